@@ -2,6 +2,7 @@ package sites
 
 import (
 	"fmt"
+	"github.com/demakes/demake/audit"
 	"github.com/demakes/demake/models"
 	"github.com/demakes/demake/ui"
 	. "github.com/gospel-sh/gospel"
@@ -11,6 +12,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 type MainServer struct {
@@ -20,8 +22,16 @@ type MainServer struct {
 }
 
 func (m *MainServer) ServeSite(site *models.Site, w http.ResponseWriter, r *http.Request) {
+
+	root := ui.ServeSite(m.db, site)
+
+	// if the site runs an experiment, the visitor might see another version
+	if headID, ok := m.experimentHead(site, w, r); ok {
+		root = ui.ServeSiteVersion(m.db, headID)
+	}
+
 	appServer := MakeServer(&App{
-		Root:         ui.ServeSite(m.db, site),
+		Root:         root,
 		StaticPrefix: "/static",
 	})
 
@@ -29,6 +39,53 @@ func (m *MainServer) ServeSite(site *models.Site, w http.ResponseWriter, r *http
 
 }
 
+// returns the head of the experiment variant the visitor was assigned to,
+// new visitors are assigned to a variant which is stored in a cookie
+func (m *MainServer) experimentHead(site *models.Site, w http.ResponseWriter, r *http.Request) (int64, bool) {
+
+	dbf := func() orm.DB { return m.db }
+
+	active, err := site.ActiveExperiment(dbf)
+
+	if err != nil {
+		fmt.Printf("Cannot load experiment: %v\n", err)
+		return 0, false
+	}
+
+	if active == nil {
+		return 0, false
+	}
+
+	cookieName := "demake-experiment-" + active.Experiment.ExtID.Hex()
+
+	if cookie, err := r.Cookie(cookieName); err == nil {
+		if variant := active.Variant(cookie.Value); variant != nil {
+			return variant.HeadID, true
+		}
+	}
+
+	variant := active.Pick()
+
+	if variant == nil {
+		return 0, false
+	}
+
+	if err := variant.RecordExposure(dbf); err != nil {
+		fmt.Printf("Cannot record exposure: %v\n", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    variant.Name,
+		Path:     "/",
+		MaxAge:   90 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return variant.HeadID, true
+}
+
 func (m *MainServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	dbf := func() orm.DB { return m.db }
 
@@ -38,14 +95,12 @@ func (m *MainServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	site := &models.Site{}
-
-	orm.Init(site, dbf)
-
 	hostnameAndPort := r.Host
 	hostname := strings.Split(hostnameAndPort, ":")[0]
 
-	if err := site.ByHostname(hostname); err != nil {
+	site, err := models.SiteByHostname(dbf, hostname)
+
+	if err != nil {
 		if err == orm.NotFound {
 			fmt.Fprintf(w, "unknown site")
 			w.Header().Add("content-type", "text/plain")
@@ -59,6 +114,7 @@ func (m *MainServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the head of the site always points to its published ref
 	m.ServeSite(site, w, r)
 }
 
@@ -76,6 +132,10 @@ func Run() error {
 		return err
 	}
 
+	if err := audit.SetTrustedProxies(settings.TrustedProxies); err != nil {
+		return err
+	}
+
 	db, err := orm.Connect("demake", settings.Database)
 
 	if err != nil {
@@ -95,16 +155,22 @@ func Run() error {
 			db:       db,
 			settings: settings,
 			appServer: MakeServer(&App{
-				Root:         ui.Root(db, profileProvider),
+				Root:         ui.Root(db, profileProvider, []byte(settings.PreviewSecret)),
 				StaticPrefix: "/static",
 			}),
 		},
 	}
 
+	// runs scheduled publications and route expiries
+	scheduler := models.MakeScheduler(func() orm.DB { return db }, time.Minute)
+	scheduler.Start()
+
 	go mainServer.ListenAndServe()
 
 	wait()
 
+	scheduler.Stop()
+
 	return nil
 }
 
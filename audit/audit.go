@@ -0,0 +1,352 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gospel-sh/gospel/orm"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Actions that are recorded in the audit log
+const (
+	Login            = "auth.login"
+	LoginFailed      = "auth.login-failed"
+	Logout           = "auth.logout"
+	SiteCreate       = "site.create"
+	SiteUpdate       = "site.update"
+	RefCreate        = "ref.create"
+	RefCommit        = "ref.commit"
+	RefRevert        = "ref.revert"
+	ChangePropose    = "change.propose"
+	ChangeReview     = "change.review"
+	ChangePublish    = "change.publish"
+	ExperimentCreate = "experiment.create"
+	ExperimentStart  = "experiment.start"
+	ExperimentStop   = "experiment.stop"
+	ScheduleCreate   = "schedule.create"
+	ScheduleCancel   = "schedule.cancel"
+	ScheduleRun      = "schedule.run"
+)
+
+// The user that performed an action, e.g. an auth.UserProfile. Only these
+// fields are recorded, as profiles can change over time.
+type Actor interface {
+	Source() string
+	SourceID() []byte
+	EMail() string
+}
+
+// An entry of the audit log. Entries are never changed or deleted, which
+// is also enforced by the database.
+type AuditEntry struct {
+	orm.DBModel
+	orm.JSONModel
+	ActorSource   string `json:"actorSource"`
+	ActorSourceID []byte `json:"actorSourceID"`
+	ActorEMail    string `json:"actorEMail" db:"col:actor_email"`
+	Action        string `json:"action"`
+	// the hex-encoded external ID of the object the action was performed on
+	TargetID string `json:"targetID"`
+	// JSON-encoded values before and after the action (if applicable)
+	Before string `json:"before"`
+	After  string `json:"after"`
+	IP     string `json:"ip" db:"col:ip"`
+}
+
+// the entry as it is exported
+type exportedEntry struct {
+	*AuditEntry
+	ID        string `json:"id"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// Filter restricts the entries that are returned, empty fields are ignored
+type Filter struct {
+	ActorEMail string
+	Action     string
+	TargetID   string
+	Since      time.Time
+	Until      time.Time
+	// the maximum number of entries (0 means unlimited)
+	Limit int
+}
+
+// the networks of reverse proxies whose X-Forwarded-For header is trusted
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the IP addresses or networks (in CIDR notation) of
+// the reverse proxies in front of the server. The X-Forwarded-For header is
+// ignored unless the request comes from one of them, as clients can set it
+// to any value.
+func SetTrustedProxies(proxies []string) error {
+
+	networks := make([]*net.IPNet, 0, len(proxies))
+
+	for _, proxy := range proxies {
+
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip == nil {
+				return fmt.Errorf("invalid proxy address '%s'", proxy)
+			} else if ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+
+		if err != nil {
+			return fmt.Errorf("invalid proxy network '%s': %v", proxy, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	trustedProxies = networks
+
+	return nil
+}
+
+func isTrustedProxy(address string) bool {
+
+	ip := net.ParseIP(address)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// returns the IP address of the client that made the request. If it was
+// forwarded by trusted proxies, this is the last address in X-Forwarded-For
+// that wasn't added by one of them.
+func clientIP(r *http.Request) string {
+
+	if r == nil {
+		return ""
+	}
+
+	ip := r.RemoteAddr
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+
+		address := strings.TrimSpace(forwarded[i])
+
+		if address == "" {
+			continue
+		}
+
+		ip = address
+
+		if !isTrustedProxy(address) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func encodeValue(value any) (string, error) {
+
+	if value == nil {
+		return "", nil
+	}
+
+	data, err := json.Marshal(value)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// Log appends an entry to the audit log. The actor and request can be nil,
+// e.g. for actions performed on the command line. The before and after
+// values are stored as JSON.
+func Log(db func() orm.DB, r *http.Request, actor Actor, action, targetID string, before, after any) error {
+
+	entry := orm.Init(&AuditEntry{
+		Action:   action,
+		TargetID: targetID,
+		IP:       clientIP(r),
+	}, db)
+
+	if actor != nil {
+		entry.ActorSource = actor.Source()
+		entry.ActorSourceID = actor.SourceID()
+		entry.ActorEMail = actor.EMail()
+	}
+
+	var err error
+
+	if entry.Before, err = encodeValue(before); err != nil {
+		return fmt.Errorf("cannot encode value: %v", err)
+	}
+
+	if entry.After, err = encodeValue(after); err != nil {
+		return fmt.Errorf("cannot encode value: %v", err)
+	}
+
+	if err := orm.Save(entry); err != nil {
+		return fmt.Errorf("cannot write audit log: %v", err)
+	}
+
+	return nil
+}
+
+// returns the query for the entries matching the filter and its arguments
+func filterQuery(filter *Filter) (string, []any) {
+
+	conditions := []string{"deleted_at IS NULL"}
+	args := []any{}
+
+	add := func(condition string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.ActorEMail != "" {
+		add("actor_email = $%d", filter.ActorEMail)
+	}
+
+	if filter.Action != "" {
+		add("action = $%d", filter.Action)
+	}
+
+	if filter.TargetID != "" {
+		add("target_id = $%d", filter.TargetID)
+	}
+
+	if !filter.Since.IsZero() {
+		add("created_at >= $%d", filter.Since.UTC())
+	}
+
+	if !filter.Until.IsZero() {
+		add("created_at < $%d", filter.Until.UTC())
+	}
+
+	query := fmt.Sprintf(`
+SELECT
+	id, ext_id, created_at, actor_source, actor_source_id, actor_email, action, target_id, before, after, ip
+FROM
+	audit_entry
+WHERE
+	%s
+ORDER BY
+	id DESC
+`, strings.Join(conditions, " AND "))
+
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf("LIMIT $%d", len(args))
+	}
+
+	return query, args
+}
+
+// Each calls the given function for each entry matching the filter, most
+// recent entries first
+func Each(db func() orm.DB, filter *Filter, f func(entry *AuditEntry) error) error {
+
+	if filter == nil {
+		filter = &Filter{}
+	}
+
+	query, args := filterQuery(filter)
+
+	rows, err := db().Query(query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		entry := &AuditEntry{}
+
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.ExtID,
+			&entry.CreatedAt,
+			&entry.ActorSource,
+			&entry.ActorSourceID,
+			&entry.ActorEMail,
+			&entry.Action,
+			&entry.TargetID,
+			&entry.Before,
+			&entry.After,
+			&entry.IP,
+		); err != nil {
+			return fmt.Errorf("scan error: %v", err)
+		}
+
+		if err := f(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Entries returns the entries matching the filter, most recent entries first
+func Entries(db func() orm.DB, filter *Filter) ([]*AuditEntry, error) {
+
+	entries := make([]*AuditEntry, 0)
+
+	if err := Each(db, filter, func(entry *AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Export writes the entries matching the filter to the writer as JSON lines
+// and returns the number of exported entries
+func Export(db func() orm.DB, filter *Filter, w io.Writer) (int, error) {
+
+	encoder := json.NewEncoder(w)
+	n := 0
+
+	err := Each(db, filter, func(entry *AuditEntry) error {
+
+		exported := &exportedEntry{
+			AuditEntry: entry,
+			ID:         entry.ExtID.Hex(),
+			CreatedAt:  entry.CreatedAt.String(),
+		}
+
+		n++
+
+		return encoder.Encode(exported)
+	})
+
+	return n, err
+}
@@ -0,0 +1,160 @@
+package audit_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/auth"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	user := &auth.BasicUserProfile{
+		BasicUserProfileFields: auth.BasicUserProfileFields{
+			EMail:  "editor@example.com",
+			Source: "test",
+		},
+	}
+
+	r := httptest.NewRequest("POST", "/demake/sites/new", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+
+	if err := audit.Log(dbf, r, user, audit.SiteCreate, "aabb", nil, map[string]any{"hostname": "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := audit.Log(dbf, nil, nil, audit.SiteUpdate, "aabb", map[string]any{"hostname": "example.com"}, map[string]any{"hostname": "example.org"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := audit.Entries(dbf, &audit.Filter{ActorEMail: "editor@example.com"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry, got %d", len(entries))
+	}
+
+	if entries[0].IP != "192.0.2.1" || entries[0].Action != audit.SiteCreate || entries[0].After != `{"hostname":"example.com"}` {
+		t.Fatalf("unexpected entry: %+v", entries[0])
+	}
+
+	if entries, err := audit.Entries(dbf, &audit.Filter{TargetID: "aabb"}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 || entries[0].Action != audit.SiteUpdate {
+		t.Fatalf("expected both entries, most recent first")
+	}
+
+	// entries can't be changed
+	if _, err := db.Exec(`UPDATE audit_entry SET action = 'foo'`); err == nil {
+		t.Fatalf("expected an error when changing an entry")
+	}
+
+	buffer := bytes.NewBuffer(nil)
+
+	n, err := audit.Export(dbf, nil, buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Fatalf("expected 2 exported entries, got %d", n)
+	}
+
+	scanner := bufio.NewScanner(buffer)
+
+	for scanner.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["targetID"] != "aabb" {
+			t.Fatalf("unexpected exported entry: %s", scanner.Text())
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	if err := audit.SetTrustedProxies([]string{"proxy"}); err == nil {
+		t.Fatalf("expected an error for an invalid proxy")
+	}
+
+	if err := audit.SetTrustedProxies([]string{"10.0.0.0/8", "192.0.2.10"}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer audit.SetTrustedProxies(nil)
+
+	for i, test := range []struct {
+		remoteAddr string
+		forwarded  string
+		ip         string
+	}{
+		// clients can't set their own address
+		{"192.0.2.1:1234", "203.0.113.1", "192.0.2.1"},
+		{"192.0.2.10:1234", "203.0.113.1", "203.0.113.1"},
+		// addresses added by trusted proxies are skipped
+		{"10.0.0.1:1234", "203.0.113.1, 203.0.113.2, 10.0.0.2", "203.0.113.2"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+	} {
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+
+		if err := audit.Log(dbf, r, nil, audit.Login, "", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := audit.Entries(dbf, &audit.Filter{Limit: 1})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if entries[0].IP != test.ip {
+			t.Fatalf("test %d: expected IP %s, got %s", i, test.ip, entries[0].IP)
+		}
+	}
+}
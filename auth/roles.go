@@ -0,0 +1,31 @@
+package auth
+
+const (
+	// users with this role can e.g. view the audit log
+	AdminRole = "admin"
+	// users with this role can approve or reject changes
+	ReviewerRole = "reviewer"
+)
+
+// HasRole returns true if the user has the given role in any of their
+// organizations. Superusers have all roles.
+func HasRole(user UserProfile, role string) bool {
+
+	if user == nil {
+		return false
+	}
+
+	if user.SuperUser() {
+		return true
+	}
+
+	for _, orgRoles := range user.Roles() {
+		for _, orgRole := range orgRoles.Roles() {
+			if orgRole == role {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -1,5 +1,9 @@
 package auth
 
+import (
+	"encoding/json"
+)
+
 type UserProfile interface {
 	Source() string
 	SourceID() []byte
@@ -79,6 +83,29 @@ type BasicOrganization struct {
 	BasicOrganizationFields
 }
 
+// UnmarshalJSON decodes the roles of the user as BasicOrganizationRoles,
+// e.g. to give users of the simple provider roles in an organization
+func (w *BasicUserProfile) UnmarshalJSON(data []byte) error {
+
+	var profile struct {
+		BasicUserProfileFields
+		Roles []*BasicOrganizationRoles `json:"roles"`
+	}
+
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return err
+	}
+
+	w.BasicUserProfileFields = profile.BasicUserProfileFields
+	w.BasicUserProfileFields.Roles = make([]OrganizationRoles, len(profile.Roles))
+
+	for i, roles := range profile.Roles {
+		w.BasicUserProfileFields.Roles[i] = roles
+	}
+
+	return nil
+}
+
 func (w *BasicUserProfile) Password() string {
 	return w.BasicUserProfileFields.Password
 }
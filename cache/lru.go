@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// LRU is a thread-safe cache with a fixed capacity that evicts the least
+// recently used entries first. Entries can optionally expire after a TTL.
+type LRU[K comparable, V any] struct {
+	mutex    sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[K]*list.Element
+	order    *list.List
+	hits     uint64
+	misses   uint64
+}
+
+type Stats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// MakeLRU creates a new cache, a TTL of 0 means entries never expire
+func MakeLRU[K comparable, V any](capacity int, ttl time.Duration) *LRU[K, V] {
+	return &LRU[K, V]{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[K]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (l *LRU[K, V]) Get(key K) (V, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if element, ok := l.entries[key]; ok {
+		e := element.Value.(*entry[K, V])
+		if l.ttl == 0 || time.Now().Before(e.expires) {
+			l.order.MoveToFront(element)
+			l.hits++
+			return e.value, true
+		}
+		// the entry has expired
+		l.remove(element)
+	}
+
+	l.misses++
+
+	var zero V
+	return zero, false
+}
+
+func (l *LRU[K, V]) Set(key K, value V) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var expires time.Time
+
+	if l.ttl > 0 {
+		expires = time.Now().Add(l.ttl)
+	}
+
+	if element, ok := l.entries[key]; ok {
+		e := element.Value.(*entry[K, V])
+		e.value = value
+		e.expires = expires
+		l.order.MoveToFront(element)
+		return
+	}
+
+	l.entries[key] = l.order.PushFront(&entry[K, V]{
+		key:     key,
+		value:   value,
+		expires: expires,
+	})
+
+	for l.order.Len() > l.capacity {
+		l.remove(l.order.Back())
+	}
+}
+
+func (l *LRU[K, V]) Delete(key K) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if element, ok := l.entries[key]; ok {
+		l.remove(element)
+	}
+}
+
+// DeleteFunc removes all entries for which the given function returns true
+func (l *LRU[K, V]) DeleteFunc(f func(key K, value V) bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for element := l.order.Front(); element != nil; {
+		next := element.Next()
+		e := element.Value.(*entry[K, V])
+		if f(e.key, e.value) {
+			l.remove(element)
+		}
+		element = next
+	}
+}
+
+func (l *LRU[K, V]) Purge() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.entries = make(map[K]*list.Element)
+	l.order.Init()
+}
+
+func (l *LRU[K, V]) Stats() Stats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return Stats{
+		Hits:    l.hits,
+		Misses:  l.misses,
+		Entries: l.order.Len(),
+	}
+}
+
+func (l *LRU[K, V]) remove(element *list.Element) {
+	e := element.Value.(*entry[K, V])
+	delete(l.entries, e.key)
+	l.order.Remove(element)
+}
@@ -0,0 +1,55 @@
+package cache_test
+
+import (
+	"github.com/demakes/demake/cache"
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+
+	lru := cache.MakeLRU[string, int](2, 0)
+
+	lru.Set("a", 1)
+	lru.Set("b", 2)
+
+	if v, ok := lru.Get("a"); !ok || v != 1 {
+		t.Fatalf("expected a cache hit")
+	}
+
+	// this evicts 'b', as 'a' was used more recently
+	lru.Set("c", 3)
+
+	if _, ok := lru.Get("b"); ok {
+		t.Fatalf("expected 'b' to be evicted")
+	}
+
+	if _, ok := lru.Get("c"); !ok {
+		t.Fatalf("expected 'c' to be cached")
+	}
+
+	lru.DeleteFunc(func(key string, value int) bool { return value == 3 })
+
+	if _, ok := lru.Get("c"); ok {
+		t.Fatalf("expected 'c' to be deleted")
+	}
+
+	stats := lru.Stats()
+
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Entries != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestLRUExpiry(t *testing.T) {
+
+	lru := cache.MakeLRU[string, int](10, time.Millisecond)
+
+	lru.Set("a", 1)
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := lru.Get("a"); ok {
+		t.Fatalf("expected the entry to expire")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/models"
+	"github.com/gospel-sh/gospel/orm"
+	"io"
+	"os"
+)
+
+func runApply(args []string) error {
+
+	applyFlags := flag.NewFlagSet("apply", flag.ExitOnError)
+
+	var filename string
+	var publish bool
+
+	applyFlags.StringVar(&filename, "f", "", "the YAML file with the site definition ('-' for stdin)")
+	applyFlags.BoolVar(&publish, "publish", false, "publish the site instead of committing it to the draft")
+
+	applyFlags.Parse(args)
+
+	if filename == "" {
+		return fmt.Errorf("usage: demake apply [-publish] -f site.yaml")
+	}
+
+	var r io.Reader = os.Stdin
+
+	if filename != "-" {
+
+		f, err := os.Open(filename)
+
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		r = f
+	}
+
+	definition, err := models.ReadSiteDefinition(r)
+
+	if err != nil {
+		return err
+	}
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	site, commit, err := models.ApplySite(db, definition, nil, publish)
+
+	if err != nil {
+		return err
+	}
+
+	if commit == nil {
+		fmt.Printf("Site '%s' is up to date.\n", site.Hostname)
+		return nil
+	}
+
+	refName := models.DraftRef
+
+	if publish {
+		refName = models.PublishedRef
+	}
+
+	if err := audit.Log(db, nil, nil, audit.RefCommit, site.ExtID.Hex(), nil, map[string]any{"ref": refName, "commit": commit.ExtID.Hex(), "definition": filename}); err != nil {
+		return err
+	}
+
+	if !publish {
+		fmt.Printf("Updated the draft of site '%s' (commit %s), please propose the changes to publish them.\n", site.Hostname, commit.ExtID.Hex())
+		return nil
+	}
+
+	fmt.Printf("Updated site '%s' (commit %s).\n", site.Hostname, commit.ExtID.Hex())
+
+	return nil
+}
+
+func runSiteDump(args []string) error {
+
+	dumpFlags := flag.NewFlagSet("site dump", flag.ExitOnError)
+
+	var refName, output string
+
+	dumpFlags.StringVar(&refName, "ref", models.PublishedRef, "dump this ref of the site")
+	dumpFlags.StringVar(&output, "o", "", "write to this file instead of stdout")
+
+	dumpFlags.Parse(args)
+
+	if dumpFlags.NArg() != 1 {
+		return fmt.Errorf("usage: demake site dump [-ref ref] [-o file] <hostname>")
+	}
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	site := orm.Init(&models.Site{}, db)
+
+	if err := site.ByHostname(dumpFlags.Arg(0)); err != nil {
+		return fmt.Errorf("cannot find site '%s': %v", dumpFlags.Arg(0), err)
+	}
+
+	definition, err := models.DumpSite(db, site, refName)
+
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+
+	if output != "" {
+
+		if w, err = os.Create(output); err != nil {
+			return err
+		}
+
+		defer w.Close()
+	}
+
+	return models.WriteSiteDefinition(w, definition)
+}
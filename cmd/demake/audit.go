@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/demakes/demake/audit"
+	"os"
+	"time"
+)
+
+func runAudit(args []string) error {
+
+	if len(args) == 0 || args[0] != "export" {
+		return fmt.Errorf("usage: demake audit export [flags]")
+	}
+
+	exportFlags := flag.NewFlagSet("audit export", flag.ExitOnError)
+
+	filter := &audit.Filter{}
+
+	var since, until, output string
+
+	exportFlags.StringVar(&filter.ActorEMail, "actor", "", "only export actions of the user with this e-mail")
+	exportFlags.StringVar(&filter.Action, "action", "", "only export this action, e.g. 'site.create'")
+	exportFlags.StringVar(&filter.TargetID, "target", "", "only export actions on the object with this (hex-encoded) ID")
+	exportFlags.StringVar(&since, "since", "", "only export actions at or after this time (RFC 3339)")
+	exportFlags.StringVar(&until, "until", "", "only export actions before this time (RFC 3339)")
+	exportFlags.StringVar(&output, "o", "", "write to this file instead of stdout")
+
+	exportFlags.Parse(args[1:])
+
+	var err error
+
+	if since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return fmt.Errorf("invalid time '%s': %v", since, err)
+		}
+	}
+
+	if until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return fmt.Errorf("invalid time '%s': %v", until, err)
+		}
+	}
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+
+	if output != "" {
+
+		if w, err = os.Create(output); err != nil {
+			return err
+		}
+
+		defer w.Close()
+	}
+
+	n, err := audit.Export(db, filter, w)
+
+	if err != nil {
+		return err
+	}
+
+	// we don't write to stdout as it might contain the exported entries
+	fmt.Fprintf(os.Stderr, "Exported %d entries.\n", n)
+
+	return nil
+}
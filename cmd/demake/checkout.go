@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/models"
+	"github.com/gospel-sh/gospel/orm"
+)
+
+func runSiteCheckout(args []string) error {
+
+	checkoutFlags := flag.NewFlagSet("site checkout", flag.ExitOnError)
+
+	var refName string
+
+	checkoutFlags.StringVar(&refName, "ref", models.DraftRef, "check out this ref of the site")
+
+	checkoutFlags.Parse(args)
+
+	if checkoutFlags.NArg() != 2 {
+		return fmt.Errorf("usage: demake site checkout [-ref ref] <hostname> <dir>")
+	}
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	site := orm.Init(&models.Site{}, db)
+
+	if err := site.ByHostname(checkoutFlags.Arg(0)); err != nil {
+		return fmt.Errorf("cannot find site '%s': %v", checkoutFlags.Arg(0), err)
+	}
+
+	checkout, err := models.CheckoutSite(db, site, refName, checkoutFlags.Arg(1))
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checked out '%s' of '%s' (%s).\n", checkout.Ref, checkout.Hostname, checkout.Head)
+
+	return nil
+}
+
+func runSiteCommit(args []string) error {
+
+	commitFlags := flag.NewFlagSet("site commit", flag.ExitOnError)
+
+	var message string
+
+	commitFlags.StringVar(&message, "m", "Commit checkout", "the commit message")
+
+	commitFlags.Parse(args)
+
+	if commitFlags.NArg() != 1 {
+		return fmt.Errorf("usage: demake site commit [-m message] <dir>")
+	}
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	commit, err := models.CommitCheckout(db, commitFlags.Arg(0), nil, message)
+
+	if err != nil {
+		if _, ok := err.(*models.HeadConflictError); ok {
+			return fmt.Errorf("%v, please check out the site again and reapply your changes", err)
+		}
+		return err
+	}
+
+	if commit == nil {
+		fmt.Println("Nothing to commit.")
+		return nil
+	}
+
+	site := orm.Init(&models.Site{}, db)
+
+	if err := site.ByID(commit.SiteID); err != nil {
+		return err
+	}
+
+	if err := audit.Log(db, nil, nil, audit.RefCommit, site.ExtID.Hex(), nil, map[string]any{"commit": commit.ExtID.Hex(), "checkout": commitFlags.Arg(0)}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created commit %s.\n", commit.ExtID.Hex())
+
+	return nil
+}
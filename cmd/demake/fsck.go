@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"github.com/demakes/demake/models"
+)
+
+func runFsck() error {
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	problems, err := models.Fsck(db)
+
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s)", len(problems))
+	}
+
+	fmt.Println("No problems found.")
+
+	return nil
+}
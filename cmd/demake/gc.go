@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	"github.com/gospel-sh/gospel/orm"
+	"time"
+)
+
+func connect() (func() orm.DB, error) {
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := orm.Connect("demake", settings.Database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return func() orm.DB { return db }, nil
+}
+
+func runGC(args []string) error {
+
+	gcFlags := flag.NewFlagSet("gc", flag.ExitOnError)
+
+	options := &models.GCOptions{}
+
+	gcFlags.BoolVar(&options.DryRun, "dry-run", false, "only show what would be deleted")
+	gcFlags.BoolVar(&options.Hard, "hard", false, "permanently delete nodes and edges")
+	gcFlags.DurationVar(&options.GracePeriod, "grace", 24*time.Hour, "keep nodes created or reused within this period")
+	gcFlags.IntVar(&options.BatchSize, "batch", 1000, "number of nodes to delete in one transaction")
+
+	gcFlags.Parse(args)
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	result, err := models.GC(db, options)
+
+	if err != nil {
+		return err
+	}
+
+	verb := "Deleted"
+
+	if options.DryRun {
+		verb = "Would delete"
+	}
+
+	fmt.Printf("%d reachable nodes. %s %d nodes and %d edges.\n", result.Reachable, verb, result.Nodes, result.Edges)
+
+	return nil
+}
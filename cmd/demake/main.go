@@ -29,6 +29,41 @@ func main() {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(-1)
 		}
+	case "gc":
+		if err := runGC(os.Args[2:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(-1)
+		}
+	case "fsck":
+		if err := runFsck(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(-1)
+		}
+	case "rehash":
+		if err := runRehash(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(-1)
+		}
+	case "audit":
+		if err := runAudit(os.Args[2:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(-1)
+		}
+	case "site":
+		if err := runSite(os.Args[2:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(-1)
+		}
+	case "apply":
+		if err := runApply(os.Args[2:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(-1)
+		}
+	case "query":
+		if err := runQuery(os.Args[2:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(-1)
+		}
 	case "run":
 		if err := sites.Run(); err != nil {
 			fmt.Printf("error running: %v", err)
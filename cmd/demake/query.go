@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/demakes/demake/models"
+	"github.com/gospel-sh/gospel/orm"
+	"os"
+)
+
+// a node matched by a query, as printed by 'demake query'
+type queryResult struct {
+	Path  string         `json:"path"`
+	Hash  string         `json:"hash"`
+	Type  string         `json:"type"`
+	Value map[string]any `json:"value"`
+}
+
+func runQuery(args []string) error {
+
+	queryFlags := flag.NewFlagSet("query", flag.ExitOnError)
+
+	var refName string
+
+	queryFlags.StringVar(&refName, "ref", models.PublishedRef, "query this ref of the site")
+
+	queryFlags.Parse(args)
+
+	if queryFlags.NArg() != 2 {
+		return fmt.Errorf("usage: demake query [-ref ref] <hostname> <expr>, e.g. 'plugins[*]/posts[type=blogPost]/title'")
+	}
+
+	query, err := models.ParsePathQuery(queryFlags.Arg(1))
+
+	if err != nil {
+		return fmt.Errorf("invalid query: %v", err)
+	}
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	site := orm.Init(&models.Site{}, db)
+
+	if err := site.ByHostname(queryFlags.Arg(0)); err != nil {
+		return fmt.Errorf("cannot find site '%s': %v", queryFlags.Arg(0), err)
+	}
+
+	ref, err := site.Ref(db, refName)
+
+	if err != nil {
+		return fmt.Errorf("cannot load ref '%s': %v", refName, err)
+	}
+
+	matches, err := query.Query(db, ref.HeadID)
+
+	if err != nil {
+		return err
+	}
+
+	results := make([]*queryResult, len(matches))
+	// the matches are part of the same graph, so nodes can be shared
+	nodes := map[int64]*models.Node{}
+
+	for i, match := range matches {
+
+		if err := models.LoadStub(db, match.Node, nil, nodes); err != nil {
+			return fmt.Errorf("cannot load %s: %v", match.Path, err)
+		}
+
+		value, err := match.Definition()
+
+		if err != nil {
+			return fmt.Errorf("cannot convert %s: %v", match.Path, err)
+		}
+
+		results[i] = &queryResult{
+			Path:  match.Path,
+			Hash:  models.HexHash(match.Node.Hash),
+			Type:  match.Node.Type,
+			Value: value,
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(results)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"github.com/demakes/demake/models"
+)
+
+func runRehash() error {
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	result, err := models.Rehash(db)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rehashed %d graphs, updated %d sites, %d refs, %d commits, %d change requests, %d schedules and %d experiment variants.\n", result.Graphs, result.Sites, result.Refs, result.Commits, result.ChangeRequests, result.Schedules, result.Variants)
+
+	if result.Graphs > 0 {
+		fmt.Println("Run 'demake gc' to remove the old nodes.")
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/models"
+	"github.com/gospel-sh/gospel/orm"
+	"io"
+	"os"
+)
+
+func runSite(args []string) error {
+
+	usage := fmt.Errorf("usage: demake site export|import|dump|checkout|commit|head [flags]")
+
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "export":
+		return runSiteExport(args[1:])
+	case "import":
+		return runSiteImport(args[1:])
+	case "dump":
+		return runSiteDump(args[1:])
+	case "checkout":
+		return runSiteCheckout(args[1:])
+	case "commit":
+		return runSiteCommit(args[1:])
+	case "head":
+		return runSiteHead(args[1:])
+	}
+
+	return usage
+}
+
+func runSiteExport(args []string) error {
+
+	exportFlags := flag.NewFlagSet("site export", flag.ExitOnError)
+
+	var output string
+
+	exportFlags.StringVar(&output, "o", "", "write to this file instead of stdout")
+
+	exportFlags.Parse(args)
+
+	if exportFlags.NArg() != 1 {
+		return fmt.Errorf("usage: demake site export [-o file] <hostname>")
+	}
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	site := orm.Init(&models.Site{}, db)
+
+	if err := site.ByHostname(exportFlags.Arg(0)); err != nil {
+		return fmt.Errorf("cannot find site '%s': %v", exportFlags.Arg(0), err)
+	}
+
+	bundle, err := models.ExportSite(db, site)
+
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+
+	if output != "" {
+
+		if w, err = os.Create(output); err != nil {
+			return err
+		}
+
+		defer w.Close()
+	}
+
+	if err := models.WriteBundle(w, bundle); err != nil {
+		return err
+	}
+
+	// we don't write to stdout as it might contain the bundle
+	fmt.Fprintf(os.Stderr, "Exported %d nodes.\n", len(bundle.Nodes))
+
+	return nil
+}
+
+func runSiteImport(args []string) error {
+
+	importFlags := flag.NewFlagSet("site import", flag.ExitOnError)
+
+	var hostname string
+
+	importFlags.StringVar(&hostname, "hostname", "", "use this hostname instead of the exported one")
+
+	importFlags.Parse(args)
+
+	var r io.Reader = os.Stdin
+
+	if importFlags.NArg() > 0 {
+
+		f, err := os.Open(importFlags.Arg(0))
+
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		r = f
+	}
+
+	bundle, err := models.ReadBundle(r)
+
+	if err != nil {
+		return err
+	}
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	site, err := models.ImportBundle(db, bundle, hostname)
+
+	if err != nil {
+		return err
+	}
+
+	if err := audit.Log(db, nil, nil, audit.SiteCreate, site.ExtID.Hex(), nil, map[string]any{"name": site.Name, "hostname": site.Hostname, "bundle": true}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported site '%s' (%s) with %d nodes.\n", site.Name, site.Hostname, len(bundle.Nodes))
+
+	return nil
+}
+
+func runSiteHead(args []string) error {
+
+	headFlags := flag.NewFlagSet("site head", flag.ExitOnError)
+
+	var refName string
+	var useBase32 bool
+
+	headFlags.StringVar(&refName, "ref", models.PublishedRef, "print the head of this ref")
+	headFlags.BoolVar(&useBase32, "base32", false, "print the hash in base32 instead of hex")
+
+	headFlags.Parse(args)
+
+	if headFlags.NArg() != 1 {
+		return fmt.Errorf("usage: demake site head [-ref ref] [-base32] <hostname>")
+	}
+
+	db, err := connect()
+
+	if err != nil {
+		return err
+	}
+
+	site := orm.Init(&models.Site{}, db)
+
+	if err := site.ByHostname(headFlags.Arg(0)); err != nil {
+		return fmt.Errorf("cannot find site '%s': %v", headFlags.Arg(0), err)
+	}
+
+	ref, err := site.Ref(db, refName)
+
+	if err != nil {
+		return fmt.Errorf("cannot load ref '%s': %v", refName, err)
+	}
+
+	hash, err := ref.HeadHash(db)
+
+	if err != nil {
+		return err
+	}
+
+	if useBase32 {
+		fmt.Println(models.Base32Hash(hash))
+	} else {
+		fmt.Println(models.HexHash(hash))
+	}
+
+	return nil
+}
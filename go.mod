@@ -3,14 +3,15 @@ module github.com/demakes/demake
 go 1.20
 
 require (
+	github.com/getworf/worf-go v0.0.0-20240131141613-a1aafe24d392
 	github.com/gospel-sh/gospel v0.0.0-20230906113311-54b3a4d459dd
 	github.com/jackc/pgx/v5 v5.5.5
 	github.com/mattn/go-sqlite3 v1.14.22
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
-	github.com/getworf/worf-go v0.0.0-20240131141613-a1aafe24d392 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
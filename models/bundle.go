@@ -0,0 +1,299 @@
+package models
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gospel-sh/gospel/orm"
+	"io"
+)
+
+// the current version of the bundle format
+const BundleVersion = 1
+
+// A bundle contains a site and all nodes reachable from its head in a single
+// file, so sites can be moved between databases (e.g. from SQLite to
+// Postgres) or attached to bug reports.
+type Bundle struct {
+	Version int         `json:"version"`
+	Site    *BundleSite `json:"site"`
+	// the hash of the head node
+	Head []byte `json:"head"`
+	// the nodes reachable from the head, keyed by their hex-encoded hash
+	Nodes map[string]*nodeRecord `json:"nodes"`
+}
+
+// the metadata of the exported site
+type BundleSite struct {
+	Name        string `json:"name"`
+	Hostname    string `json:"hostname"`
+	Description string `json:"description"`
+}
+
+// adds the node and its descendants to the bundle, including the targets
+// of references (which are loaded as stubs), already loaded nodes are reused
+func (b *Bundle) addNode(db func() orm.DB, node *Node, nodes map[int64]*Node) error {
+
+	hash := hex.EncodeToString(node.Hash)
+
+	if _, ok := b.Nodes[hash]; ok {
+		return nil
+	}
+
+	if node.Stub {
+		if err := LoadStub(db, node, nil, nodes); err != nil {
+			return fmt.Errorf("cannot load referenced node %s: %v", hash, err)
+		}
+	}
+
+	record := makeNodeRecord(node)
+	// IDs are local to the database
+	record.ID = 0
+
+	b.Nodes[hash] = record
+
+	for _, edge := range node.Outgoing {
+		if err := b.addNode(db, edge.To, nodes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// returns the node with the given hash and its descendants, which are
+// taken from the given map if they were built before
+func (b *Bundle) buildNode(hash string, nodes map[string]*Node) (*Node, error) {
+
+	if node, ok := nodes[hash]; ok {
+		if node == nil {
+			return nil, fmt.Errorf("node %s refers to itself", hash)
+		}
+		return node, nil
+	}
+
+	record, ok := b.Nodes[hash]
+
+	if !ok {
+		return nil, fmt.Errorf("node %s is missing in the bundle", hash)
+	}
+
+	if hex.EncodeToString(record.Hash) != hash {
+		return nil, fmt.Errorf("node %s has a different hash", hash)
+	}
+
+	// marks the node as being built, so we can detect cycles
+	nodes[hash] = nil
+
+	node := &Node{
+		Hash: record.Hash,
+		Type: record.Type,
+		Data: recordData(record.Data),
+	}
+
+	for _, edgeRecord := range record.Edges {
+
+		toNode, err := b.buildNode(hex.EncodeToString(edgeRecord.To), nodes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		edge := MakeEdge()
+		edge.Name = edgeRecord.Name
+		edge.Type = edgeRecord.Type
+		edge.Key = edgeRecord.Key
+		edge.Index = edgeRecord.Index
+		edge.Follow = edgeRecord.Follow
+		edge.Data = recordData(edgeRecord.Data)
+
+		edge.FromTo(node, toNode)
+	}
+
+	nodes[hash] = node
+
+	return node, nil
+}
+
+// Graph returns the graph of the bundle, starting at the head
+func (b *Bundle) Graph() (*Node, error) {
+	return b.buildNode(hex.EncodeToString(b.Head), map[string]*Node{})
+}
+
+// checks that the hashes in the graph match the ones obtained by serializing
+// it again, so a bundle can't store nodes under the hash of another node
+func verifyHashes(node *Node, verified map[*Node]bool) error {
+
+	if verified[node] {
+		return nil
+	}
+
+	verified[node] = true
+
+	model, err := Deserialize(node)
+
+	if err != nil {
+		return fmt.Errorf("cannot deserialize node %s: %v", hex.EncodeToString(node.Hash), err)
+	}
+
+	recomputed, err := Serialize(model)
+
+	if err != nil {
+		return fmt.Errorf("cannot serialize node %s: %v", hex.EncodeToString(node.Hash), err)
+	}
+
+	var mismatch error
+
+	compareHashes(node, recomputed, "", func(stored *Node, path string, message string, args ...any) {
+		if mismatch == nil {
+			mismatch = fmt.Errorf("node %s at %s: %s", hex.EncodeToString(node.Hash), path, fmt.Sprintf(message, args...))
+		}
+	})
+
+	if mismatch != nil {
+		return mismatch
+	}
+
+	// referenced graphs keep their hash when serializing, so we check them
+	// separately
+	return verifyReferences(node, verified, map[*Node]bool{})
+}
+
+func verifyReferences(node *Node, verified, visited map[*Node]bool) error {
+
+	if visited[node] {
+		return nil
+	}
+
+	visited[node] = true
+
+	for _, edge := range node.Outgoing {
+
+		var err error
+
+		if edge.Follow {
+			err = verifyReferences(edge.To, verified, visited)
+		} else {
+			err = verifyHashes(edge.To, verified)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExportSite creates a bundle with the published version of the site
+func ExportSite(db func() orm.DB, site *Site) (*Bundle, error) {
+
+	if site.HeadID == nil {
+		return nil, fmt.Errorf("site doesn't have a head")
+	}
+
+	head, err := MakeSQLStore(db).GetByID(*site.HeadID)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load head: %v", err)
+	}
+
+	bundle := &Bundle{
+		Version: BundleVersion,
+		Site: &BundleSite{
+			Name:        site.Name,
+			Hostname:    site.Hostname,
+			Description: site.Description,
+		},
+		Head:  head.Hash,
+		Nodes: map[string]*nodeRecord{},
+	}
+
+	if err := bundle.addNode(db, head, head.NodesByID()); err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// ImportBundle creates a new site from the bundle. The hashes of the nodes
+// are checked before saving them, and nodes that already exist in the
+// database are reused. If the site can't be committed, it is removed again.
+// If hostname isn't empty it replaces the hostname of the exported site.
+func ImportBundle(db func() orm.DB, bundle *Bundle, hostname string) (*Site, error) {
+
+	if bundle.Version != BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", bundle.Version)
+	}
+
+	if bundle.Site == nil {
+		return nil, fmt.Errorf("bundle doesn't contain a site")
+	}
+
+	if hostname == "" {
+		hostname = bundle.Site.Hostname
+	}
+
+	existing := orm.Init(&Site{}, db)
+
+	if err := existing.ByHostname(hostname); err == nil {
+		return nil, fmt.Errorf("a site with hostname '%s' already exists", hostname)
+	} else if err != orm.NotFound {
+		return nil, err
+	}
+
+	head, err := bundle.Graph()
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle: %v", err)
+	}
+
+	if err := verifyHashes(head, map[*Node]bool{}); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %v", err)
+	}
+
+	// the unique index on the node hash deduplicates existing nodes
+	if err := MakeSQLStore(db).PutTree(head); err != nil {
+		return nil, fmt.Errorf("cannot save nodes: %v", err)
+	}
+
+	site := orm.Init(&Site{
+		Name:        bundle.Site.Name,
+		Hostname:    hostname,
+		Description: bundle.Site.Description,
+	}, db)
+
+	if err := site.Save(); err != nil {
+		return nil, fmt.Errorf("cannot save site: %v", err)
+	}
+
+	if _, err := site.CommitHead(db, head, nil, "Import bundle"); err != nil {
+		return nil, site.removeCreated(db, err)
+	}
+
+	// changes are made in the draft and published explicitly
+	if _, err := site.CreateRef(db, DraftRef, PublishedRef); err != nil {
+		return nil, site.removeCreated(db, err)
+	}
+
+	return site, nil
+}
+
+// WriteBundle writes the bundle as JSON
+func WriteBundle(w io.Writer, bundle *Bundle) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(bundle)
+}
+
+// ReadBundle reads a bundle written by WriteBundle
+func ReadBundle(r io.Reader) (*Bundle, error) {
+
+	bundle := &Bundle{}
+
+	if err := json.NewDecoder(r).Decode(bundle); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %v", err)
+	}
+
+	return bundle, nil
+}
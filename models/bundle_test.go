@@ -0,0 +1,152 @@
+package models_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example", Description: "a test site"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := models.Serialize(makeSiteGraph("/", "/about"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CommitHead(dbf, node, nil, "initial version"); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := models.ExportSite(dbf, site)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := &bytes.Buffer{}
+
+	if err := models.WriteBundle(buffer, bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	// we import the bundle into an empty database
+	if db, err = kt.DB(settings); err != nil {
+		t.Fatal(err)
+	}
+
+	readBundle, err := models.ReadBundle(buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := models.ImportBundle(dbf, readBundle, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if imported.Name != "test" || imported.Hostname != "test.example" || imported.Description != "a test site" {
+		t.Fatalf("site metadata doesn't match: %v", imported)
+	}
+
+	importedNode, err := models.GetGraphByID(dbf, *imported.HeadID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(importedNode.Hash, node.Hash) {
+		t.Fatalf("hashes don't match")
+	}
+
+	if _, err := imported.Ref(dbf, models.DraftRef); err != nil {
+		t.Fatalf("expected a draft: %v", err)
+	}
+
+	if routes := headRoutes(t, dbf, *imported.HeadID); len(routes) != 2 {
+		t.Fatalf("expected two routes, got %v", routes)
+	}
+
+	if _, err := models.ImportBundle(dbf, readBundle, ""); err == nil {
+		t.Fatalf("expected an error as the hostname exists")
+	}
+
+	n := countNodes(t, db)
+
+	// existing nodes are reused
+	if _, err := models.ImportBundle(dbf, readBundle, "copy.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	if countNodes(t, db) != n {
+		t.Fatalf("expected no new nodes")
+	}
+
+	// we change the route of a node but keep its hash
+	tampered := false
+
+	for _, record := range readBundle.Nodes {
+		if bytes.Contains(record.Data, []byte("/about")) {
+			record.Data = bytes.Replace(record.Data, []byte("/about"), []byte("/admin"), 1)
+			tampered = true
+		}
+	}
+
+	if !tampered {
+		t.Fatalf("expected a node with the route")
+	}
+
+	if _, err := models.ImportBundle(dbf, readBundle, "tampered.example"); err == nil {
+		t.Fatalf("expected an error as a hash doesn't match")
+	}
+
+	if countNodes(t, db) != n {
+		t.Fatalf("expected no new nodes")
+	}
+
+	// we remove a node from the bundle
+	for hash := range readBundle.Nodes {
+		if hash != hex.EncodeToString(readBundle.Head) {
+			delete(readBundle.Nodes, hash)
+			break
+		}
+	}
+
+	if _, err := models.ImportBundle(dbf, readBundle, "broken.example"); err == nil {
+		t.Fatalf("expected an error as a node is missing")
+	}
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"github.com/demakes/demake/cache"
+	"github.com/gospel-sh/gospel/orm"
+	"time"
+)
+
+// caches sites by their hostname. Sites can also be changed by other
+// processes, so entries expire after a short time.
+var SiteCache = cache.MakeLRU[string, *Site](1024, time.Minute)
+
+// caches deserialized site graphs by the ID of their head node. As nodes
+// never change, entries only need to be removed to free memory.
+var SiteGraphCache = cache.MakeLRU[int64, *SiteGraph](128, 0)
+
+// SiteByHostname returns the (possibly cached) site for the given hostname.
+// The returned site is shared and must not be modified.
+func SiteByHostname(db func() orm.DB, hostname string) (*Site, error) {
+
+	if site, ok := SiteCache.Get(hostname); ok {
+		return site, nil
+	}
+
+	site := orm.Init(&Site{}, db)
+
+	if err := site.ByHostname(hostname); err != nil {
+		return nil, err
+	}
+
+	SiteCache.Set(hostname, site)
+
+	return site, nil
+}
+
+// CachedSiteGraph returns the (possibly cached) site graph with the given
+// head. The returned graph is shared and must not be modified.
+func CachedSiteGraph(db func() orm.DB, headID int64) (*SiteGraph, error) {
+
+	if siteGraph, ok := SiteGraphCache.Get(headID); ok {
+		return siteGraph, nil
+	}
+
+	node, err := MakeSQLStore(db).GetByID(headID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	siteGraph, err := DeserializeType[SiteGraph](node)
+
+	if err != nil {
+		return nil, err
+	}
+
+	SiteGraphCache.Set(headID, siteGraph)
+
+	return siteGraph, nil
+}
+
+// InvalidateSite removes all cache entries of the given site, including
+// the graph of its previous head.
+func InvalidateSite(site *Site) {
+	SiteCache.DeleteFunc(func(hostname string, cachedSite *Site) bool {
+		if cachedSite.ID != site.ID {
+			return false
+		}
+		if cachedSite.HeadID != nil && (site.HeadID == nil || *cachedSite.HeadID != *site.HeadID) {
+			SiteGraphCache.Delete(*cachedSite.HeadID)
+		}
+		return true
+	})
+}
@@ -0,0 +1,79 @@
+package models_test
+
+import (
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+func TestSiteCache(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	models.SiteCache.Purge()
+
+	site := orm.Init(&models.Site{Name: "cached", Hostname: "cached.example"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := models.SiteCache.Stats()
+
+	for i := 0; i < 2; i++ {
+		if cachedSite, err := models.SiteByHostname(dbf, "cached.example"); err != nil {
+			t.Fatal(err)
+		} else if cachedSite.ID != site.ID {
+			t.Fatalf("unexpected site")
+		}
+	}
+
+	newStats := models.SiteCache.Stats()
+
+	if newStats.Hits != stats.Hits+1 || newStats.Misses != stats.Misses+1 {
+		t.Fatalf("expected one hit and one miss, got %+v", newStats)
+	}
+
+	node, err := models.Serialize(&Tag{Type: "p", Meta: Meta{Language: "de"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// changing the head invalidates the cached site
+	if _, err := site.CommitHead(dbf, node, nil, "new head"); err != nil {
+		t.Fatal(err)
+	}
+
+	cachedSite, err := models.SiteByHostname(dbf, "cached.example")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cachedSite.HeadID == nil || *cachedSite.HeadID != node.ID {
+		t.Fatalf("expected the cached site to be updated")
+	}
+}
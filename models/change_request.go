@@ -0,0 +1,296 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/demakes/demake/auth"
+	"github.com/gospel-sh/gospel/orm"
+	"time"
+)
+
+const (
+	// the change request waits for a review
+	ChangeRequestOpen = "open"
+	// a reviewer approved the change request, so it can be published
+	ChangeRequestApproved = "approved"
+	// a reviewer rejected the change request
+	ChangeRequestRejected = "rejected"
+	// the change request was published
+	ChangeRequestPublished = "published"
+)
+
+const (
+	ReviewComment = "comment"
+	ReviewApprove = "approve"
+	ReviewReject  = "reject"
+)
+
+// A change request proposes a new version of a site for publishing. It
+// records the published version it is based on, so that reviewers see the
+// same changes that will be published.
+type ChangeRequest struct {
+	orm.DBModel
+	orm.JSONModel
+	SiteID int64
+	// the ref the proposed version was taken from
+	RefName string
+	// the proposed version and its hash
+	HeadID int64
+	Hash   []byte
+	// the published version at the time the change was proposed
+	BaseID int64
+	// the commit that published the change
+	CommitID       *int64 `db:"commit_id"`
+	Description    string
+	Status         string
+	AuthorSource   string
+	AuthorSourceID []byte
+	AuthorEMail    string `db:"col:author_email"`
+	AuthorName     string
+}
+
+// An approval, rejection or comment of a change request
+type ChangeRequestReview struct {
+	orm.DBModel
+	orm.JSONModel
+	ChangeRequestID int64
+	Action          string
+	Message         string
+	AuthorSource    string
+	AuthorSourceID  []byte
+	AuthorEMail     string `db:"col:author_email"`
+	AuthorName      string
+}
+
+func (c *ChangeRequest) Save() error {
+	return orm.Save(c)
+}
+
+func (c *ChangeRequest) ByExtID(id []byte) error {
+	return orm.LoadOne(c, map[string]any{"ext_id": id})
+}
+
+func (c *ChangeRequest) ByID(id int64) error {
+	return orm.LoadOne(c, map[string]any{"id": id})
+}
+
+// sets the author fields from a user profile
+func (c *ChangeRequest) SetAuthor(author auth.UserProfile) {
+	if author == nil {
+		return
+	}
+	c.AuthorSource = author.Source()
+	c.AuthorSourceID = author.SourceID()
+	c.AuthorEMail = author.EMail()
+	c.AuthorName = author.DisplayName()
+}
+
+// returns true if the given user created the change request
+func (c *ChangeRequest) IsAuthor(user auth.UserProfile) bool {
+	if user == nil {
+		return false
+	}
+	return c.AuthorSource == user.Source() && c.AuthorEMail == user.EMail() && bytes.Equal(c.AuthorSourceID, user.SourceID())
+}
+
+func (r *ChangeRequestReview) Save() error {
+	return orm.Save(r)
+}
+
+// sets the author fields from a user profile
+func (r *ChangeRequestReview) SetAuthor(author auth.UserProfile) {
+	if author == nil {
+		return
+	}
+	r.AuthorSource = author.Source()
+	r.AuthorSourceID = author.SourceID()
+	r.AuthorEMail = author.EMail()
+	r.AuthorName = author.DisplayName()
+}
+
+// ChangeRequests returns the change requests of the site
+func (s *Site) ChangeRequests(db func() orm.DB) ([]*ChangeRequest, error) {
+	return orm.Objects[ChangeRequest](db, map[string]any{"site_id": s.ID})
+}
+
+// ProposeChange creates a change request for publishing the current
+// version of the given ref
+func (s *Site) ProposeChange(db func() orm.DB, refName string, author auth.UserProfile, description string) (*ChangeRequest, error) {
+
+	if refName == PublishedRef {
+		return nil, fmt.Errorf("the published version can't be proposed")
+	}
+
+	ref, err := s.Ref(db, refName)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load ref '%s': %v", refName, err)
+	}
+
+	published, err := s.Ref(db, PublishedRef)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load published ref: %v", err)
+	}
+
+	if ref.HeadID == published.HeadID {
+		return nil, fmt.Errorf("'%s' doesn't contain any unpublished changes", refName)
+	}
+
+	hash, err := ref.HeadHash(db)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load proposed version: %v", err)
+	}
+
+	changeRequest := orm.Init(&ChangeRequest{
+		SiteID:      s.ID,
+		RefName:     refName,
+		HeadID:      ref.HeadID,
+		Hash:        hash,
+		BaseID:      published.HeadID,
+		Description: description,
+		Status:      ChangeRequestOpen,
+	}, db)
+
+	changeRequest.SetAuthor(author)
+
+	if err := changeRequest.Save(); err != nil {
+		return nil, fmt.Errorf("cannot save change request: %v", err)
+	}
+
+	return changeRequest, nil
+}
+
+// Reviews returns the approvals, rejections and comments of the change request
+func (c *ChangeRequest) Reviews(db func() orm.DB) ([]*ChangeRequestReview, error) {
+	return orm.Objects[ChangeRequestReview](db, map[string]any{"change_request_id": c.ID})
+}
+
+// Review approves, rejects or comments the change request. Only reviewers
+// can approve or reject changes, and not the ones they proposed themselves.
+func (c *ChangeRequest) Review(db func() orm.DB, reviewer auth.UserProfile, action, message string) (*ChangeRequestReview, error) {
+
+	switch action {
+	case ReviewComment:
+		if message == "" {
+			return nil, fmt.Errorf("please enter a comment")
+		}
+	case ReviewApprove, ReviewReject:
+		if !auth.HasRole(reviewer, auth.ReviewerRole) {
+			return nil, fmt.Errorf("only reviewers can approve or reject changes")
+		}
+		if c.IsAuthor(reviewer) {
+			return nil, fmt.Errorf("you can't review your own changes")
+		}
+		if c.Status != ChangeRequestOpen {
+			return nil, fmt.Errorf("the change request is %s", c.Status)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action '%s'", action)
+	}
+
+	// approving or rejecting only succeeds if nobody else reviewed the change
+	// request in the meantime
+	switch action {
+	case ReviewApprove:
+		if err := c.setStatus(db, ChangeRequestOpen, ChangeRequestApproved); err != nil {
+			return nil, err
+		}
+	case ReviewReject:
+		if err := c.setStatus(db, ChangeRequestOpen, ChangeRequestRejected); err != nil {
+			return nil, err
+		}
+	}
+
+	review := orm.Init(&ChangeRequestReview{
+		ChangeRequestID: c.ID,
+		Action:          action,
+		Message:         message,
+	}, db)
+
+	review.SetAuthor(reviewer)
+
+	if err := review.Save(); err != nil {
+		return nil, fmt.Errorf("cannot save review: %v", err)
+	}
+
+	return review, nil
+}
+
+// changes the status of the change request, but only if it still has the
+// expected status
+func (c *ChangeRequest) setStatus(db func() orm.DB, expected, status string) error {
+
+	rows, err := db().Query(`UPDATE change_request SET status = $1, updated_at = $2 WHERE id = $3 AND status = $4 RETURNING id`, status, time.Now().UTC(), c.ID, expected)
+
+	if err != nil {
+		return fmt.Errorf("cannot update change request: %v", err)
+	}
+
+	updated := rows.Next()
+	rows.Close()
+
+	if !updated {
+		return fmt.Errorf("the change request isn't %s anymore", expected)
+	}
+
+	c.Status = status
+
+	return nil
+}
+
+// Changes returns the differences between the published version the
+// change request is based on and the proposed version
+func (c *ChangeRequest) Changes(db func() orm.DB) ([]*Change, error) {
+
+	base, err := MakeSQLStore(db).GetByID(c.BaseID)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load base version: %v", err)
+	}
+
+	head, err := MakeSQLStore(db).GetByID(c.HeadID)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load proposed version: %v", err)
+	}
+
+	return Diff(base, head), nil
+}
+
+// Publish makes the proposed version the published version of the site.
+// Only approved change requests can be published, and only if the published
+// version didn't change since they were proposed (otherwise the reviewed
+// changes wouldn't match the published ones).
+func (c *ChangeRequest) Publish(db func() orm.DB, site *Site, author auth.UserProfile) (*Commit, error) {
+
+	if c.Status != ChangeRequestApproved {
+		return nil, fmt.Errorf("only approved changes can be published")
+	}
+
+	if site.ID != c.SiteID {
+		return nil, fmt.Errorf("the change request belongs to another site")
+	}
+
+	message := c.Description
+
+	if message == "" {
+		message = fmt.Sprintf("Publish '%s'", c.RefName)
+	}
+
+	commit, err := site.CompareAndCommitRef(db, PublishedRef, &Node{ID: c.BaseID}, &Node{ID: c.HeadID, Hash: c.Hash}, author, message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.Status = ChangeRequestPublished
+	c.CommitID = &commit.ID
+
+	if err := c.Save(); err != nil {
+		return nil, fmt.Errorf("cannot update change request: %v", err)
+	}
+
+	return commit, nil
+}
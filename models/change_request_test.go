@@ -0,0 +1,169 @@
+package models_test
+
+import (
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/auth"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+func makeUser(email string, roles ...string) auth.UserProfile {
+	return &auth.BasicUserProfile{
+		BasicUserProfileFields: auth.BasicUserProfileFields{
+			EMail:  email,
+			Source: "test",
+			Roles: []auth.OrganizationRoles{
+				&auth.BasicOrganizationRoles{
+					BasicOrganizationRolesFields: auth.BasicOrganizationRolesFields{
+						Roles:        roles,
+						Organization: &auth.BasicOrganization{},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestChangeRequests(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	editor := makeUser("editor@example.com")
+	reviewer := makeUser("reviewer@example.com", auth.ReviewerRole)
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := make([]*models.Node, 0)
+
+	for _, tagType := range []string{"p", "h1", "h2"} {
+
+		node, err := models.Serialize(&Tag{Type: tagType, Meta: Meta{Language: "de"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := node.SaveTree(db); err != nil {
+			t.Fatal(err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if _, err := site.CommitHead(dbf, nodes[0], nil, "initial version"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CreateRef(dbf, models.DraftRef, models.PublishedRef); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.ProposeChange(dbf, models.DraftRef, editor, "nothing"); err == nil {
+		t.Fatalf("expected an error as there are no changes")
+	}
+
+	if _, err := site.CommitRef(dbf, models.DraftRef, nodes[1], editor, "new title"); err != nil {
+		t.Fatal(err)
+	}
+
+	changeRequest, err := site.ProposeChange(dbf, models.DraftRef, editor, "new title")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changes, err := changeRequest.Changes(dbf); err != nil {
+		t.Fatal(err)
+	} else if len(changes) == 0 {
+		t.Fatalf("expected changes")
+	}
+
+	if _, err := changeRequest.Publish(dbf, site, editor); err == nil {
+		t.Fatalf("expected an error as the change wasn't approved")
+	}
+
+	if _, err := changeRequest.Review(dbf, editor, models.ReviewApprove, ""); err == nil {
+		t.Fatalf("expected an error as the editor isn't a reviewer")
+	}
+
+	if _, err := changeRequest.Review(dbf, makeUser("editor@example.com", auth.ReviewerRole), models.ReviewApprove, ""); err == nil {
+		t.Fatalf("expected an error as reviewers can't approve their own changes")
+	}
+
+	if _, err := changeRequest.Review(dbf, editor, models.ReviewComment, "please have a look"); err != nil {
+		t.Fatal(err)
+	}
+
+	// another reviewer has the change request open at the same time
+	stale := orm.Init(&models.ChangeRequest{}, dbf)
+
+	if err := stale.ByID(changeRequest.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := changeRequest.Review(dbf, reviewer, models.ReviewApprove, "looks good"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := stale.Review(dbf, makeUser("other@example.com", auth.ReviewerRole), models.ReviewReject, ""); err == nil {
+		t.Fatalf("expected an error as the change request was already approved")
+	}
+
+	if reviews, err := changeRequest.Reviews(dbf); err != nil {
+		t.Fatal(err)
+	} else if len(reviews) != 2 {
+		t.Fatalf("expected 2 reviews, got %d", len(reviews))
+	}
+
+	// a second change request based on the same version
+	if _, err := site.CommitRef(dbf, models.DraftRef, nodes[2], editor, "another title"); err != nil {
+		t.Fatal(err)
+	}
+
+	otherRequest, err := site.ProposeChange(dbf, models.DraftRef, editor, "another title")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := otherRequest.Review(dbf, reviewer, models.ReviewApprove, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := changeRequest.Publish(dbf, site, reviewer); err != nil {
+		t.Fatal(err)
+	}
+
+	if *site.HeadID != nodes[1].ID || changeRequest.Status != models.ChangeRequestPublished {
+		t.Fatalf("expected the change to be published")
+	}
+
+	// the published version changed, so the approved changes don't match anymore
+	if _, err := otherRequest.Publish(dbf, site, reviewer); err == nil {
+		t.Fatalf("expected a conflict")
+	} else if _, ok := err.(*models.HeadConflictError); !ok {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+}
@@ -0,0 +1,513 @@
+package models
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/demakes/demake/auth"
+	"github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A checked out site is stored as a directory tree that can be managed with
+// Git and edited with normal editors. Every node is stored in a YAML file
+// with its type and data fields, its related nodes are stored in a directory
+// with the same name, e.g.
+//
+//	demake.yaml
+//	graph.yaml
+//	graph/dom.html
+//	graph/plugins/0.yaml
+//	graph/translations/en.yaml
+//
+// File names are taken from the edge name, followed by the map key or the
+// slice index. Map keys are escaped (see keyFileName), so they can't refer to
+// other directories or be hidden. HTML elements (e.g. the DOM) are stored as
+// .html fragments instead of one file per element. Related nodes can also be
+// written inline in the YAML file of their parent.
+
+const (
+	// the file with the checkout metadata
+	CheckoutFile = "demake.yaml"
+	// the name of the root node
+	CheckoutRoot = "graph"
+)
+
+// describes which version of a site was checked out
+type Checkout struct {
+	Hostname string `yaml:"hostname"`
+	Ref      string `yaml:"ref"`
+	// the hex-encoded hash of the checked out version
+	Head string `yaml:"head"`
+}
+
+func writeYAML(filename string, value any) error {
+
+	buffer := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buffer)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, buffer.Bytes(), 0644)
+}
+
+func readYAML(filename string, value any) error {
+
+	data, err := os.ReadFile(filename)
+
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("invalid file '%s': %v", filename, err)
+	}
+
+	return nil
+}
+
+// the file name of an empty map key, escaped keys never consist of a single
+// percent sign as it is escaped as well
+const emptyKeyFileName = "%"
+
+// returns the file name of a map key, which might contain slashes or other
+// special characters. A leading dot is escaped, so keys like '..' don't
+// refer to other directories and aren't skipped as hidden files.
+func keyFileName(key string) string {
+
+	if key == "" {
+		return emptyKeyFileName
+	}
+
+	name := url.PathEscape(key)
+
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+
+	return name
+}
+
+// returns the map key of a file name written by keyFileName
+func fileNameKey(name string) (string, error) {
+
+	if name == emptyKeyFileName {
+		return "", nil
+	}
+
+	return url.PathUnescape(name)
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// WriteNodeFiles writes the node and its descendants to files, path is the
+// name of the node without the file extension. The type of the node is
+// omitted if it matches the given schema.
+func WriteNodeFiles(path string, node *Node, schema *ModelSchema) error {
+
+	if node.Type == ElementType {
+
+		element, err := DeserializeType[gospel.HTMLElement](node)
+
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(path+".html", []byte(element.RenderCode()), 0644)
+	}
+
+	nodeSchema, ok := Registry[node.Type]
+
+	if !ok {
+		return fmt.Errorf("unknown node type: %s", node.Type)
+	}
+
+	data, err := nodeData(node, schema)
+
+	if err != nil {
+		return err
+	}
+
+	for _, relatedSchema := range nodeSchema.RelatedSchemas {
+
+		edges := node.Outgoing.FilterByName(relatedSchema.Name)
+
+		if len(edges) == 0 {
+			continue
+		}
+
+		if relatedSchema.Lazy {
+			data[relatedSchema.Name] = map[string]any{DefinitionRefKey: hex.EncodeToString(edges[0].To.Hash)}
+			continue
+		}
+
+		relatedPath := filepath.Join(path, relatedSchema.Name)
+
+		if relatedSchema.Type == Struct {
+
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+
+			if err := WriteNodeFiles(relatedPath, edges[0].To, relatedSchema.ModelSchema); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := os.MkdirAll(relatedPath, 0755); err != nil {
+			return err
+		}
+
+		for _, edge := range edges {
+
+			name := keyFileName(edge.Key)
+
+			if relatedSchema.Type == Slice {
+				name = strconv.Itoa(edge.Index)
+			}
+
+			if err := WriteNodeFiles(filepath.Join(relatedPath, name), edge.To, relatedSchema.ModelSchema); err != nil {
+				return err
+			}
+		}
+	}
+
+	return writeYAML(path+".yaml", data)
+}
+
+// returns the names of the nodes in the given directory
+func nodeNames(dir string) ([]string, error) {
+
+	entries, err := os.ReadDir(dir)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	seen := map[string]bool{}
+
+	for _, entry := range entries {
+
+		name := entry.Name()
+
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			// directories only contain the related nodes
+			continue
+		}
+
+		if ext := filepath.Ext(name); ext == ".yaml" || ext == ".html" {
+			name = strings.TrimSuffix(name, ext)
+		} else {
+			continue
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// reads a node written by WriteNodeFiles and returns its definition
+func readNodeDefinition(path string, schema *ModelSchema) (map[string]any, error) {
+
+	if fileExists(path + ".html") {
+
+		if fileExists(path + ".yaml") {
+			return nil, fmt.Errorf("%s: found both a .html and a .yaml file", path)
+		}
+
+		source, err := os.ReadFile(path + ".html")
+
+		if err != nil {
+			return nil, err
+		}
+
+		parser := &gospel.Parser{
+			Source: string(source),
+		}
+
+		element, err := parser.ParseHTMLElement()
+
+		if err != nil {
+			return nil, fmt.Errorf("%s.html: cannot parse: %v", path, err)
+		}
+
+		if element == nil {
+			return nil, fmt.Errorf("%s.html: not a HTML element", path)
+		}
+
+		node, err := Serialize(element)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s.html: %v", path, err)
+		}
+
+		return nodeDefinition(node, schema)
+	}
+
+	definition := map[string]any{}
+
+	if err := readYAML(path+".yaml", &definition); err != nil {
+		return nil, err
+	}
+
+	nodeSchema := schema
+
+	if typeName, ok := definition[DefinitionTypeKey]; ok {
+		name, _ := typeName.(string)
+		if nodeSchema, ok = Registry[name]; !ok {
+			return nil, fmt.Errorf("%s.yaml: unknown type '%v'", path, typeName)
+		}
+	}
+
+	if nodeSchema == nil {
+		return nil, fmt.Errorf("%s.yaml: please specify the type using '%s'", path, DefinitionTypeKey)
+	}
+
+	for _, relatedSchema := range nodeSchema.RelatedSchemas {
+
+		if relatedSchema.Lazy {
+			continue
+		}
+
+		relatedPath := filepath.Join(path, relatedSchema.Name)
+
+		// related nodes can also be written inline, e.g. when adding them
+		if _, ok := definition[relatedSchema.Name]; ok {
+			if fileExists(relatedPath) || fileExists(relatedPath+".yaml") || fileExists(relatedPath+".html") {
+				return nil, fmt.Errorf("%s.yaml: '%s' is defined both inline and in a separate file", path, relatedSchema.Name)
+			}
+			continue
+		}
+
+		if relatedSchema.Type == Struct {
+
+			if !fileExists(relatedPath+".yaml") && !fileExists(relatedPath+".html") {
+				continue
+			}
+
+			related, err := readNodeDefinition(relatedPath, relatedSchema.ModelSchema)
+
+			if err != nil {
+				return nil, err
+			}
+
+			definition[relatedSchema.Name] = related
+			continue
+		}
+
+		names, err := nodeNames(relatedPath)
+
+		if err != nil {
+			return nil, err
+		} else if len(names) == 0 {
+			continue
+		}
+
+		if relatedSchema.Type == Map {
+
+			relatedMap := map[string]any{}
+
+			for _, name := range names {
+
+				key, err := fileNameKey(name)
+
+				if err != nil {
+					return nil, fmt.Errorf("%s: invalid name '%s'", relatedPath, name)
+				}
+
+				if relatedMap[key], err = readNodeDefinition(filepath.Join(relatedPath, name), relatedSchema.ModelSchema); err != nil {
+					return nil, err
+				}
+			}
+
+			definition[relatedSchema.Name] = relatedMap
+			continue
+		}
+
+		// maps the indexes to the file names, which might differ (e.g. '01')
+		indexes := make([]int, 0, len(names))
+		indexNames := map[int]string{}
+
+		for _, name := range names {
+
+			index, err := strconv.Atoi(name)
+
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("%s: '%s' isn't a valid index", relatedPath, name)
+			}
+
+			if _, ok := indexNames[index]; ok {
+				return nil, fmt.Errorf("%s: duplicate index %d", relatedPath, index)
+			}
+
+			indexes = append(indexes, index)
+			indexNames[index] = name
+		}
+
+		// the indexes only determine the order and can have gaps, so nodes
+		// can be removed or appended without renaming other files
+		sort.Ints(indexes)
+
+		relatedSlice := make([]any, 0, len(indexes))
+
+		for _, index := range indexes {
+
+			related, err := readNodeDefinition(filepath.Join(relatedPath, indexNames[index]), relatedSchema.ModelSchema)
+
+			if err != nil {
+				return nil, err
+			}
+
+			relatedSlice = append(relatedSlice, related)
+		}
+
+		definition[relatedSchema.Name] = relatedSlice
+	}
+
+	return definition, nil
+}
+
+// ReadNodeFiles reads a node written by WriteNodeFiles and serializes it,
+// the type of the node defaults to the given schema
+func ReadNodeFiles(path string, schema *ModelSchema) (*Node, error) {
+
+	definition, err := readNodeDefinition(path, schema)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return serializeDefinition(definition, schema)
+}
+
+// CheckoutSite writes the given ref of the site to the directory. Existing
+// files of a previous checkout are replaced, other files (e.g. '.git') are
+// kept.
+func CheckoutSite(db func() orm.DB, site *Site, refName, dir string) (*Checkout, error) {
+
+	ref, err := site.Ref(db, refName)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load ref '%s': %v", refName, err)
+	}
+
+	node, err := MakeSQLStore(db).GetByID(ref.HeadID)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load graph: %v", err)
+	}
+
+	root := filepath.Join(dir, CheckoutRoot)
+
+	// we remove the previous checkout so no deleted nodes are left over
+	for _, path := range []string{root, root + ".yaml"} {
+		if err := os.RemoveAll(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := WriteNodeFiles(root, node, Registry["siteGraph"]); err != nil {
+		return nil, err
+	}
+
+	checkout := &Checkout{
+		Hostname: site.Hostname,
+		Ref:      refName,
+		Head:     hex.EncodeToString(node.Hash),
+	}
+
+	if err := writeYAML(filepath.Join(dir, CheckoutFile), checkout); err != nil {
+		return nil, err
+	}
+
+	return checkout, nil
+}
+
+// CommitCheckout commits the directory written by CheckoutSite to the ref it
+// was checked out from and returns the new commit, or nil if nothing changed.
+// If the ref changed since the checkout a HeadConflictError is returned.
+// Checkouts of the published version can't be committed, changes need to be
+// made in another ref and published with a change request.
+func CommitCheckout(db func() orm.DB, dir string, author auth.UserProfile, message string) (*Commit, error) {
+
+	checkout := &Checkout{}
+
+	if err := readYAML(filepath.Join(dir, CheckoutFile), checkout); err != nil {
+		return nil, fmt.Errorf("cannot read checkout: %v", err)
+	}
+
+	if checkout.Ref == PublishedRef {
+		return nil, fmt.Errorf("the published version can't be committed, please check out '%s' instead", DraftRef)
+	}
+
+	head, err := ParseHash(checkout.Head)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid head '%s'", checkout.Head)
+	}
+
+	site := orm.Init(&Site{}, db)
+
+	if err := site.ByHostname(checkout.Hostname); err != nil {
+		return nil, fmt.Errorf("cannot find site '%s': %v", checkout.Hostname, err)
+	}
+
+	node, err := ReadNodeFiles(filepath.Join(dir, CheckoutRoot), Registry["siteGraph"])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(node.Hash, head) {
+		// nothing changed
+		return nil, nil
+	}
+
+	if err := MakeSQLStore(db).PutTree(node); err != nil {
+		return nil, fmt.Errorf("cannot save graph: %v", err)
+	}
+
+	commit, err := site.CompareAndCommitRef(db, checkout.Ref, &Node{Hash: head}, node, author, message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	checkout.Head = hex.EncodeToString(node.Hash)
+
+	if err := writeYAML(filepath.Join(dir, CheckoutFile), checkout); err != nil {
+		return nil, err
+	}
+
+	return commit, nil
+}
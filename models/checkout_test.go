@@ -0,0 +1,177 @@
+package models_test
+
+import (
+	"bytes"
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeFiles(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	tag := &Tag{
+		Type: "div",
+		Meta: Meta{Language: "de"},
+		Children: []*Tag{
+			{Type: "p", Meta: Meta{Language: "de"}},
+			{Type: "h1", Meta: Meta{Language: "de"}},
+		},
+		Attributes: []*Attribute{
+			{
+				Name:  "class",
+				Value: "main",
+				Labels: map[string]*Label{
+					"a/b":     {Name: "foo", Value: "bar"},
+					"..":      {Name: "parent", Value: "bar"},
+					"":        {Name: "empty", Value: "bar"},
+					".hidden": {Name: "hidden", Value: "bar"},
+				},
+			},
+		},
+	}
+
+	node, err := models.Serialize(tag)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(t.TempDir(), "root")
+
+	if err := models.WriteNodeFiles(root, node, models.Registry["tag"]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{"root.yaml", "root/children/0.yaml", "root/children/1.yaml", "root/attributes/0.yaml", "root/attributes/0/labels/a%2Fb.yaml", "root/attributes/0/labels/%2E..yaml", "root/attributes/0/labels/%.yaml", "root/attributes/0/labels/%2Ehidden.yaml"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(root), filename)); err != nil {
+			t.Fatalf("expected file '%s': %v", filename, err)
+		}
+	}
+
+	readNode, err := models.ReadNodeFiles(root, models.Registry["tag"])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readNode.Hash, node.Hash) {
+		t.Fatalf("hashes don't match")
+	}
+
+	// we append a new child, indexes can have gaps
+	if err := os.WriteFile(filepath.Join(root, "children", "5.yaml"), []byte("type: h2\nmeta:\n  language: en\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if readNode, err = models.ReadNodeFiles(root, models.Registry["tag"]); err != nil {
+		t.Fatal(err)
+	}
+
+	readTag, err := models.DeserializeType[Tag](readNode)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(readTag.Children) != 3 || readTag.Children[2].Type != "h2" || readTag.Children[2].Meta.Language != "en" {
+		t.Fatalf("expected the new child to be appended")
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "children", "05.yaml"), []byte("type: h3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := models.ReadNodeFiles(root, models.Registry["tag"]); err == nil {
+		t.Fatalf("expected an error because of the duplicate index")
+	}
+}
+
+func TestCheckout(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := models.Serialize(makeSiteGraph("/", "/about"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CommitHead(dbf, node, nil, "initial version"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CreateRef(dbf, models.DraftRef, models.PublishedRef); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+
+	if _, err := models.CheckoutSite(dbf, site, models.DraftRef, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, models.CheckoutRoot, "dom.html")); err != nil {
+		t.Fatalf("expected the DOM to be written as HTML: %v", err)
+	}
+
+	// reading the unedited checkout results in the same hash
+	if commit, err := models.CommitCheckout(dbf, dir, nil, "nothing changed"); err != nil {
+		t.Fatal(err)
+	} else if commit != nil {
+		t.Fatalf("expected no commit as nothing changed")
+	}
+
+	if readNode, err := models.ReadNodeFiles(filepath.Join(dir, models.CheckoutRoot), models.Registry["siteGraph"]); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(readNode.Hash, node.Hash) {
+		t.Fatalf("hashes don't match")
+	}
+
+	published := t.TempDir()
+
+	if _, err := models.CheckoutSite(dbf, site, models.PublishedRef, published); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(published, models.CheckoutRoot, "dom.html"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := models.CommitCheckout(dbf, published, nil, "edit published"); err == nil {
+		t.Fatalf("expected an error as the published version can't be committed")
+	}
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"fmt"
+	"github.com/demakes/demake/auth"
+	"github.com/gospel-sh/gospel/orm"
+)
+
+// A commit records a version of a site graph, together with its author,
+// a message and the commit that preceded it.
+type Commit struct {
+	orm.DBModel
+	orm.JSONModel
+	SiteID         int64
+	ParentID       *int64 `db:"parent_id"`
+	HeadID         int64
+	Hash           []byte
+	AuthorSource   string
+	AuthorSourceID []byte
+	AuthorEMail    string `db:"col:author_email"`
+	AuthorName     string
+	Message        string
+}
+
+func (c *Commit) Save() error {
+	return orm.Save(c)
+}
+
+func (c *Commit) ByExtID(id []byte) error {
+	return orm.LoadOne(c, map[string]any{"ext_id": id})
+}
+
+func (c *Commit) ByID(id int64) error {
+	return orm.LoadOne(c, map[string]any{"id": id})
+}
+
+// sets the author fields from a user profile (which can be nil e.g. for
+// commits created from the command line)
+func (c *Commit) SetAuthor(author auth.UserProfile) {
+	if author == nil {
+		return
+	}
+	c.AuthorSource = author.Source()
+	c.AuthorSourceID = author.SourceID()
+	c.AuthorEMail = author.EMail()
+	c.AuthorName = author.DisplayName()
+}
+
+// returns the graph of the site as it was at this commit
+func (c *Commit) Graph(db func() orm.DB) (*Node, error) {
+	return MakeSQLStore(db).GetByID(c.HeadID)
+}
+
+// CommitHead records the given (already saved) node as a new commit on the
+// published ref and makes it the head of the site.
+func (s *Site) CommitHead(db func() orm.DB, node *Node, author auth.UserProfile, message string) (*Commit, error) {
+	return s.CommitRef(db, PublishedRef, node, author, message)
+}
+
+// History returns the commits of the published version of the site,
+// starting with the latest one and following the parent links back to the
+// initial commit.
+func (s *Site) History(db func() orm.DB) ([]*Commit, error) {
+	return s.historyFrom(db, s.CommitID)
+}
+
+func (s *Site) historyFrom(db func() orm.DB, commitID *int64) ([]*Commit, error) {
+
+	commits, err := orm.Objects[Commit](db, map[string]any{"site_id": s.ID})
+
+	if err != nil {
+		return nil, err
+	}
+
+	commitsByID := make(map[int64]*Commit, len(commits))
+
+	for _, commit := range commits {
+		commitsByID[commit.ID] = commit
+	}
+
+	history := make([]*Commit, 0, len(commits))
+
+	for id := commitID; id != nil; {
+		commit, ok := commitsByID[*id]
+		if !ok {
+			return nil, fmt.Errorf("commit %d is missing", *id)
+		}
+		history = append(history, commit)
+		id = commit.ParentID
+	}
+
+	return history, nil
+}
+
+// Revert makes the version of the given commit the published version of
+// the site again. The history is kept intact, i.e. this creates a new commit
+// on top of the current one.
+func (s *Site) Revert(db func() orm.DB, commit *Commit, author auth.UserProfile) (*Commit, error) {
+	return s.RevertRef(db, PublishedRef, commit, author)
+}
@@ -0,0 +1,110 @@
+package models_test
+
+import (
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+func TestCommitHistory(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	commits := make([]*models.Commit, 0)
+
+	for _, tagType := range []string{"p", "h1", "h2"} {
+
+		node, err := models.Serialize(&Tag{Type: tagType, Meta: Meta{Language: "de"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := node.SaveTree(db); err != nil {
+			t.Fatal(err)
+		}
+
+		commit, err := site.CommitHead(dbf, node, nil, tagType)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if *site.HeadID != node.ID {
+			t.Fatalf("expected the site head to point to the new node")
+		}
+
+		commits = append(commits, commit)
+	}
+
+	history, err := site.History(dbf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != 3 {
+		t.Fatalf("expected 3 commits, got %d", len(history))
+	}
+
+	for i, commit := range history {
+		if commit.ID != commits[len(commits)-1-i].ID {
+			t.Fatalf("history is not in reverse order")
+		}
+	}
+
+	// we revert to the initial version
+	revertCommit, err := site.Revert(dbf, commits[0], nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *site.HeadID != commits[0].HeadID {
+		t.Fatalf("expected the site head to point to the initial version")
+	}
+
+	if *revertCommit.ParentID != commits[2].ID {
+		t.Fatalf("expected the revert commit to be on top of the latest one")
+	}
+
+	graph, err := history[2].Graph(dbf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := models.DeserializeType[Tag](graph)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tag.Type != "p" {
+		t.Fatalf("expected to load the initial version, got '%s'", tag.Type)
+	}
+}
@@ -0,0 +1,559 @@
+package models
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/demakes/demake/auth"
+	"github.com/gospel-sh/gospel/orm"
+	"gopkg.in/yaml.v3"
+	"io"
+	"sort"
+)
+
+const (
+	// the key that holds the registered type of a model in a definition, it
+	// can be omitted if the type follows from the parent model
+	DefinitionTypeKey = "$type"
+	// the key that holds the hex-encoded hash of a referenced node
+	DefinitionRefKey = "$ref"
+)
+
+// A declarative definition of a site, which can be written as YAML. The
+// graph contains the registered models of the site graph, e.g.
+//
+//	name: Example
+//	hostname: example.org
+//	graph:
+//	  meta:
+//	    domain: example.org
+//	    title:
+//	      translations:
+//	        en: Example
+type SiteDefinition struct {
+	Name        string         `yaml:"name"`
+	Hostname    string         `yaml:"hostname"`
+	Description string         `yaml:"description,omitempty"`
+	Graph       map[string]any `yaml:"graph"`
+}
+
+func ReadSiteDefinition(r io.Reader) (*SiteDefinition, error) {
+
+	definition := &SiteDefinition{}
+
+	if err := yaml.NewDecoder(r).Decode(definition); err != nil {
+		return nil, fmt.Errorf("invalid site definition: %v", err)
+	}
+
+	return definition, nil
+}
+
+func WriteSiteDefinition(w io.Writer, definition *SiteDefinition) error {
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(definition); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+// converts JSON numbers to integers where possible, so that they are
+// written as such
+func definitionValue(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, mapValue := range v {
+			v[key] = definitionValue(mapValue)
+		}
+	case []any:
+		for i, sliceValue := range v {
+			v[i] = definitionValue(sliceValue)
+		}
+	}
+	return value
+}
+
+// returns the data fields of the node (without empty values) and its type
+// if it doesn't match the given schema
+func nodeData(node *Node, schema *ModelSchema) (map[string]any, error) {
+
+	definition := map[string]any{}
+
+	if node.Data != nil {
+
+		decoder := json.NewDecoder(bytes.NewReader(node.Data))
+		decoder.UseNumber()
+
+		if err := decoder.Decode(&definition); err != nil {
+			return nil, fmt.Errorf("cannot decode data of node %s: %v", hex.EncodeToString(node.Hash), err)
+		}
+
+		// we omit empty values to keep the definition readable
+		for key, value := range definition {
+			if value == nil {
+				delete(definition, key)
+			} else {
+				definition[key] = definitionValue(value)
+			}
+		}
+	}
+
+	if schema == nil || schema.Name != node.Type {
+		definition[DefinitionTypeKey] = node.Type
+	}
+
+	return definition, nil
+}
+
+// converts a node and its descendants to a definition, the type is omitted
+// if it matches the given schema
+func nodeDefinition(node *Node, schema *ModelSchema) (map[string]any, error) {
+
+	nodeSchema, ok := Registry[node.Type]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown node type: %s", node.Type)
+	}
+
+	definition, err := nodeData(node, schema)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, relatedSchema := range nodeSchema.RelatedSchemas {
+
+		edges := node.Outgoing.FilterByName(relatedSchema.Name)
+
+		if len(edges) == 0 {
+			continue
+		}
+
+		if relatedSchema.Lazy {
+			definition[relatedSchema.Name] = map[string]any{DefinitionRefKey: hex.EncodeToString(edges[0].To.Hash)}
+			continue
+		}
+
+		switch relatedSchema.Type {
+		case Struct:
+			related, err := nodeDefinition(edges[0].To, relatedSchema.ModelSchema)
+			if err != nil {
+				return nil, err
+			}
+			definition[relatedSchema.Name] = related
+		case Map:
+			relatedMap := map[string]any{}
+			for _, edge := range edges {
+				related, err := nodeDefinition(edge.To, relatedSchema.ModelSchema)
+				if err != nil {
+					return nil, err
+				}
+				relatedMap[edge.Key] = related
+			}
+			definition[relatedSchema.Name] = relatedMap
+		case Slice:
+			sort.SliceStable(edges, func(i, j int) bool { return edges[i].Index < edges[j].Index })
+			relatedSlice := make([]any, 0, len(edges))
+			for _, edge := range edges {
+				related, err := nodeDefinition(edge.To, relatedSchema.ModelSchema)
+				if err != nil {
+					return nil, err
+				}
+				relatedSlice = append(relatedSlice, related)
+			}
+			definition[relatedSchema.Name] = relatedSlice
+		}
+	}
+
+	return definition, nil
+}
+
+// converts a definition to a (not yet hashed) node and its descendants, the
+// type defaults to the one of the given schema
+func definitionNode(definition map[string]any, schema *ModelSchema, path string) (*Node, error) {
+
+	if path == "" {
+		path = "graph"
+	}
+
+	nodeSchema := schema
+
+	if typeName, ok := definition[DefinitionTypeKey]; ok {
+		name, _ := typeName.(string)
+		if nodeSchema, ok = Registry[name]; !ok {
+			return nil, fmt.Errorf("%s: unknown type '%v'", path, typeName)
+		}
+	}
+
+	if nodeSchema == nil {
+		return nil, fmt.Errorf("%s: please specify the type using '%s'", path, DefinitionTypeKey)
+	}
+
+	node := &Node{Type: nodeSchema.Name}
+	data := map[string]any{}
+	fields := map[string]bool{}
+	related := map[string]*RelatedModelSchema{}
+
+	for _, field := range nodeSchema.Fields {
+		fields[field.Name] = true
+	}
+
+	for _, relatedSchema := range nodeSchema.RelatedSchemas {
+		related[relatedSchema.Name] = relatedSchema
+	}
+
+	for key, value := range definition {
+
+		if key == DefinitionTypeKey {
+			continue
+		}
+
+		relatedSchema, ok := related[key]
+
+		if !ok {
+			// we don't silently drop misspelled fields
+			if !fields[key] {
+				return nil, fmt.Errorf("%s: unknown field '%s' of type '%s'", path, key, nodeSchema.Name)
+			}
+			data[key] = value
+			continue
+		}
+
+		keyPath := fmt.Sprintf("%s.%s", path, key)
+
+		if value == nil {
+			continue
+		}
+
+		if relatedSchema.Lazy {
+
+			ref, ok := value.(map[string]any)
+
+			if !ok {
+				return nil, fmt.Errorf("%s: expected '%s'", keyPath, DefinitionRefKey)
+			}
+
+			hashValue, _ := ref[DefinitionRefKey].(string)
+			hash, err := ParseHash(hashValue)
+
+			if err != nil || len(hash) == 0 {
+				return nil, fmt.Errorf("%s: invalid reference '%v'", keyPath, ref[DefinitionRefKey])
+			}
+
+			edge := MakeEdge()
+			edge.Type = int(Struct)
+			edge.Name = key
+			edge.Follow = false
+			edge.FromTo(node, &Node{Hash: hash, Stub: true})
+			continue
+		}
+
+		switch relatedSchema.Type {
+		case Struct:
+
+			relatedDefinition, ok := value.(map[string]any)
+
+			if !ok {
+				return nil, fmt.Errorf("%s: expected a mapping", keyPath)
+			}
+
+			relatedNode, err := definitionNode(relatedDefinition, relatedSchema.ModelSchema, keyPath)
+
+			if err != nil {
+				return nil, err
+			}
+
+			edge := MakeEdge()
+			edge.Type = int(Struct)
+			edge.Name = key
+			edge.FromTo(node, relatedNode)
+
+		case Map:
+
+			relatedMap, ok := value.(map[string]any)
+
+			if !ok {
+				return nil, fmt.Errorf("%s: expected a mapping", keyPath)
+			}
+
+			for mapKey, mapValue := range relatedMap {
+
+				relatedDefinition, ok := mapValue.(map[string]any)
+
+				if !ok {
+					return nil, fmt.Errorf("%s.%s: expected a mapping", keyPath, mapKey)
+				}
+
+				relatedNode, err := definitionNode(relatedDefinition, relatedSchema.ModelSchema, fmt.Sprintf("%s.%s", keyPath, mapKey))
+
+				if err != nil {
+					return nil, err
+				}
+
+				edge := MakeEdge()
+				edge.Type = int(Map)
+				edge.Name = key
+				edge.Key = mapKey
+				edge.FromTo(node, relatedNode)
+			}
+
+		case Slice:
+
+			relatedSlice, ok := value.([]any)
+
+			if !ok {
+				return nil, fmt.Errorf("%s: expected a list", keyPath)
+			}
+
+			for i, sliceValue := range relatedSlice {
+
+				relatedDefinition, ok := sliceValue.(map[string]any)
+
+				if !ok {
+					return nil, fmt.Errorf("%s[%d]: expected a mapping", keyPath, i)
+				}
+
+				relatedNode, err := definitionNode(relatedDefinition, relatedSchema.ModelSchema, fmt.Sprintf("%s[%d]", keyPath, i))
+
+				if err != nil {
+					return nil, err
+				}
+
+				edge := MakeEdge()
+				edge.Type = int(Slice)
+				edge.Name = key
+				edge.Index = i
+				edge.FromTo(node, relatedNode)
+			}
+		}
+	}
+
+	if err := node.SetData(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return node, nil
+}
+
+// Serialize returns the serialized graph of the definition
+func (d *SiteDefinition) Serialize() (*Node, error) {
+
+	if d.Graph == nil {
+		return nil, fmt.Errorf("the definition doesn't contain a graph")
+	}
+
+	return serializeDefinition(d.Graph, Registry["siteGraph"])
+}
+
+// converts the definition to models and serializes them, the type of the
+// root model defaults to the given schema
+func serializeDefinition(definition map[string]any, schema *ModelSchema) (*Node, error) {
+
+	node, err := definitionNode(definition, schema, "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	// we deserialize the models and serialize them again, which checks the
+	// definition against the registered models and calculates the hashes
+	model, err := Deserialize(node)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid graph: %v", err)
+	}
+
+	return Serialize(model)
+}
+
+// DumpSite returns the definition of the given ref of the site
+func DumpSite(db func() orm.DB, site *Site, refName string) (*SiteDefinition, error) {
+
+	ref, err := site.Ref(db, refName)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load ref '%s': %v", refName, err)
+	}
+
+	node, err := MakeSQLStore(db).GetByID(ref.HeadID)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load graph: %v", err)
+	}
+
+	graph, err := nodeDefinition(node, Registry["siteGraph"])
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &SiteDefinition{
+		Name:        site.Name,
+		Hostname:    site.Hostname,
+		Description: site.Description,
+		Graph:       graph,
+	}, nil
+}
+
+// ApplySite creates or updates the site with the hostname of the definition
+// and returns the new commit, or nil if the graph didn't change. Unless
+// publish is set, the graph is committed to the draft and published with a
+// change request, which is why new sites can only be created by publishing
+// them. When publishing, the draft is updated as well if it didn't contain
+// any unpublished changes. The name and description of an existing site are
+// only saved after the graph was committed.
+func ApplySite(db func() orm.DB, definition *SiteDefinition, author auth.UserProfile, publish bool) (*Site, *Commit, error) {
+
+	if definition.Hostname == "" {
+		return nil, nil, fmt.Errorf("please specify a hostname")
+	}
+
+	node, err := definition.Serialize()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	site := orm.Init(&Site{}, db)
+
+	if err := site.ByHostname(definition.Hostname); err == orm.NotFound {
+
+		if !publish {
+			return nil, nil, fmt.Errorf("site '%s' doesn't exist yet, new sites need to be published", definition.Hostname)
+		}
+
+		site.Hostname = definition.Hostname
+		site.Name = definition.Name
+		site.Description = definition.Description
+
+		// commits need a saved site, which we remove again if they fail
+		if err := site.Save(); err != nil {
+			return nil, nil, fmt.Errorf("cannot save site: %v", err)
+		}
+
+		commit, err := site.applyPublished(db, node, author)
+
+		if err != nil {
+			return nil, nil, site.removeCreated(db, err)
+		}
+
+		return site, commit, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var commit *Commit
+
+	if publish {
+		commit, err = site.applyPublished(db, node, author)
+	} else {
+		commit, err = site.applyDraft(db, node, author)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if site.Name != definition.Name || site.Description != definition.Description {
+
+		site.Name = definition.Name
+		site.Description = definition.Description
+
+		if err := site.saveMetadata(db); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return site, commit, nil
+}
+
+// commits the node to the draft, unless it is the head of the draft already
+func (s *Site) applyDraft(db func() orm.DB, node *Node, author auth.UserProfile) (*Commit, error) {
+
+	var expected *Node
+
+	if draft, err := s.Ref(db, DraftRef); err == nil {
+
+		if hash, err := draft.HeadHash(db); err != nil {
+			return nil, err
+		} else if bytes.Equal(hash, node.Hash) {
+			// nothing changed
+			return nil, nil
+		}
+
+		expected = &Node{ID: draft.HeadID}
+	} else if err != orm.NotFound {
+		return nil, err
+	}
+
+	if err := MakeSQLStore(db).PutTree(node); err != nil {
+		return nil, fmt.Errorf("cannot save graph: %v", err)
+	}
+
+	return s.CompareAndCommitRef(db, DraftRef, expected, node, author, "Apply site definition")
+}
+
+// publishes the node, unless it is the published head already
+func (s *Site) applyPublished(db func() orm.DB, node *Node, author auth.UserProfile) (*Commit, error) {
+
+	var published *SiteRef
+	var err error
+
+	if s.HeadID != nil {
+
+		if published, err = s.Ref(db, PublishedRef); err != nil {
+			return nil, err
+		}
+
+		if hash, err := published.HeadHash(db); err != nil {
+			return nil, err
+		} else if bytes.Equal(hash, node.Hash) {
+			// nothing changed
+			return nil, nil
+		}
+	}
+
+	if err := MakeSQLStore(db).PutTree(node); err != nil {
+		return nil, fmt.Errorf("cannot save graph: %v", err)
+	}
+
+	commit, err := s.CommitHead(db, node, author, "Apply site definition")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if published == nil {
+		// changes are made in the draft and published explicitly
+		if _, err := s.CreateRef(db, DraftRef, PublishedRef); err != nil {
+			return nil, err
+		}
+		return commit, nil
+	}
+
+	draft, err := s.Ref(db, DraftRef)
+
+	if err == orm.NotFound {
+		return commit, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if draft.HeadID == published.HeadID {
+		if _, err := s.CompareAndCommitRef(db, DraftRef, &Node{ID: draft.HeadID}, node, author, "Apply site definition"); err != nil {
+			return nil, err
+		}
+	}
+
+	return commit, nil
+}
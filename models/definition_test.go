@@ -0,0 +1,168 @@
+package models_test
+
+import (
+	"bytes"
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"strings"
+	"testing"
+)
+
+func TestSiteDefinition(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	definition, err := models.ReadSiteDefinition(strings.NewReader(`
+name: Example
+hostname: example.org
+graph:
+  meta:
+    domain: example.org
+    title:
+      translations:
+        en: Example
+  plugins:
+    - $type: blogPlugin
+  dom:
+    tag: div
+    children:
+      - $type: route
+        route: /about
+        element:
+          $type: element
+          tag: p
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := models.ApplySite(dbf, definition, nil, false); err == nil {
+		t.Fatalf("expected an error as new sites need to be published")
+	}
+
+	site, commit, err := models.ApplySite(dbf, definition, nil, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if commit == nil || site.Name != "Example" {
+		t.Fatalf("expected the site to be created")
+	}
+
+	siteGraph, err := models.DeserializeType[models.SiteGraph](mustGraph(t, dbf, *site.HeadID))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if siteGraph.Meta.Domain != "example.org" || len(siteGraph.Plugins) != 1 || len(siteGraph.DOM.Children) != 1 {
+		t.Fatalf("unexpected site graph: %v", siteGraph)
+	}
+
+	// we dump the site and apply the result again, which shouldn't change anything
+	dumped, err := models.DumpSite(dbf, site, models.PublishedRef)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := &bytes.Buffer{}
+
+	if err := models.WriteSiteDefinition(buffer, dumped); err != nil {
+		t.Fatal(err)
+	}
+
+	if dumped, err = models.ReadSiteDefinition(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, commit, err := models.ApplySite(dbf, dumped, nil, true); err != nil {
+		t.Fatal(err)
+	} else if commit != nil {
+		t.Fatalf("expected no changes")
+	}
+
+	headID := *site.HeadID
+
+	dumped.Graph["meta"].(map[string]any)["domain"] = "example.com"
+
+	if site, commit, err = models.ApplySite(dbf, dumped, nil, true); err != nil {
+		t.Fatal(err)
+	} else if commit == nil || *site.HeadID == headID {
+		t.Fatalf("expected a new head")
+	}
+
+	// the draft didn't contain any changes, so it is updated as well
+	if draft, err := site.Ref(dbf, models.DraftRef); err != nil {
+		t.Fatal(err)
+	} else if draft.HeadID != *site.HeadID {
+		t.Fatalf("expected the draft to be updated")
+	}
+
+	// without publishing, only the draft and the metadata are updated
+	headID = *site.HeadID
+
+	dumped.Name = "Renamed"
+	dumped.Graph["meta"].(map[string]any)["domain"] = "example.net"
+
+	if site, commit, err = models.ApplySite(dbf, dumped, nil, false); err != nil {
+		t.Fatal(err)
+	} else if commit == nil || *site.HeadID != headID || site.Name != "Renamed" {
+		t.Fatalf("expected a new draft")
+	}
+
+	if draft, err := site.Ref(dbf, models.DraftRef); err != nil {
+		t.Fatal(err)
+	} else if draft.HeadID == headID || draft.CommitID == nil || *draft.CommitID != commit.ID {
+		t.Fatalf("expected the draft to be updated")
+	}
+
+	if err := site.ByID(site.ID); err != nil {
+		t.Fatal(err)
+	} else if *site.HeadID != headID || site.Name != "Renamed" {
+		t.Fatalf("expected only the name to change")
+	}
+
+	if _, commit, err := models.ApplySite(dbf, dumped, nil, false); err != nil {
+		t.Fatal(err)
+	} else if commit != nil {
+		t.Fatalf("expected no changes")
+	}
+
+	dumped.Graph["mta"] = map[string]any{"domain": "example.com"}
+
+	if _, _, err := models.ApplySite(dbf, dumped, nil, false); err == nil {
+		t.Fatalf("expected an error because of the unknown field")
+	}
+}
+
+func mustGraph(t *testing.T, dbf func() orm.DB, id int64) *models.Node {
+
+	node, err := models.GetGraphByID(dbf, id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return node
+}
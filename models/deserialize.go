@@ -6,7 +6,21 @@ import (
 	"reflect"
 )
 
+// Deserialize returns the model of the node and its related nodes. Nodes that
+// are shared by several edges are deserialized once and their model is reused.
 func Deserialize(node *Node) (any, error) {
+	return deserialize(node, map[*Node]any{})
+}
+
+func deserialize(node *Node, values map[*Node]any) (any, error) {
+
+	if model, ok := values[node]; ok {
+		return model, nil
+	}
+
+	if node.Stub {
+		return nil, fmt.Errorf("node %d is a stub and needs to be loaded first", node.ID)
+	}
 
 	schema, ok := Registry[node.Type]
 
@@ -27,11 +41,21 @@ func Deserialize(node *Node) (any, error) {
 		structField := model.FieldByName(relatedSchema.Field)
 		structType := structField.Type()
 		edges := node.Outgoing.FilterByName(relatedSchema.Name)
+		if relatedSchema.Lazy {
+			// we only remember the referenced node, the model is loaded on demand
+			if len(edges) == 1 {
+				structField.Addr().Interface().(settableReference).setReferencedNode(edges[0].To)
+			} else if len(edges) > 1 {
+				return nil, fmt.Errorf("expected at most one edge, got %d", len(edges))
+			}
+			continue
+		}
+
 		switch relatedSchema.Type {
 		case Map:
 			mapValue := reflect.MakeMap(structType)
 			for _, edge := range edges {
-				if model, err := Deserialize(edge.To); err != nil {
+				if model, err := deserialize(edge.To, values); err != nil {
 					return nil, fmt.Errorf("cannot deserialize related node '%s'(%s): %v", relatedSchema.Name, edge.Key, err)
 				} else {
 					modelValue := reflect.ValueOf(model)
@@ -52,7 +76,7 @@ func Deserialize(node *Node) (any, error) {
 				}
 				return nil, fmt.Errorf("expected exactly one edge, got %d", len(edges))
 			}
-			if model, err := Deserialize(edges[0].To); err != nil {
+			if model, err := deserialize(edges[0].To, values); err != nil {
 				return nil, fmt.Errorf("cannot deserialize related node '%s': %v", relatedSchema.Name, err)
 			} else {
 				modelValue := reflect.ValueOf(model)
@@ -68,7 +92,7 @@ func Deserialize(node *Node) (any, error) {
 		case Slice:
 			// to do: check the edge indices to ensure they're sorted correctly
 			for _, edge := range edges {
-				if model, err := Deserialize(edge.To); err != nil {
+				if model, err := deserialize(edge.To, values); err != nil {
 					return nil, fmt.Errorf("cannot deserialize related node '%s'(%d): %v", relatedSchema.Name, edge.Index, err)
 				} else {
 					modelValue := reflect.ValueOf(model)
@@ -82,6 +106,8 @@ func Deserialize(node *Node) (any, error) {
 		}
 	}
 
+	values[node] = modelPtr.Interface()
+
 	return modelPtr.Interface(), nil
 }
 
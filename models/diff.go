@@ -0,0 +1,162 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type ChangeType int
+
+const (
+	Added ChangeType = iota
+	Removed
+	Changed
+)
+
+func (c ChangeType) String() string {
+	switch c {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Changed:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// describes a single difference between two graphs
+type Change struct {
+	Type ChangeType
+	// the path of the node, e.g. 'dom/children[3]/attributes[class]'
+	Path string
+	// the node in the old graph (nil if the node was added)
+	From *Node
+	// the node in the new graph (nil if the node was removed)
+	To *Node
+	// the edge pointing to the node in the old graph (nil for the root)
+	FromEdge *Edge
+	// the edge pointing to the node in the new graph (nil for the root)
+	ToEdge *Edge
+}
+
+// uniquely identifies an edge among the outgoing edges of a node
+type EdgeKey struct {
+	Name  string
+	Type  int
+	Key   string
+	Index int
+}
+
+func (e *Edge) EdgeKey() EdgeKey {
+	return EdgeKey{
+		Name:  e.Name,
+		Type:  e.Type,
+		Key:   e.Key,
+		Index: e.Index,
+	}
+}
+
+// returns the path segment of the edge, e.g. 'children[3]'
+func (e *Edge) PathSegment() string {
+	switch Relation(e.Type) {
+	case Slice:
+		return fmt.Sprintf("%s[%d]", e.Name, e.Index)
+	case Map:
+		return fmt.Sprintf("%s[%s]", e.Name, e.Key)
+	}
+	return e.Name
+}
+
+func joinPath(path, segment string) string {
+	if path == "" {
+		return segment
+	}
+	return path + "/" + segment
+}
+
+// Diff compares two graphs and returns the added, removed and changed
+// nodes and edges. Subtrees with identical hashes are skipped, and added
+// or removed subtrees are reported only once, at their root. A nil graph
+// (e.g. a missing base or a site without a head) is treated as empty, so
+// the entire other graph is reported as added or removed.
+func Diff(a, b *Node) []*Change {
+
+	changes := make([]*Change, 0)
+
+	if a == nil && b == nil {
+		return changes
+	} else if a == nil {
+		return append(changes, &Change{Type: Added, To: b})
+	} else if b == nil {
+		return append(changes, &Change{Type: Removed, From: a})
+	}
+
+	return diffNodes(a, b, nil, nil, "", changes)
+}
+
+func diffNodes(a, b *Node, aEdge, bEdge *Edge, path string, changes []*Change) []*Change {
+
+	// edge data isn't part of the node hash, so we check it separately
+	if a.Type != b.Type || !bytes.Equal(a.Data, b.Data) || !equalEdges(aEdge, bEdge) {
+		changes = append(changes, &Change{
+			Type:     Changed,
+			Path:     path,
+			From:     a,
+			To:       b,
+			FromEdge: aEdge,
+			ToEdge:   bEdge,
+		})
+	}
+
+	if bytes.Equal(a.Hash, b.Hash) {
+		// the subtrees are identical
+		return changes
+	}
+
+	bEdges := make(map[EdgeKey]*Edge, len(b.Outgoing))
+
+	for _, edge := range b.Outgoing {
+		bEdges[edge.EdgeKey()] = edge
+	}
+
+	aEdges := make(map[EdgeKey]*Edge, len(a.Outgoing))
+
+	for _, edge := range a.Outgoing {
+
+		aEdges[edge.EdgeKey()] = edge
+
+		edgePath := joinPath(path, edge.PathSegment())
+
+		if bEdge, ok := bEdges[edge.EdgeKey()]; ok {
+			changes = diffNodes(edge.To, bEdge.To, edge, bEdge, edgePath, changes)
+		} else {
+			changes = append(changes, &Change{
+				Type:     Removed,
+				Path:     edgePath,
+				From:     edge.To,
+				FromEdge: edge,
+			})
+		}
+	}
+
+	for _, edge := range b.Outgoing {
+		if _, ok := aEdges[edge.EdgeKey()]; !ok {
+			changes = append(changes, &Change{
+				Type:   Added,
+				Path:   joinPath(path, edge.PathSegment()),
+				To:     edge.To,
+				ToEdge: edge,
+			})
+		}
+	}
+
+	return changes
+}
+
+func equalEdges(a, b *Edge) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Follow == b.Follow && bytes.Equal(a.Data, b.Data)
+}
@@ -0,0 +1,90 @@
+package models_test
+
+import (
+	"github.com/demakes/demake/models"
+	"testing"
+)
+
+func makeDiffTag() *Tag {
+	return &Tag{
+		Type: "div",
+		Meta: Meta{Language: "de"},
+		Children: []*Tag{
+			&Tag{Type: "p", Meta: Meta{Language: "de"}},
+			&Tag{Type: "h1", Meta: Meta{Language: "de"}},
+		},
+		Attributes: []*Attribute{
+			&Attribute{
+				Name:  "class",
+				Value: "foo",
+				Labels: map[string]*Label{
+					"test": {Name: "foo", Value: "bar"},
+				},
+			},
+		},
+	}
+}
+
+func TestDiff(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := models.Serialize(makeDiffTag())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changes := models.Diff(a, a); len(changes) != 0 {
+		t.Fatalf("expected no changes, got %d", len(changes))
+	}
+
+	tag := makeDiffTag()
+	// we change a label
+	tag.Attributes[0].Labels["test"].Value = "baz"
+	// we remove the second child
+	tag.Children = tag.Children[:1]
+	// we add a new label
+	tag.Attributes[0].Labels["new"] = &Label{Name: "new", Value: "label"}
+
+	b, err := models.Serialize(tag)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := models.Diff(a, b)
+
+	expected := map[string]models.ChangeType{
+		"children[1]":                models.Removed,
+		"attributes[0]/labels[test]": models.Changed,
+		"attributes[0]/labels[new]":  models.Added,
+	}
+
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %d", len(expected), len(changes))
+	}
+
+	for _, change := range changes {
+		if changeType, ok := expected[change.Path]; !ok {
+			t.Fatalf("unexpected change at '%s'", change.Path)
+		} else if changeType != change.Type {
+			t.Fatalf("expected change at '%s' to be %s, got %s", change.Path, changeType, change.Type)
+		}
+	}
+
+	// a missing graph is treated as empty
+	if changes := models.Diff(nil, b); len(changes) != 1 || changes[0].Type != models.Added || changes[0].To != b {
+		t.Fatalf("expected the graph to be added")
+	}
+
+	if changes := models.Diff(a, nil); len(changes) != 1 || changes[0].Type != models.Removed || changes[0].From != a {
+		t.Fatalf("expected the graph to be removed")
+	}
+
+	if changes := models.Diff(nil, nil); len(changes) != 0 {
+		t.Fatalf("expected no changes, got %d", len(changes))
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"github.com/gospel-sh/gospel"
 )
 
+// the registered type of HTML elements
+const ElementType = "element"
+
 func init() {
-	MustRegister[gospel.HTMLElement]("element")
+	MustRegister[gospel.HTMLElement](ElementType)
 	MustRegister[gospel.HTMLAttribute]("attribute")
 	MustRegister[gospel.RouteConfig]("route")
 	MustRegister[gospel.Function]("function")
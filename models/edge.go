@@ -32,6 +32,7 @@ INSERT INTO edge
 		ind,
 		key,
 		data,
+		follow,
 		updated_at
 	)
 VALUES
@@ -44,13 +45,14 @@ VALUES
 		$6,
 		$7,
 		$8,
+		$9,
 		NULL
 	)
 ON CONFLICT
 	(from_id, to_id, name, ind, key, type)
 WHERE
 	deleted_at IS NULL
-DO UPDATE SET updated_at = $9
+DO UPDATE SET updated_at = $10
 RETURNING
 	id, updated_at, created_at
 `
@@ -90,7 +92,7 @@ func (e *Edge) Save(db orm.Transaction) error {
 
 	e.UpdatedAt = &orm.Time{time.Now()}
 
-	if rows, err := db.Query(insertEdgeQuery, e.ExtID.Bytes(), e.FromID, e.ToID, e.Name, e.Type, e.Index, e.Key, e.Data, time.Now().UTC()); err != nil {
+	if rows, err := db.Query(insertEdgeQuery, e.ExtID.Bytes(), e.FromID, e.ToID, e.Name, e.Type, e.Index, e.Key, e.Data, e.Follow, time.Now().UTC()); err != nil {
 		return fmt.Errorf("cannot check for node existence. %v", err)
 	} else {
 		defer rows.Close()
@@ -0,0 +1,358 @@
+package models
+
+import (
+	"fmt"
+	"github.com/demakes/demake/auth"
+	"github.com/demakes/demake/cache"
+	"github.com/gospel-sh/gospel/orm"
+	"math/rand"
+	"time"
+)
+
+// An experiment serves different versions of a site to different visitors,
+// e.g. to find out which version of a landing page works better (A/B test).
+// Only one experiment per site can be active at a time.
+type Experiment struct {
+	orm.DBModel
+	orm.JSONModel
+	SiteID int64
+	Name   string
+	Active bool
+}
+
+// A variant of an experiment, which is shown to a share of the visitors
+// proportional to its weight.
+type ExperimentVariant struct {
+	orm.DBModel
+	orm.JSONModel
+	ExperimentID int64
+	Name         string
+	// the version of the site that is shown, which can be a ref name, a
+	// commit ID or a node hash (see Site.ResolveVersion). It is replaced by
+	// the hex-encoded hash of its head when the experiment starts.
+	Version string
+	Weight  int
+	// the number of visitors that were assigned to this variant
+	Exposures int64
+	// the resolved head of the version (only set for active experiments)
+	HeadID int64 `json:"-" db:"ignore"`
+}
+
+func (e *Experiment) Save() error {
+	if err := orm.Save(e); err != nil {
+		return err
+	}
+	ExperimentCache.Delete(e.SiteID)
+	return nil
+}
+
+func (e *Experiment) ByExtID(id []byte) error {
+	return orm.LoadOne(e, map[string]any{"ext_id": id})
+}
+
+func (v *ExperimentVariant) Save() error {
+	return orm.Save(v)
+}
+
+// the active experiment of a site together with its variants
+type ActiveExperiment struct {
+	Experiment *Experiment
+	Variants   []*ExperimentVariant
+}
+
+// caches the active experiment of each site (nil if there is none) by the
+// ID of the site. Experiments can also be changed by other processes, so
+// entries expire after a short time.
+var ExperimentCache = cache.MakeLRU[int64, *ActiveExperiment](1024, time.Minute)
+
+// Experiments returns all experiments of the site
+func (s *Site) Experiments(db func() orm.DB) ([]*Experiment, error) {
+	return orm.Objects[Experiment](db, map[string]any{"site_id": s.ID})
+}
+
+// Variants returns the variants of the experiment
+func (e *Experiment) Variants(db func() orm.DB) ([]*ExperimentVariant, error) {
+	return orm.Objects[ExperimentVariant](db, map[string]any{"experiment_id": e.ID})
+}
+
+// CanManageExperiments returns true if the user can create and start
+// experiments, which serves versions of a site to visitors
+func CanManageExperiments(user auth.UserProfile) bool {
+	return auth.HasRole(user, auth.ReviewerRole) || auth.HasRole(user, auth.AdminRole)
+}
+
+// resolves the version of a variant to the ID of its head. Only published
+// versions and approved changes can be shown to visitors.
+func (s *Site) resolveVariant(db func() orm.DB, version string) (int64, error) {
+
+	var headID int64
+
+	// started experiments refer to their versions by hash
+	if hash, err := ParseHash(version); err == nil && len(hash) == HashSize {
+		if headID, err = nodeIDByHash(db(), hash); err != nil && err != ErrNodeNotFound {
+			return 0, err
+		}
+	}
+
+	if headID == 0 {
+
+		var err error
+
+		if headID, err = s.ResolveVersion(db, version); err != nil {
+			return 0, err
+		}
+	}
+
+	if released, err := s.isReleased(db, headID); err != nil {
+		return 0, err
+	} else if !released {
+		return 0, fmt.Errorf("version '%s' is neither published nor approved", version)
+	}
+
+	return headID, nil
+}
+
+// checks if the head was published or is part of an approved change request
+func (s *Site) isReleased(db func() orm.DB, headID int64) (bool, error) {
+
+	history, err := s.RefHistory(db, PublishedRef)
+
+	if err != nil && err != orm.NotFound {
+		return false, err
+	}
+
+	for _, commit := range history {
+		if commit.HeadID == headID {
+			return true, nil
+		}
+	}
+
+	changeRequests, err := orm.Objects[ChangeRequest](db, map[string]any{"site_id": s.ID, "head_id": headID})
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, changeRequest := range changeRequests {
+		if changeRequest.Status == ChangeRequestApproved || changeRequest.Status == ChangeRequestPublished {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// CreateExperiment creates a new (inactive) experiment with the given variants
+func (s *Site) CreateExperiment(db func() orm.DB, user auth.UserProfile, name string, variants []*ExperimentVariant) (*Experiment, error) {
+
+	if !CanManageExperiments(user) {
+		return nil, fmt.Errorf("only reviewers and admins can create experiments")
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("please enter a name")
+	}
+
+	if len(variants) < 2 {
+		return nil, fmt.Errorf("an experiment needs at least two variants")
+	}
+
+	names := make(map[string]bool)
+
+	for _, variant := range variants {
+
+		if variant.Weight <= 0 {
+			return nil, fmt.Errorf("variant '%s' needs a positive weight", variant.Name)
+		}
+
+		if names[variant.Name] {
+			return nil, fmt.Errorf("duplicate variant '%s'", variant.Name)
+		}
+
+		names[variant.Name] = true
+
+		// we make sure that the version exists and can be shown
+		if _, err := s.resolveVariant(db, variant.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	experiment := orm.Init(&Experiment{SiteID: s.ID, Name: name}, db)
+
+	if err := experiment.Save(); err != nil {
+		return nil, fmt.Errorf("cannot save experiment: %v", err)
+	}
+
+	for _, variant := range variants {
+
+		orm.Init(variant, db)
+		variant.ExperimentID = experiment.ID
+
+		if err := variant.Save(); err != nil {
+			return nil, fmt.Errorf("cannot save variant: %v", err)
+		}
+	}
+
+	return experiment, nil
+}
+
+// Start activates the experiment and stops all other experiments of the site.
+// The versions of the variants are pinned to the hashes of their heads, so
+// later changes to a ref don't change the experiment.
+func (e *Experiment) Start(db func() orm.DB, user auth.UserProfile) error {
+
+	if !CanManageExperiments(user) {
+		return fmt.Errorf("only reviewers and admins can start experiments")
+	}
+
+	site := orm.Init(&Site{}, db)
+
+	if err := site.ByID(e.SiteID); err != nil {
+		return fmt.Errorf("cannot load site: %v", err)
+	}
+
+	variants, err := e.Variants(db)
+
+	if err != nil {
+		return err
+	}
+
+	for _, variant := range variants {
+
+		headID, err := site.resolveVariant(db, variant.Version)
+
+		if err != nil {
+			return fmt.Errorf("cannot resolve variant '%s': %v", variant.Name, err)
+		}
+
+		hash, err := nodeHashByID(db(), headID)
+
+		if err != nil {
+			return fmt.Errorf("cannot load head of variant '%s': %v", variant.Name, err)
+		}
+
+		if variant.Version == HexHash(hash) {
+			continue
+		}
+
+		orm.Init(variant, db)
+		variant.Version = HexHash(hash)
+
+		if err := variant.Save(); err != nil {
+			return fmt.Errorf("cannot save variant: %v", err)
+		}
+	}
+
+	experiments, err := orm.Objects[Experiment](db, map[string]any{"site_id": e.SiteID, "active": true})
+
+	if err != nil {
+		return err
+	}
+
+	for _, experiment := range experiments {
+		if err := experiment.Stop(db); err != nil {
+			return err
+		}
+	}
+
+	e.Active = true
+
+	return e.Save()
+}
+
+// Stop deactivates the experiment, so only the published version is served
+func (e *Experiment) Stop(db func() orm.DB) error {
+	e.Active = false
+	return e.Save()
+}
+
+// ActiveExperiment returns the (possibly cached) active experiment of the
+// site, or nil if there is none. The result is shared and must not be modified.
+func (s *Site) ActiveExperiment(db func() orm.DB) (*ActiveExperiment, error) {
+
+	if active, ok := ExperimentCache.Get(s.ID); ok {
+		return active, nil
+	}
+
+	experiments, err := orm.Objects[Experiment](db, map[string]any{"site_id": s.ID, "active": true})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var active *ActiveExperiment
+
+	if len(experiments) > 0 {
+
+		variants, err := experiments[0].Variants(db)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// the versions were pinned to hashes when the experiment started, so
+		// they always resolve to the same heads
+		for _, variant := range variants {
+
+			hash, err := ParseHash(variant.Version)
+
+			if err != nil || len(hash) != HashSize {
+				return nil, fmt.Errorf("variant '%s' isn't pinned to a hash, please restart the experiment", variant.Name)
+			}
+
+			if variant.HeadID, err = nodeIDByHash(db(), hash); err != nil {
+				return nil, fmt.Errorf("cannot resolve variant '%s': %v", variant.Name, err)
+			}
+		}
+
+		active = &ActiveExperiment{
+			Experiment: experiments[0],
+			Variants:   variants,
+		}
+	}
+
+	ExperimentCache.Set(s.ID, active)
+
+	return active, nil
+}
+
+// Variant returns the variant with the given name, or nil
+func (a *ActiveExperiment) Variant(name string) *ExperimentVariant {
+	for _, variant := range a.Variants {
+		if variant.Name == name {
+			return variant
+		}
+	}
+	return nil
+}
+
+// Pick randomly picks a variant according to the weights of the variants
+func (a *ActiveExperiment) Pick() *ExperimentVariant {
+
+	total := 0
+
+	for _, variant := range a.Variants {
+		total += variant.Weight
+	}
+
+	if total <= 0 {
+		return nil
+	}
+
+	n := rand.Intn(total)
+
+	for _, variant := range a.Variants {
+		if n < variant.Weight {
+			return variant
+		}
+		n -= variant.Weight
+	}
+
+	return nil
+}
+
+// RecordExposure counts a new visitor that was assigned to the variant
+func (v *ExperimentVariant) RecordExposure(db func() orm.DB) error {
+	_, err := db().Exec(`UPDATE experiment_variant SET exposures = exposures + 1 WHERE id = $1`, v.ID)
+	return err
+}
@@ -0,0 +1,180 @@
+package models_test
+
+import (
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/auth"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+func TestExperiments(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	// site IDs are reused between test databases
+	models.ExperimentCache.Purge()
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := make([]*models.Node, 0)
+
+	for _, tagType := range []string{"p", "h1", "h2"} {
+
+		node, err := models.Serialize(&Tag{Type: tagType, Meta: Meta{Language: "de"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := node.SaveTree(db); err != nil {
+			t.Fatal(err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	for _, node := range nodes[:2] {
+		if _, err := site.CommitHead(dbf, node, nil, node.Type); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := site.CommitRef(dbf, models.DraftRef, nodes[2], nil, "draft"); err != nil {
+		t.Fatal(err)
+	}
+
+	editor := makeUser("editor@example.com")
+	reviewer := makeUser("reviewer@example.com", auth.ReviewerRole)
+
+	if _, err := site.CreateExperiment(dbf, reviewer, "invalid", []*models.ExperimentVariant{
+		{Name: "a", Version: models.PublishedRef, Weight: 1},
+		{Name: "b", Version: "missing", Weight: 1},
+	}); err == nil {
+		t.Fatalf("expected an error for an unknown version")
+	}
+
+	if _, err := site.CreateExperiment(dbf, reviewer, "draft", []*models.ExperimentVariant{
+		{Name: "a", Version: models.PublishedRef, Weight: 1},
+		{Name: "b", Version: models.DraftRef, Weight: 1},
+	}); err == nil {
+		t.Fatalf("expected an error for an unpublished version")
+	}
+
+	variants := []*models.ExperimentVariant{
+		{Name: "a", Version: models.HexHash(nodes[0].Hash), Weight: 1},
+		{Name: "b", Version: models.PublishedRef, Weight: 3},
+	}
+
+	if _, err := site.CreateExperiment(dbf, editor, "landing page", variants); err == nil {
+		t.Fatalf("expected an error as editors can't create experiments")
+	}
+
+	experiment, err := site.CreateExperiment(dbf, reviewer, "landing page", variants)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if active, err := site.ActiveExperiment(dbf); err != nil {
+		t.Fatal(err)
+	} else if active != nil {
+		t.Fatalf("the experiment shouldn't be active yet")
+	}
+
+	if err := experiment.Start(dbf, editor); err == nil {
+		t.Fatalf("expected an error as editors can't start experiments")
+	}
+
+	if err := experiment.Start(dbf, reviewer); err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := site.ActiveExperiment(dbf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if active == nil || active.Experiment.ID != experiment.ID {
+		t.Fatalf("expected the experiment to be active")
+	}
+
+	if active.Variant("a").HeadID != nodes[0].ID || active.Variant("b").HeadID != nodes[1].ID {
+		t.Fatalf("expected the variants to be resolved")
+	}
+
+	// the variants are pinned to their heads when the experiment starts
+	if _, err := site.CommitHead(dbf, nodes[2], nil, "new version"); err != nil {
+		t.Fatal(err)
+	}
+
+	models.ExperimentCache.Purge()
+
+	if active, err = site.ActiveExperiment(dbf); err != nil {
+		t.Fatal(err)
+	} else if active.Variant("b").HeadID != nodes[1].ID {
+		t.Fatalf("expected the variant to stay pinned")
+	}
+
+	picked := map[string]int{}
+
+	for i := 0; i < 1000; i++ {
+		picked[active.Pick().Name]++
+	}
+
+	if picked["a"] == 0 || picked["b"] <= picked["a"] {
+		t.Fatalf("variants weren't picked according to their weights: %v", picked)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := active.Variant("b").RecordExposure(dbf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if variants, err = experiment.Variants(dbf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, variant := range variants {
+		if variant.Name == "b" && variant.Exposures != 2 {
+			t.Fatalf("expected 2 exposures, got %d", variant.Exposures)
+		}
+	}
+
+	if err := experiment.Stop(dbf); err != nil {
+		t.Fatal(err)
+	}
+
+	if active, err := site.ActiveExperiment(dbf); err != nil {
+		t.Fatal(err)
+	} else if active != nil {
+		t.Fatalf("the experiment should be stopped")
+	}
+}
@@ -0,0 +1,7 @@
+package models
+
+// SetGCAfterMark sets a function that is called between the mark and the
+// sweep phase of the GC
+func SetGCAfterMark(f func()) {
+	gcAfterMark = f
+}
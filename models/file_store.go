@@ -0,0 +1,107 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileStore keeps graphs in a directory, with one JSON file per node that
+// is named after the hex-encoded hash of the node. Node IDs are local to
+// the directory.
+type FileStore struct {
+	recordStore
+	path string
+}
+
+type fileBackend string
+
+func (f fileBackend) filename(hash string) string {
+	return filepath.Join(string(f), hash+".json")
+}
+
+func (f fileBackend) getRecord(hash string) (*nodeRecord, error) {
+
+	data, err := os.ReadFile(f.filename(hash))
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	record := &nodeRecord{}
+
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("invalid node file '%s': %v", f.filename(hash), err)
+	}
+
+	return record, nil
+}
+
+func (f fileBackend) putRecord(hash string, record *nodeRecord) error {
+
+	data, err := json.MarshalIndent(record, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	// we write to a temporary file first so we never leave partial nodes
+	tmpFilename := f.filename(hash) + ".tmp"
+
+	if err := os.WriteFile(tmpFilename, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilename, f.filename(hash))
+}
+
+func (f fileBackend) deleteRecord(hash string) error {
+	return os.Remove(f.filename(hash))
+}
+
+// MakeFileStore opens (and if necessary creates) the given directory
+func MakeFileStore(path string) (*FileStore, error) {
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	backend := fileBackend(path)
+
+	store := &FileStore{
+		recordStore: makeRecordStore(backend),
+		path:        path,
+	}
+
+	entries, err := os.ReadDir(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// we index the IDs of all existing nodes
+	for _, entry := range entries {
+
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		record, err := backend.getRecord(strings.TrimSuffix(entry.Name(), ".json"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		store.addRecord(record)
+	}
+
+	return store, nil
+}
+
+func (f *FileStore) Path() string {
+	return f.path
+}
@@ -0,0 +1,281 @@
+package models
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/gospel-sh/gospel/orm"
+	"sort"
+)
+
+// describes an inconsistency found by Fsck
+type FsckProblem struct {
+	SiteID  int64
+	NodeID  int64
+	Path    string
+	Message string
+}
+
+func (p *FsckProblem) String() string {
+	path := p.Path
+	if path == "" {
+		path = "(root)"
+	}
+	return fmt.Sprintf("site %d, node %d at %s: %s", p.SiteID, p.NodeID, path, p.Message)
+}
+
+type fsck struct {
+	db       func() orm.DB
+	siteID   int64
+	problems []*FsckProblem
+}
+
+func (f *fsck) report(node *Node, path string, message string, args ...any) {
+	var nodeID int64
+	if node != nil {
+		nodeID = node.ID
+	}
+	f.problems = append(f.problems, &FsckProblem{
+		SiteID:  f.siteID,
+		NodeID:  nodeID,
+		Path:    path,
+		Message: fmt.Sprintf(message, args...),
+	})
+}
+
+// returns all edges that point from a reachable node to a soft-deleted one
+var danglingEdgesQuery = `
+WITH RECURSIVE
+	reachable(id)
+	AS (
+		SELECT id FROM node WHERE id = $1
+		UNION SELECT
+			edge.to_id
+		FROM
+			edge
+		JOIN
+			node ON node.id = edge.to_id AND node.deleted_at IS NULL
+		JOIN
+			reachable ON edge.from_id = reachable.id
+		WHERE
+			edge.deleted_at IS NULL
+	)
+SELECT
+	edge.from_id, edge.to_id, edge.name
+FROM
+	edge
+JOIN
+	node ON node.id = edge.to_id
+JOIN
+	reachable ON edge.from_id = reachable.id
+WHERE
+	edge.deleted_at IS NULL AND node.deleted_at IS NOT NULL
+ORDER BY
+	edge.from_id, edge.id
+`
+
+func (f *fsck) checkDanglingEdges(headID int64) error {
+
+	rows, err := f.db().Query(danglingEdgesQuery, headID)
+
+	if err != nil {
+		return fmt.Errorf("cannot check for dangling edges: %v", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var fromID, toID int64
+		var name string
+		if err := rows.Scan(&fromID, &toID, &name); err != nil {
+			return fmt.Errorf("scan error: %v", err)
+		}
+		f.report(&Node{ID: fromID}, "", "edge '%s' points to deleted node %d", name, toID)
+	}
+
+	return nil
+}
+
+// checks node types and slice indexes, returns false if there are unknown types
+func (f *fsck) checkStructure(node *Node, path string) bool {
+
+	known := true
+
+	if _, ok := Registry[node.Type]; !ok {
+		f.report(node, path, "unknown type '%s'", node.Type)
+		known = false
+	}
+
+	indexes := map[string][]int{}
+
+	for _, edge := range node.Outgoing {
+		if edge.Type == int(Slice) {
+			indexes[edge.Name] = append(indexes[edge.Name], edge.Index)
+		}
+		if !f.checkStructure(edge.To, joinPath(path, edge.PathSegment())) {
+			known = false
+		}
+	}
+
+	for name, sliceIndexes := range indexes {
+
+		sort.Ints(sliceIndexes)
+
+		expected := 0
+
+		for i, index := range sliceIndexes {
+			if i > 0 && index == sliceIndexes[i-1] {
+				f.report(node, path, "duplicate index %d in '%s'", index, name)
+				continue
+			}
+			if index != expected {
+				f.report(node, path, "gap in '%s', expected index %d, got %d", name, expected, index)
+			}
+			expected = index + 1
+		}
+	}
+
+	return known
+}
+
+// compares the stored graph with the re-serialized one and reports nodes
+// whose hashes differ and edges that only exist in one of the graphs.
+// Referenced graphs are serialized as stubs that keep their hash, so they
+// aren't compared.
+func compareHashes(stored, recomputed *Node, path string, report func(node *Node, path string, message string, args ...any)) {
+
+	if !bytes.Equal(stored.Hash, recomputed.Hash) {
+		report(stored, path, "stored hash %s doesn't match recomputed hash %s", hex.EncodeToString(stored.Hash), hex.EncodeToString(recomputed.Hash))
+	}
+
+	recomputedEdges := outgoingByKey(recomputed)
+	seen := map[EdgeKey]bool{}
+
+	for _, edge := range stored.Outgoing {
+
+		key := edge.EdgeKey()
+		seen[key] = true
+		edgePath := joinPath(path, edge.PathSegment())
+
+		if recomputedEdge, ok := recomputedEdges[key]; !ok {
+			report(stored, edgePath, "edge is lost when serializing again")
+		} else if edge.Follow {
+			compareHashes(edge.To, recomputedEdge.To, edgePath, report)
+		}
+	}
+
+	for _, edge := range recomputed.Outgoing {
+		if !seen[edge.EdgeKey()] {
+			report(stored, joinPath(path, edge.PathSegment()), "edge is missing in the stored graph")
+		}
+	}
+}
+
+// returns the distinct GC roots, a head that is used by several sites is
+// only checked once
+var fsckRootsQuery = fmt.Sprintf(`
+SELECT
+	MIN(site_id), id
+FROM
+	(%s) AS roots
+GROUP BY
+	id
+ORDER BY
+	MIN(site_id), id
+`, gcRootsQuery)
+
+type fsckRoot struct {
+	siteID int64
+	headID int64
+}
+
+func (f *fsck) roots() ([]fsckRoot, error) {
+
+	rows, err := f.db().Query(fsckRootsQuery)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load heads: %v", err)
+	}
+
+	defer rows.Close()
+
+	roots := make([]fsckRoot, 0)
+
+	for rows.Next() {
+		var root fsckRoot
+		if err := rows.Scan(&root.siteID, &root.headID); err != nil {
+			return nil, fmt.Errorf("scan error: %v", err)
+		}
+		roots = append(roots, root)
+	}
+
+	return roots, nil
+}
+
+func (f *fsck) checkHead(root fsckRoot) error {
+
+	f.siteID = root.siteID
+
+	if err := f.checkDanglingEdges(root.headID); err != nil {
+		return err
+	}
+
+	node, err := MakeSQLStore(f.db).GetByID(root.headID)
+
+	if err == ErrNodeNotFound {
+		f.report(&Node{ID: root.headID}, "", "head node is missing or deleted")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !f.checkStructure(node, "") {
+		// we can't deserialize unknown types
+		return nil
+	}
+
+	model, err := Deserialize(node)
+
+	if err != nil {
+		f.report(node, "", "cannot deserialize graph: %v", err)
+		return nil
+	}
+
+	recomputed, err := Serialize(model)
+
+	if err != nil {
+		f.report(node, "", "cannot serialize graph again: %v", err)
+		return nil
+	}
+
+	compareHashes(node, recomputed, "", f.report)
+
+	return nil
+}
+
+// Fsck checks the graphs of all heads that are kept by the GC (sites, refs,
+// commits, change requests and schedules) for consistency and returns the
+// problems it finds: nodes whose stored hash doesn't match the one obtained
+// by serializing the graph again, edges pointing to deleted nodes, nodes
+// with unregistered types and slices with missing or duplicate indexes.
+func Fsck(db func() orm.DB) ([]*FsckProblem, error) {
+
+	f := &fsck{
+		db:       db,
+		problems: make([]*FsckProblem, 0),
+	}
+
+	roots, err := f.roots()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, root := range roots {
+		if err := f.checkHead(root); err != nil {
+			return nil, fmt.Errorf("cannot check head %d of site %d: %v", root.headID, root.siteID, err)
+		}
+	}
+
+	return f.problems, nil
+}
@@ -0,0 +1,134 @@
+package models_test
+
+import (
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"strings"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	node, err := models.Serialize(makeDiffTag())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example", HeadID: &node.ID}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems, err := models.Fsck(dbf); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Fatalf("expected no problems, got %v", problems)
+	}
+
+	first := node.Outgoing[1].To
+	second := node.Outgoing[2].To
+	attribute := node.Outgoing[3].To
+
+	for _, query := range []struct {
+		sql  string
+		args []any
+	}{
+		// we modify the data of the first child without updating its hash
+		{`UPDATE node SET data = $1 WHERE id = $2`, []any{[]byte(`{"type":"span","value":null}`), first.ID}},
+		// we move the second child to a different index
+		{`UPDATE edge SET ind = 5 WHERE from_id = $1 AND to_id = $2`, []any{node.ID, second.ID}},
+		// we delete the attribute node but not its edge
+		{`UPDATE node SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1`, []any{attribute.ID}},
+	} {
+		if _, err := db.Exec(query.sql, query.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := models.Fsck(dbf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{
+		"children[0]: stored hash":                         false,
+		"(root): gap in 'children'":                        false,
+		"(root): edge 'attributes' points to deleted node": false,
+	}
+
+	for _, problem := range problems {
+		for substr := range expected {
+			if strings.Contains(problem.String(), substr) {
+				expected[substr] = true
+			}
+		}
+	}
+
+	for substr, found := range expected {
+		if !found {
+			t.Fatalf("expected a problem containing '%s', got %v", substr, problems)
+		}
+	}
+
+	// heads of other refs are checked as well
+	draft, err := models.Serialize(&Tag{Type: "p", Meta: Meta{Language: "en"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := draft.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CommitRef(dbf, models.DraftRef, draft, nil, "draft"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`UPDATE node SET data = $1 WHERE id = $2`, []byte(`{"type":"div","value":null}`), draft.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems, err = models.Fsck(dbf); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+
+	for _, problem := range problems {
+		if problem.NodeID == draft.ID && strings.Contains(problem.String(), "(root): stored hash") {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("expected a problem with the draft head, got %v", problems)
+	}
+}
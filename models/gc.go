@@ -0,0 +1,386 @@
+package models
+
+import (
+	"fmt"
+	"github.com/gospel-sh/gospel/orm"
+	"strings"
+	"time"
+)
+
+type GCOptions struct {
+	// only determine what would be deleted
+	DryRun bool
+	// permanently delete nodes and edges instead of marking them as deleted
+	Hard bool
+	// nodes that were created or reused within this period are kept,
+	// together with everything they reference
+	GracePeriod time.Duration
+	// the number of nodes that are deleted in one transaction
+	BatchSize int
+}
+
+type GCResult struct {
+	// the number of nodes that are still in use
+	Reachable int
+	// the number of (to be) deleted nodes
+	Nodes int
+	// the number of (to be) deleted edges
+	Edges int
+}
+
+// returns the heads of sites, commits, refs, change requests and schedules
+// together with the ID of their site, which are the roots of the GC
+var gcRootsQuery = `
+SELECT id AS site_id, head_id AS id FROM site WHERE head_id IS NOT NULL
+UNION
+SELECT site_id, head_id AS id FROM "commit"
+UNION
+SELECT site_id, head_id AS id FROM site_ref
+UNION
+SELECT site_id, head_id AS id FROM change_request
+UNION
+SELECT site_id, base_id AS id FROM change_request
+UNION
+SELECT site_id, head_id AS id FROM schedule WHERE head_id IS NOT NULL
+`
+
+// returns the IDs of all nodes that must be kept (the GC roots and recently
+// created or reused nodes) and everything reachable from them
+var gcReachableQuery = fmt.Sprintf(`
+WITH RECURSIVE
+	reachable(id)
+	AS (
+		SELECT id FROM (
+			SELECT id FROM (%s) AS heads
+			UNION
+			SELECT id FROM node WHERE deleted_at IS NULL AND COALESCE(updated_at, created_at) >= $1
+		) AS roots
+		UNION SELECT
+			edge.to_id
+		FROM
+			edge
+		JOIN
+			reachable ON edge.from_id = reachable.id
+		WHERE
+			edge.deleted_at IS NULL
+	)
+SELECT id FROM reachable;
+`, gcRootsQuery)
+
+// returns the next batch of nodes that are candidates for deletion
+var gcCandidatesQuery = `
+SELECT
+	id
+FROM
+	node
+WHERE
+	id > $1 AND COALESCE(updated_at, created_at) < $2 AND (deleted_at IS NULL OR $3)
+ORDER BY
+	id
+LIMIT $4
+`
+
+// returns the nodes among the given candidates that are reachable from nodes
+// that were created ($1 is the highest node ID during the mark phase) or
+// reused ($2) after the mark phase started, or from heads that were set since
+// then ($3), which happens if a save reuses an unreachable subtree while the
+// collection is running
+var gcRecheckQuery = `
+WITH RECURSIVE
+	touched(id)
+	AS (
+		SELECT id FROM (
+			SELECT id FROM node WHERE deleted_at IS NULL AND (id > $1 OR updated_at >= $2)
+			UNION
+			SELECT head_id AS id FROM site WHERE head_id IS NOT NULL AND COALESCE(updated_at, created_at) >= $3
+			UNION
+			SELECT head_id AS id FROM "commit" WHERE COALESCE(updated_at, created_at) >= $3
+			UNION
+			SELECT head_id AS id FROM site_ref WHERE COALESCE(updated_at, created_at) >= $3
+			UNION
+			SELECT head_id AS id FROM change_request WHERE COALESCE(updated_at, created_at) >= $3
+			UNION
+			SELECT base_id AS id FROM change_request WHERE COALESCE(updated_at, created_at) >= $3
+			UNION
+			SELECT head_id AS id FROM schedule WHERE head_id IS NOT NULL AND COALESCE(updated_at, created_at) >= $3
+		) AS roots
+		UNION SELECT
+			edge.to_id
+		FROM
+			edge
+		JOIN
+			touched ON edge.from_id = touched.id
+		WHERE
+			edge.deleted_at IS NULL
+	)
+SELECT id FROM touched WHERE id IN (%s);
+`
+
+// describes the state of the database when the mark phase started
+type gcMark struct {
+	// the highest node ID
+	maxID int64
+	// the start time of the mark phase
+	start time.Time
+}
+
+// called between the mark and the sweep phase, only used in tests
+var gcAfterMark func()
+
+// returns a list of numbered placeholders, e.g. '$2, $3, $4'
+func placeholders(start, n int) string {
+	values := make([]string, n)
+	for i := 0; i < n; i++ {
+		values[i] = fmt.Sprintf("$%d", start+i)
+	}
+	return strings.Join(values, ", ")
+}
+
+func int64sToArgs(ids []int64) []any {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
+
+// GC deletes all nodes and edges that can't be reached from any site head,
+// commit or ref anymore. Nodes created or reused within the grace period are
+// kept, which protects trees that are being saved while the collection is
+// running, as their head isn't set until the tree is complete. The grace
+// period should therefore be much longer than the longest save operation.
+// Saves that reuse unreachable subtrees during the collection only update
+// the root of the subtree, so each batch is checked again before deleting it.
+func GC(db func() orm.DB, options *GCOptions) (*GCResult, error) {
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = 1000
+	}
+
+	mark := &gcMark{
+		start: time.Now().UTC(),
+	}
+
+	cutoff := mark.start.Add(-options.GracePeriod)
+
+	if err := mark.loadMaxID(db); err != nil {
+		return nil, err
+	}
+
+	// mark phase: we determine all reachable nodes
+	rows, err := db().Query(gcReachableQuery, cutoff)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine reachable nodes: %v", err)
+	}
+
+	reachable := make(map[int64]bool)
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan error: %v", err)
+		}
+		reachable[id] = true
+	}
+
+	rows.Close()
+
+	result := &GCResult{
+		Reachable: len(reachable),
+	}
+
+	if gcAfterMark != nil {
+		gcAfterMark()
+	}
+
+	// sweep phase: we delete all unreachable nodes in batches
+	var lastID int64
+
+	for {
+		rows, err := db().Query(gcCandidatesQuery, lastID, cutoff, options.Hard, options.BatchSize)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot load candidates: %v", err)
+		}
+
+		candidates := 0
+		unreachable := make([]int64, 0, options.BatchSize)
+
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("scan error: %v", err)
+			}
+			candidates++
+			lastID = id
+			if !reachable[id] {
+				unreachable = append(unreachable, id)
+			}
+		}
+
+		rows.Close()
+
+		if len(unreachable) > 0 {
+			// we check again within the transaction, as the nodes might have
+			// been reused since the mark phase
+			nodes, edges, err := sweep(db, unreachable, options, mark.recheck)
+
+			if err != nil {
+				return nil, err
+			}
+
+			result.Nodes += nodes
+			result.Edges += edges
+		}
+
+		if candidates < options.BatchSize {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func (m *gcMark) loadMaxID(db func() orm.DB) error {
+
+	rows, err := db().Query(`SELECT COALESCE(MAX(id), 0) FROM node`)
+
+	if err != nil {
+		return fmt.Errorf("cannot determine the highest node ID: %v", err)
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+		if err := rows.Scan(&m.maxID); err != nil {
+			return fmt.Errorf("scan error: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// removes the nodes that became reachable since the mark phase started
+func (m *gcMark) recheck(tx orm.Transaction, ids []int64) ([]int64, error) {
+
+	// created_at has a resolution of one second in SQLite, so we also
+	// consider heads that were set in the second the mark phase started
+	args := append([]any{m.maxID, m.start, m.start.Truncate(time.Second)}, int64sToArgs(ids)...)
+
+	rows, err := tx.Query(fmt.Sprintf(gcRecheckQuery, placeholders(4, len(ids))), args...)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot check reachability: %v", err)
+	}
+
+	defer rows.Close()
+
+	reachable := map[int64]bool{}
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scan error: %v", err)
+		}
+		reachable[id] = true
+	}
+
+	unreachable := make([]int64, 0, len(ids))
+
+	for _, id := range ids {
+		if !reachable[id] {
+			unreachable = append(unreachable, id)
+		}
+	}
+
+	return unreachable, nil
+}
+
+// filters the nodes that are about to be deleted within the transaction
+type sweepFilter func(tx orm.Transaction, ids []int64) ([]int64, error)
+
+// deletes (or counts) the given nodes and all edges that point to or from
+// them and returns the number of deleted nodes and edges. The filter (if
+// given) can remove nodes that must be kept within the same transaction.
+func sweep(db func() orm.DB, ids []int64, options *GCOptions, filter sweepFilter) (int, int, error) {
+
+	tx, err := db().Begin()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if filter != nil {
+
+		if ids, err = filter(tx, ids); err != nil {
+			tx.Rollback()
+			return 0, 0, err
+		}
+
+		if len(ids) == 0 {
+			return 0, 0, tx.Rollback()
+		}
+	}
+
+	inList := placeholders(1, len(ids))
+	args := int64sToArgs(ids)
+
+	edgeFilter := fmt.Sprintf(`(from_id IN (%[1]s) OR to_id IN (%[1]s))`, inList)
+
+	if !options.Hard {
+		// when soft-deleting we ignore edges that are already deleted
+		edgeFilter += ` AND deleted_at IS NULL`
+	}
+
+	var edges int
+
+	rows, err := tx.Query(fmt.Sprintf(`SELECT COUNT(*) FROM edge WHERE %s`, edgeFilter), args...)
+
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, fmt.Errorf("cannot count edges: %v", err)
+	}
+
+	if rows.Next() {
+		if err := rows.Scan(&edges); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, 0, fmt.Errorf("scan error: %v", err)
+		}
+	}
+
+	rows.Close()
+
+	if options.DryRun {
+		return len(ids), edges, tx.Rollback()
+	}
+
+	queries := []string{
+		fmt.Sprintf(`DELETE FROM edge WHERE %s`, edgeFilter),
+		fmt.Sprintf(`DELETE FROM node WHERE id IN (%s)`, inList),
+	}
+
+	if !options.Hard {
+		// sqlite numbers parameters in the order in which they appear,
+		// so the deletion time has to come first
+		inList = placeholders(2, len(ids))
+		edgeFilter = fmt.Sprintf(`(from_id IN (%[1]s) OR to_id IN (%[1]s)) AND deleted_at IS NULL`, inList)
+		args = append([]any{time.Now().UTC()}, args...)
+		queries = []string{
+			fmt.Sprintf(`UPDATE edge SET deleted_at = $1 WHERE %s`, edgeFilter),
+			fmt.Sprintf(`UPDATE node SET deleted_at = $1 WHERE id IN (%s)`, inList),
+		}
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query, args...); err != nil {
+			tx.Rollback()
+			return 0, 0, fmt.Errorf("cannot delete: %v", err)
+		}
+	}
+
+	return len(ids), edges, tx.Commit()
+}
@@ -0,0 +1,242 @@
+package models_test
+
+import (
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+	"time"
+)
+
+func countNodes(t *testing.T, db orm.DB) int {
+
+	rows, err := db.Query(`SELECT COUNT(*) FROM node WHERE deleted_at IS NULL`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rows.Close()
+
+	var count int
+
+	if rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return count
+}
+
+func TestGC(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	head, err := models.Serialize(makeDiffTag())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := head.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example", HeadID: &head.ID}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reachable := countNodes(t, db)
+
+	// this tree isn't referenced by anything
+	orphan, err := models.Serialize(&Tag{
+		Type: "h2",
+		Meta: Meta{Language: "en"},
+		Attributes: []*Attribute{
+			&Attribute{Name: "id", Value: "orphan"},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := orphan.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	total := countNodes(t, db)
+
+	// with a grace period, recently created nodes are kept
+	if result, err := models.GC(dbf, &models.GCOptions{GracePeriod: time.Hour}); err != nil {
+		t.Fatal(err)
+	} else if result.Nodes != 0 {
+		t.Fatalf("expected no nodes to be deleted, got %d", result.Nodes)
+	}
+
+	result, err := models.GC(dbf, &models.GCOptions{DryRun: true, BatchSize: 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Nodes != total-reachable {
+		t.Fatalf("expected %d unreachable nodes, got %d", total-reachable, result.Nodes)
+	}
+
+	if result.Edges == 0 {
+		t.Fatalf("expected unreachable edges")
+	}
+
+	if countNodes(t, db) != total {
+		t.Fatalf("dry run shouldn't delete nodes")
+	}
+
+	if _, err := models.GC(dbf, &models.GCOptions{BatchSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := countNodes(t, db); count != reachable {
+		t.Fatalf("expected %d nodes, got %d", reachable, count)
+	}
+
+	if _, err := models.GetGraphByID(dbf, head.ID); err != nil {
+		t.Fatalf("cannot load site graph after GC: %v", err)
+	}
+
+	// a hard delete removes the soft-deleted nodes as well
+	if result, err := models.GC(dbf, &models.GCOptions{Hard: true}); err != nil {
+		t.Fatal(err)
+	} else if result.Nodes != total-reachable {
+		t.Fatalf("expected %d nodes to be purged, got %d", total-reachable, result.Nodes)
+	}
+}
+
+func TestGCReuseDuringCollection(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	head, err := models.Serialize(makeDiffTag())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := head.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example", HeadID: &head.ID}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	makeSection := func() *Tag {
+		return &Tag{
+			Type:     "section",
+			Meta:     Meta{Language: "en"},
+			Children: []*Tag{&Tag{Type: "span", Meta: Meta{Language: "en"}}},
+		}
+	}
+
+	orphan, err := models.Serialize(makeSection())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := orphan.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// all nodes are older than the grace period
+	if _, err := db.Exec(`UPDATE node SET created_at = $1, updated_at = NULL`, time.Now().UTC().Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var reused *models.Node
+
+	// a save reuses the unreachable tree between the mark and the sweep
+	// phase, which only updates the root of the reused tree
+	models.SetGCAfterMark(func() {
+
+		node, err := models.Serialize(&Tag{
+			Type:     "div",
+			Meta:     Meta{Language: "de"},
+			Children: []*Tag{makeSection()},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := node.SaveTree(db); err != nil {
+			t.Fatal(err)
+		}
+
+		site.HeadID = &node.ID
+
+		if err := site.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		reused = node
+	})
+
+	defer models.SetGCAfterMark(nil)
+
+	if _, err := models.GC(dbf, &models.GCOptions{GracePeriod: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	if reused == nil {
+		t.Fatalf("expected the tree to be saved during the collection")
+	}
+
+	graph, err := models.GetGraphByID(dbf, reused.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := countGraphNodes(graph); count != countGraphNodes(reused) {
+		t.Fatalf("expected %d nodes, got %d", countGraphNodes(reused), count)
+	}
+}
@@ -2,14 +2,58 @@ package models
 
 import (
 	"crypto/sha256"
+	"encoding/base32"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"hash"
 	"math"
 	"reflect"
 	"sort"
+	"strings"
 )
 
+// the size of a node hash in bytes
+const HashSize = sha256.Size
+
+// hashes are encoded in lowercase and without padding, so they only consist
+// of letters and digits and can be used in URLs
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// HexHash returns the hex encoding of the hash
+func HexHash(hash []byte) string {
+	return hex.EncodeToString(hash)
+}
+
+// Base32Hash returns the base32 encoding of the hash, which is shorter than
+// the hex encoding (52 instead of 64 characters)
+func Base32Hash(hash []byte) string {
+	return strings.ToLower(base32Encoding.EncodeToString(hash))
+}
+
+// ParseHash decodes a hash in hex or base32 encoding, which are told apart
+// by their length
+func ParseHash(value string) ([]byte, error) {
+
+	var hash []byte
+	var err error
+
+	switch len(value) {
+	case hex.EncodedLen(HashSize):
+		hash, err = hex.DecodeString(value)
+	case base32Encoding.EncodedLen(HashSize):
+		hash, err = base32Encoding.DecodeString(strings.ToUpper(value))
+	default:
+		return nil, fmt.Errorf("invalid hash '%s': unexpected length", value)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash '%s': %v", value, err)
+	}
+
+	return hash, nil
+}
+
 type Hash struct {
 	h hash.Hash
 }
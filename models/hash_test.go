@@ -0,0 +1,40 @@
+package models_test
+
+import (
+	"github.com/demakes/demake/models"
+	"testing"
+)
+
+func TestHashEncodings(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := models.Serialize(makeDiffTag())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hexHash := models.HexHash(node.Hash)
+	base32Hash := models.Base32Hash(node.Hash)
+
+	if len(hexHash) != 64 || len(base32Hash) != 52 {
+		t.Fatalf("unexpected lengths: %d, %d", len(hexHash), len(base32Hash))
+	}
+
+	for _, value := range []string{hexHash, base32Hash} {
+		if hash, err := models.ParseHash(value); err != nil {
+			t.Fatal(err)
+		} else if string(hash) != string(node.Hash) {
+			t.Fatalf("'%s' decodes to a different hash", value)
+		}
+	}
+
+	for _, value := range []string{"", "draft", hexHash[1:], base32Hash[:51] + "!"} {
+		if _, err := models.ParseHash(value); err == nil {
+			t.Fatalf("expected an error for '%s'", value)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package models_test
+
+import (
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+func countGraphNodes(node *models.Node) int {
+	count := 1
+	for _, edge := range node.Outgoing {
+		count += countGraphNodes(edge.To)
+	}
+	return count
+}
+
+func TestLoadOptions(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	node, err := models.Serialize(makeDiffTag())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// root, meta, two children with meta each, attribute and label
+	if countGraphNodes(node) != 8 {
+		t.Fatalf("unexpected number of nodes: %d", countGraphNodes(node))
+	}
+
+	full, err := models.GetGraph(dbf, node.ID, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := countGraphNodes(full); count != 8 {
+		t.Fatalf("expected 8 nodes, got %d", count)
+	}
+
+	// paths are compared literally, even if they contain wildcards
+	literal, err := models.GetGraph(dbf, node.ID, &models.LoadOptions{Exclude: []string{"%", "attribute_"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := countGraphNodes(literal); count != 8 {
+		t.Fatalf("expected 8 nodes, got %d", count)
+	}
+
+	// we only load the direct children of the root
+	shallow, err := models.GetGraph(dbf, node.ID, &models.LoadOptions{MaxDepth: 1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := countGraphNodes(shallow); count != 5 {
+		t.Fatalf("expected 5 nodes, got %d", count)
+	}
+
+	for _, edge := range shallow.Outgoing {
+		if !edge.To.Stub {
+			t.Fatalf("expected children at the maximum depth to be stubs")
+		}
+	}
+
+	if shallow.Stub {
+		t.Fatalf("the root node shouldn't be a stub")
+	}
+
+	if _, err := models.Deserialize(shallow); err == nil {
+		t.Fatalf("expected an error when deserializing stubs")
+	}
+
+	// we only load the meta data and attributes without labels
+	partial, err := models.GetGraph(dbf, node.ID, &models.LoadOptions{
+		Include: []string{"meta", "attributes"},
+		Exclude: []string{"attributes/labels"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := countGraphNodes(partial); count != 3 {
+		t.Fatalf("expected 3 nodes, got %d", count)
+	}
+
+	if len(partial.Outgoing.FilterByName("children")) != 0 {
+		t.Fatalf("children shouldn't be loaded")
+	}
+
+	// the same, but with stubs for the excluded edges
+	stubbed, err := models.GetGraph(dbf, node.ID, &models.LoadOptions{
+		Include: []string{"meta/language", "attributes"},
+		Exclude: []string{"attributes/labels"},
+		Stubs:   true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	children := stubbed.Outgoing.FilterByName("children")
+
+	if len(children) != 2 || !children[0].To.Stub {
+		t.Fatalf("expected children to be returned as stubs")
+	}
+
+	if err := models.LoadStub(dbf, children[0].To, nil, stubbed.NodesByID()); err != nil {
+		t.Fatal(err)
+	}
+
+	if children[0].To.Stub || len(children[0].To.Outgoing) != 1 {
+		t.Fatalf("expected the stub to be loaded")
+	}
+
+	// the child shares the meta node with its parent
+	if children[0].To.Outgoing[0].To != stubbed.Outgoing.FilterByName("meta")[0].To {
+		t.Fatalf("expected the loaded nodes to be reused")
+	}
+
+	if count := countGraphNodes(stubbed); count != 7 {
+		t.Fatalf("expected 7 nodes, got %d", count)
+	}
+}
+
+func TestSharedNodes(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	// the two children are identical and share a node in the database
+	tag := &Tag{
+		Type: "div",
+		Meta: Meta{Language: "de"},
+		Children: []*Tag{
+			&Tag{Type: "p", Meta: Meta{Language: "de"}, Children: []*Tag{&Tag{Type: "span", Meta: Meta{Language: "de"}}}},
+			&Tag{Type: "p", Meta: Meta{Language: "de"}, Children: []*Tag{&Tag{Type: "span", Meta: Meta{Language: "de"}}}},
+		},
+	}
+
+	node, err := models.Serialize(tag)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := models.GetGraphByID(dbf, node.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	children := loaded.Outgoing.FilterByName("children")
+
+	if len(children) != 2 {
+		t.Fatalf("expected two children, got %d", len(children))
+	}
+
+	if children[0] == children[1] || children[0].Index != 0 || children[1].Index != 1 {
+		t.Fatalf("expected two distinct edges")
+	}
+
+	shared := children[0].To
+
+	if shared != children[1].To {
+		t.Fatalf("expected the children to be the same node")
+	}
+
+	if len(shared.Incoming) != 2 {
+		t.Fatalf("expected two incoming edges, got %d", len(shared.Incoming))
+	}
+
+	// the grandchild is only loaded once as well
+	grandchildren := shared.Outgoing.FilterByName("children")
+
+	if len(grandchildren) != 1 || len(grandchildren[0].To.Incoming) != 1 {
+		t.Fatalf("expected the grandchild to be loaded once")
+	}
+
+	model, err := models.DeserializeType[Tag](loaded)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(model.Children) != 2 || model.Children[0] != model.Children[1] {
+		t.Fatalf("expected the children to share a model")
+	}
+
+	if model.Children[0].Children[0].Type != "span" {
+		t.Fatalf("unexpected grandchild: %v", model.Children[0].Children[0])
+	}
+
+	// nodes at the maximum depth are shared as well
+	shallow, err := models.GetGraph(dbf, node.ID, &models.LoadOptions{MaxDepth: 1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	children = shallow.Outgoing.FilterByName("children")
+
+	if len(children) != 2 || children[0].To != children[1].To || !children[0].To.Stub {
+		t.Fatalf("expected the shared child to be a stub")
+	}
+
+	// the graph is still serialized to the same hash
+	reserialized, err := models.Serialize(model)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(reserialized.Hash) != string(node.Hash) {
+		t.Fatalf("hash mismatch")
+	}
+}
@@ -0,0 +1,28 @@
+package models
+
+// MemoryStore keeps graphs in memory, e.g. for tests.
+type MemoryStore struct {
+	recordStore
+}
+
+type memoryBackend map[string]*nodeRecord
+
+func (m memoryBackend) getRecord(hash string) (*nodeRecord, error) {
+	return m[hash], nil
+}
+
+func (m memoryBackend) putRecord(hash string, record *nodeRecord) error {
+	m[hash] = record
+	return nil
+}
+
+func (m memoryBackend) deleteRecord(hash string) error {
+	delete(m, hash)
+	return nil
+}
+
+func MakeMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		recordStore: makeRecordStore(memoryBackend{}),
+	}
+}
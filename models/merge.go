@@ -0,0 +1,181 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// describes a node that was changed in both versions in incompatible ways
+type Conflict struct {
+	Path string
+	// the node in the common ancestor (nil if it didn't exist)
+	Base *Node
+	// our version of the node (nil if we removed it)
+	Ours *Node
+	// their version of the node (nil if they removed it)
+	Theirs *Node
+}
+
+// Merge performs a three-way merge of two versions of a graph against their
+// common ancestor. Edges are matched by their name, key and index. Changes
+// made in only one of the versions are applied automatically. If both
+// versions changed a node in different ways our version is kept and a
+// conflict is reported. The merged graph is serialized again, so its hashes
+// are valid and it can be saved directly.
+func Merge(base, ours, theirs *Node) (*Node, []*Conflict, error) {
+
+	conflicts := make([]*Conflict, 0)
+
+	merged, conflicts := mergeNodes(base, ours, theirs, "", conflicts)
+
+	if merged == nil {
+		return nil, conflicts, fmt.Errorf("the merged graph is empty")
+	}
+
+	// we recalculate all hashes by serializing the merged model again
+	model, err := Deserialize(merged)
+
+	if err != nil {
+		return nil, conflicts, fmt.Errorf("cannot deserialize merged graph: %v", err)
+	}
+
+	mergedNode, err := Serialize(model)
+
+	if err != nil {
+		return nil, conflicts, fmt.Errorf("cannot serialize merged graph: %v", err)
+	}
+
+	return mergedNode, conflicts, nil
+}
+
+func sameNode(a, b *Node) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(a.Hash, b.Hash)
+}
+
+func sameContent(a, b *Node) bool {
+	return a.Type == b.Type && bytes.Equal(a.Data, b.Data)
+}
+
+func outgoingByKey(node *Node) map[EdgeKey]*Edge {
+	edges := map[EdgeKey]*Edge{}
+	if node == nil {
+		return edges
+	}
+	for _, edge := range node.Outgoing {
+		edges[edge.EdgeKey()] = edge
+	}
+	return edges
+}
+
+func edgeTarget(edge *Edge) *Node {
+	if edge == nil {
+		return nil
+	}
+	return edge.To
+}
+
+func mergeNodes(base, ours, theirs *Node, path string, conflicts []*Conflict) (*Node, []*Conflict) {
+
+	switch {
+	case sameNode(ours, theirs):
+		// both made the same change (or none at all)
+		return ours, conflicts
+	case sameNode(base, ours):
+		// only they changed this subtree
+		return theirs, conflicts
+	case sameNode(base, theirs):
+		// only we changed this subtree
+		return ours, conflicts
+	}
+
+	if ours == nil || theirs == nil {
+		// one side removed the node while the other one changed it
+		return ours, append(conflicts, &Conflict{
+			Path:   path,
+			Base:   base,
+			Ours:   ours,
+			Theirs: theirs,
+		})
+	}
+
+	merged := &Node{
+		Type: ours.Type,
+		Data: ours.Data,
+	}
+
+	if !sameContent(ours, theirs) {
+		if base != nil && sameContent(base, ours) {
+			merged.Type = theirs.Type
+			merged.Data = theirs.Data
+		} else if base == nil || !sameContent(base, theirs) {
+			// both sides changed the node itself
+			conflicts = append(conflicts, &Conflict{
+				Path:   path,
+				Base:   base,
+				Ours:   ours,
+				Theirs: theirs,
+			})
+		}
+	}
+
+	baseEdges := outgoingByKey(base)
+	ourEdges := outgoingByKey(ours)
+	theirEdges := outgoingByKey(theirs)
+
+	// we process the edges in a predictable order
+	keys := make([]EdgeKey, 0, len(ourEdges)+len(theirEdges))
+	seen := map[EdgeKey]bool{}
+
+	for _, node := range []*Node{ours, theirs} {
+		for _, edge := range node.Outgoing {
+			if !seen[edge.EdgeKey()] {
+				seen[edge.EdgeKey()] = true
+				keys = append(keys, edge.EdgeKey())
+			}
+		}
+	}
+
+	for _, key := range keys {
+
+		var child *Node
+
+		ourEdge, theirEdge := ourEdges[key], theirEdges[key]
+
+		// we pick the edge that we copy
+		edge := ourEdge
+
+		if edge == nil {
+			edge = theirEdge
+		}
+
+		child, conflicts = mergeNodes(edgeTarget(baseEdges[key]), edgeTarget(ourEdge), edgeTarget(theirEdge), joinPath(path, edge.PathSegment()), conflicts)
+
+		if child == nil {
+			// the node was removed
+			continue
+		}
+
+		mergedEdge := MakeEdge()
+		mergedEdge.Name = edge.Name
+		mergedEdge.Type = edge.Type
+		mergedEdge.Key = edge.Key
+		mergedEdge.Index = edge.Index
+		mergedEdge.Follow = edge.Follow
+		mergedEdge.Data = edge.Data
+		mergedEdge.From = merged
+		mergedEdge.To = child
+
+		merged.Outgoing = append(merged.Outgoing, mergedEdge)
+	}
+
+	// slice elements need to be ordered by their index
+	sort.SliceStable(merged.Outgoing, func(i, j int) bool {
+		return merged.Outgoing[i].Index < merged.Outgoing[j].Index
+	})
+
+	return merged, conflicts
+}
@@ -0,0 +1,100 @@
+package models_test
+
+import (
+	"github.com/demakes/demake/models"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := models.Serialize(makeDiffTag())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// we change the type of the first child
+	ourTag := makeDiffTag()
+	ourTag.Children[0].Type = "span"
+
+	ours, err := models.Serialize(ourTag)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// they change a label and add an attribute
+	theirTag := makeDiffTag()
+	theirTag.Attributes[0].Labels["test"].Value = "baz"
+	theirTag.Attributes = append(theirTag.Attributes, &Attribute{Name: "style", Value: "color: red"})
+
+	theirs, err := models.Serialize(theirTag)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, conflicts, err := models.Merge(base, ours, theirs)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conflicts) != 0 {
+		t.Fatalf("expected no conflicts, got %d", len(conflicts))
+	}
+
+	expectedTag := makeDiffTag()
+	expectedTag.Children[0].Type = "span"
+	expectedTag.Attributes[0].Labels["test"].Value = "baz"
+	expectedTag.Attributes = append(expectedTag.Attributes, &Attribute{Name: "style", Value: "color: red"})
+
+	expected, err := models.Serialize(expectedTag)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changes := models.Diff(expected, merged); len(changes) != 0 {
+		t.Fatalf("merged graph doesn't match, %d changes", len(changes))
+	}
+
+	// they also change the type of the first child
+	theirTag.Children[0].Type = "strong"
+
+	if theirs, err = models.Serialize(theirTag); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, conflicts, err = models.Merge(base, ours, theirs)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conflicts) != 1 {
+		t.Fatalf("expected one conflict, got %d", len(conflicts))
+	}
+
+	if conflicts[0].Path != "children[0]" {
+		t.Fatalf("unexpected conflict path: %s", conflicts[0].Path)
+	}
+
+	mergedTag, err := models.DeserializeType[Tag](merged)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mergedTag.Children[0].Type != "span" {
+		t.Fatalf("expected our version to be kept")
+	}
+
+	if len(mergedTag.Attributes) != 2 {
+		t.Fatalf("expected their non-conflicting changes to be merged")
+	}
+}
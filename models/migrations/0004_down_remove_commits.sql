@@ -0,0 +1,5 @@
+UPDATE demake_version SET version_num = 3;
+
+DROP INDEX ix_site_commit_id;
+ALTER TABLE site DROP COLUMN commit_id;
+DROP TABLE "commit";
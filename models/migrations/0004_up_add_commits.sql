@@ -0,0 +1,71 @@
+UPDATE demake_version SET version_num = 4;
+
+{{$sqlite:=false}}
+
+{{if eq .DBType "sqlite3"}}
+    {{$sqlite = true}}
+{{end}}
+
+/* Commits */
+
+CREATE TABLE "commit" (
+    {{if $sqlite}}
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    {{else}}
+    id BIGINT NOT NULL,
+    {{end}}
+    ext_id bytea NOT NULL,
+    {{ if $sqlite }}
+    site_id INTEGER NOT NULL REFERENCES site(id),
+    parent_id INTEGER REFERENCES "commit"(id),
+    head_id INTEGER NOT NULL REFERENCES node(id),
+    {{else}}
+    site_id bigint NOT NULL REFERENCES site(id),
+    parent_id bigint REFERENCES "commit"(id),
+    head_id bigint NOT NULL REFERENCES node(id),
+    {{end}}
+    hash bytea NOT NULL,
+    author_source character varying DEFAULT '' NOT NULL,
+    author_source_id bytea,
+    author_email character varying DEFAULT '' NOT NULL,
+    author_name character varying DEFAULT '' NOT NULL,
+    message character varying DEFAULT '' NOT NULL,
+    created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone,
+    data jsonb
+);
+
+{{ if not $sqlite}}
+
+CREATE SEQUENCE commit_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+ALTER SEQUENCE commit_seq OWNED BY "commit".id;
+ALTER TABLE ONLY "commit" ALTER COLUMN id SET DEFAULT nextval('commit_seq'::regclass);
+
+ALTER TABLE ONLY "commit"
+    ADD CONSTRAINT commit_pkey PRIMARY KEY (id);
+
+{{ end }}
+
+CREATE UNIQUE INDEX ix_commit_ext_id ON "commit" (ext_id);
+CREATE INDEX ix_commit_site_id ON "commit" (site_id);
+CREATE INDEX ix_commit_parent_id ON "commit" (parent_id);
+CREATE INDEX ix_commit_head_id ON "commit" (head_id);
+CREATE INDEX ix_commit_created_at ON "commit" (created_at);
+CREATE INDEX ix_commit_deleted_at ON "commit" (deleted_at);
+
+/* Sites point to their latest commit */
+
+{{ if $sqlite }}
+ALTER TABLE site ADD COLUMN commit_id INTEGER REFERENCES "commit"(id);
+{{else}}
+ALTER TABLE site ADD COLUMN commit_id bigint REFERENCES "commit"(id);
+{{end}}
+
+CREATE INDEX ix_site_commit_id ON site (commit_id);
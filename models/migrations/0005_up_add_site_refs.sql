@@ -0,0 +1,83 @@
+UPDATE demake_version SET version_num = 5;
+
+{{$sqlite:=false}}
+
+{{if eq .DBType "sqlite3"}}
+    {{$sqlite = true}}
+{{end}}
+
+/* Named refs (e.g. draft and published) of a site */
+
+CREATE TABLE site_ref (
+    {{if $sqlite}}
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    {{else}}
+    id BIGINT NOT NULL,
+    {{end}}
+    ext_id bytea NOT NULL,
+    {{ if $sqlite }}
+    site_id INTEGER NOT NULL REFERENCES site(id),
+    head_id INTEGER NOT NULL REFERENCES node(id),
+    commit_id INTEGER REFERENCES "commit"(id),
+    {{else}}
+    site_id bigint NOT NULL REFERENCES site(id),
+    head_id bigint NOT NULL REFERENCES node(id),
+    commit_id bigint REFERENCES "commit"(id),
+    {{end}}
+    name character varying NOT NULL,
+    created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone,
+    data jsonb
+);
+
+{{ if not $sqlite}}
+
+CREATE SEQUENCE site_ref_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+ALTER SEQUENCE site_ref_seq OWNED BY site_ref.id;
+ALTER TABLE ONLY site_ref ALTER COLUMN id SET DEFAULT nextval('site_ref_seq'::regclass);
+
+ALTER TABLE ONLY site_ref
+    ADD CONSTRAINT site_ref_pkey PRIMARY KEY (id);
+
+{{ end }}
+
+CREATE UNIQUE INDEX ix_site_ref_ext_id ON site_ref (ext_id);
+CREATE UNIQUE INDEX ix_site_ref_site_id_name ON site_ref (site_id, name);
+CREATE INDEX ix_site_ref_head_id ON site_ref (head_id);
+CREATE INDEX ix_site_ref_created_at ON site_ref (created_at);
+CREATE INDEX ix_site_ref_deleted_at ON site_ref (deleted_at);
+
+/* Existing sites get a draft and a published ref pointing to their head */
+
+INSERT INTO site_ref
+    (ext_id, site_id, head_id, commit_id, name)
+SELECT
+    {{if $sqlite}}randomblob(16){{else}}decode(md5(random()::text || id::text || 'draft'), 'hex'){{end}},
+    id,
+    head_id,
+    commit_id,
+    'draft'
+FROM
+    site
+WHERE
+    head_id IS NOT NULL;
+
+INSERT INTO site_ref
+    (ext_id, site_id, head_id, commit_id, name)
+SELECT
+    {{if $sqlite}}randomblob(16){{else}}decode(md5(random()::text || id::text || 'published'), 'hex'){{end}},
+    id,
+    head_id,
+    commit_id,
+    'published'
+FROM
+    site
+WHERE
+    head_id IS NOT NULL;
@@ -0,0 +1,4 @@
+UPDATE demake_version SET version_num = 5;
+
+DROP TABLE experiment_variant;
+DROP TABLE experiment;
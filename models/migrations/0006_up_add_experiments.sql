@@ -0,0 +1,97 @@
+UPDATE demake_version SET version_num = 6;
+
+{{$sqlite:=false}}
+
+{{if eq .DBType "sqlite3"}}
+    {{$sqlite = true}}
+{{end}}
+
+/* A/B tests that serve different versions of a site to visitors */
+
+CREATE TABLE experiment (
+    {{if $sqlite}}
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    {{else}}
+    id BIGINT NOT NULL,
+    {{end}}
+    ext_id bytea NOT NULL,
+    {{ if $sqlite }}
+    site_id INTEGER NOT NULL REFERENCES site(id),
+    {{else}}
+    site_id bigint NOT NULL REFERENCES site(id),
+    {{end}}
+    name character varying NOT NULL,
+    active boolean NOT NULL DEFAULT false,
+    created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone,
+    data jsonb
+);
+
+{{ if not $sqlite}}
+
+CREATE SEQUENCE experiment_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+ALTER SEQUENCE experiment_seq OWNED BY experiment.id;
+ALTER TABLE ONLY experiment ALTER COLUMN id SET DEFAULT nextval('experiment_seq'::regclass);
+
+ALTER TABLE ONLY experiment
+    ADD CONSTRAINT experiment_pkey PRIMARY KEY (id);
+
+{{ end }}
+
+CREATE UNIQUE INDEX ix_experiment_ext_id ON experiment (ext_id);
+CREATE INDEX ix_experiment_site_id ON experiment (site_id);
+CREATE INDEX ix_experiment_created_at ON experiment (created_at);
+CREATE INDEX ix_experiment_deleted_at ON experiment (deleted_at);
+
+/* The variants of an experiment, each pointing to a version of the site */
+
+CREATE TABLE experiment_variant (
+    {{if $sqlite}}
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    {{else}}
+    id BIGINT NOT NULL,
+    {{end}}
+    ext_id bytea NOT NULL,
+    {{ if $sqlite }}
+    experiment_id INTEGER NOT NULL REFERENCES experiment(id),
+    {{else}}
+    experiment_id bigint NOT NULL REFERENCES experiment(id),
+    {{end}}
+    name character varying NOT NULL,
+    version character varying NOT NULL,
+    weight integer NOT NULL,
+    exposures bigint NOT NULL DEFAULT 0,
+    created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone,
+    data jsonb
+);
+
+{{ if not $sqlite}}
+
+CREATE SEQUENCE experiment_variant_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+ALTER SEQUENCE experiment_variant_seq OWNED BY experiment_variant.id;
+ALTER TABLE ONLY experiment_variant ALTER COLUMN id SET DEFAULT nextval('experiment_variant_seq'::regclass);
+
+ALTER TABLE ONLY experiment_variant
+    ADD CONSTRAINT experiment_variant_pkey PRIMARY KEY (id);
+
+{{ end }}
+
+CREATE UNIQUE INDEX ix_experiment_variant_ext_id ON experiment_variant (ext_id);
+CREATE UNIQUE INDEX ix_experiment_variant_experiment_id_name ON experiment_variant (experiment_id, name);
+CREATE INDEX ix_experiment_variant_created_at ON experiment_variant (created_at);
+CREATE INDEX ix_experiment_variant_deleted_at ON experiment_variant (deleted_at);
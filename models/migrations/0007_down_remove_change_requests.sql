@@ -0,0 +1,4 @@
+UPDATE demake_version SET version_num = 6;
+
+DROP TABLE change_request_review;
+DROP TABLE change_request;
@@ -0,0 +1,112 @@
+UPDATE demake_version SET version_num = 7;
+
+{{$sqlite:=false}}
+
+{{if eq .DBType "sqlite3"}}
+    {{$sqlite = true}}
+{{end}}
+
+/* Proposed changes to the published version of a site */
+
+CREATE TABLE change_request (
+    {{if $sqlite}}
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    {{else}}
+    id BIGINT NOT NULL,
+    {{end}}
+    ext_id bytea NOT NULL,
+    {{ if $sqlite }}
+    site_id INTEGER NOT NULL REFERENCES site(id),
+    head_id INTEGER NOT NULL REFERENCES node(id),
+    base_id INTEGER NOT NULL REFERENCES node(id),
+    commit_id INTEGER REFERENCES "commit"(id),
+    {{else}}
+    site_id bigint NOT NULL REFERENCES site(id),
+    head_id bigint NOT NULL REFERENCES node(id),
+    base_id bigint NOT NULL REFERENCES node(id),
+    commit_id bigint REFERENCES "commit"(id),
+    {{end}}
+    hash bytea NOT NULL,
+    ref_name character varying NOT NULL,
+    description character varying DEFAULT '' NOT NULL,
+    status character varying NOT NULL,
+    author_source character varying DEFAULT '' NOT NULL,
+    author_source_id bytea,
+    author_email character varying DEFAULT '' NOT NULL,
+    author_name character varying DEFAULT '' NOT NULL,
+    created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone,
+    data jsonb
+);
+
+{{ if not $sqlite}}
+
+CREATE SEQUENCE change_request_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+ALTER SEQUENCE change_request_seq OWNED BY change_request.id;
+ALTER TABLE ONLY change_request ALTER COLUMN id SET DEFAULT nextval('change_request_seq'::regclass);
+
+ALTER TABLE ONLY change_request
+    ADD CONSTRAINT change_request_pkey PRIMARY KEY (id);
+
+{{ end }}
+
+CREATE UNIQUE INDEX ix_change_request_ext_id ON change_request (ext_id);
+CREATE INDEX ix_change_request_site_id ON change_request (site_id);
+CREATE INDEX ix_change_request_status ON change_request (status);
+CREATE INDEX ix_change_request_created_at ON change_request (created_at);
+CREATE INDEX ix_change_request_deleted_at ON change_request (deleted_at);
+
+/* Approvals, rejections and comments of change requests */
+
+CREATE TABLE change_request_review (
+    {{if $sqlite}}
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    {{else}}
+    id BIGINT NOT NULL,
+    {{end}}
+    ext_id bytea NOT NULL,
+    {{ if $sqlite }}
+    change_request_id INTEGER NOT NULL REFERENCES change_request(id),
+    {{else}}
+    change_request_id bigint NOT NULL REFERENCES change_request(id),
+    {{end}}
+    action character varying NOT NULL,
+    message character varying DEFAULT '' NOT NULL,
+    author_source character varying DEFAULT '' NOT NULL,
+    author_source_id bytea,
+    author_email character varying DEFAULT '' NOT NULL,
+    author_name character varying DEFAULT '' NOT NULL,
+    created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone,
+    data jsonb
+);
+
+{{ if not $sqlite}}
+
+CREATE SEQUENCE change_request_review_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+ALTER SEQUENCE change_request_review_seq OWNED BY change_request_review.id;
+ALTER TABLE ONLY change_request_review ALTER COLUMN id SET DEFAULT nextval('change_request_review_seq'::regclass);
+
+ALTER TABLE ONLY change_request_review
+    ADD CONSTRAINT change_request_review_pkey PRIMARY KEY (id);
+
+{{ end }}
+
+CREATE UNIQUE INDEX ix_change_request_review_ext_id ON change_request_review (ext_id);
+CREATE INDEX ix_change_request_review_change_request_id ON change_request_review (change_request_id);
+CREATE INDEX ix_change_request_review_created_at ON change_request_review (created_at);
+CREATE INDEX ix_change_request_review_deleted_at ON change_request_review (deleted_at);
@@ -0,0 +1,13 @@
+UPDATE demake_version SET version_num = 7;
+
+{{$sqlite:=false}}
+
+{{if eq .DBType "sqlite3"}}
+    {{$sqlite = true}}
+{{end}}
+
+DROP TABLE audit_entry;
+
+{{if not $sqlite}}
+DROP FUNCTION audit_entry_append_only();
+{{end}}
@@ -0,0 +1,80 @@
+UPDATE demake_version SET version_num = 8;
+
+{{$sqlite:=false}}
+
+{{if eq .DBType "sqlite3"}}
+    {{$sqlite = true}}
+{{end}}
+
+/* Append-only log of administrative actions */
+
+CREATE TABLE audit_entry (
+    {{if $sqlite}}
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    {{else}}
+    id BIGINT NOT NULL,
+    {{end}}
+    ext_id bytea NOT NULL,
+    actor_source character varying DEFAULT '' NOT NULL,
+    actor_source_id bytea,
+    actor_email character varying DEFAULT '' NOT NULL,
+    action character varying NOT NULL,
+    target_id character varying DEFAULT '' NOT NULL,
+    before text DEFAULT '' NOT NULL,
+    after text DEFAULT '' NOT NULL,
+    ip character varying DEFAULT '' NOT NULL,
+    created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone,
+    data jsonb
+);
+
+{{ if not $sqlite}}
+
+CREATE SEQUENCE audit_entry_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+ALTER SEQUENCE audit_entry_seq OWNED BY audit_entry.id;
+ALTER TABLE ONLY audit_entry ALTER COLUMN id SET DEFAULT nextval('audit_entry_seq'::regclass);
+
+ALTER TABLE ONLY audit_entry
+    ADD CONSTRAINT audit_entry_pkey PRIMARY KEY (id);
+
+{{ end }}
+
+CREATE UNIQUE INDEX ix_audit_entry_ext_id ON audit_entry (ext_id);
+CREATE INDEX ix_audit_entry_actor_email ON audit_entry (actor_email);
+CREATE INDEX ix_audit_entry_action ON audit_entry (action);
+CREATE INDEX ix_audit_entry_target_id ON audit_entry (target_id);
+CREATE INDEX ix_audit_entry_created_at ON audit_entry (created_at);
+
+/* Entries can't be changed or deleted */
+
+{{if $sqlite}}
+
+CREATE TRIGGER audit_entry_no_update BEFORE UPDATE ON audit_entry
+BEGIN
+    SELECT RAISE(ABORT, 'the audit log is append-only');
+END;
+
+CREATE TRIGGER audit_entry_no_delete BEFORE DELETE ON audit_entry
+BEGIN
+    SELECT RAISE(ABORT, 'the audit log is append-only');
+END;
+
+{{else}}
+
+CREATE FUNCTION audit_entry_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'the audit log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_entry_no_update BEFORE UPDATE OR DELETE ON audit_entry
+    FOR EACH ROW EXECUTE FUNCTION audit_entry_append_only();
+
+{{end}}
@@ -0,0 +1,3 @@
+UPDATE demake_version SET version_num = 8;
+
+DROP TABLE schedule;
@@ -0,0 +1,65 @@
+UPDATE demake_version SET version_num = 9;
+
+{{$sqlite:=false}}
+
+{{if eq .DBType "sqlite3"}}
+    {{$sqlite = true}}
+{{end}}
+
+/* Actions that run at a given time, e.g. publishing a version or expiring a route */
+
+CREATE TABLE schedule (
+    {{if $sqlite}}
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    {{else}}
+    id BIGINT NOT NULL,
+    {{end}}
+    ext_id bytea NOT NULL,
+    {{ if $sqlite }}
+    site_id INTEGER NOT NULL REFERENCES site(id),
+    head_id INTEGER REFERENCES node(id),
+    change_request_id INTEGER REFERENCES change_request(id),
+    commit_id INTEGER REFERENCES "commit"(id),
+    {{else}}
+    site_id bigint NOT NULL REFERENCES site(id),
+    head_id bigint REFERENCES node(id),
+    change_request_id bigint REFERENCES change_request(id),
+    commit_id bigint REFERENCES "commit"(id),
+    {{end}}
+    action character varying NOT NULL,
+    route character varying DEFAULT '' NOT NULL,
+    run_at timestamp without time zone NOT NULL,
+    status character varying NOT NULL,
+    error character varying DEFAULT '' NOT NULL,
+    author_source character varying DEFAULT '' NOT NULL,
+    author_source_id bytea,
+    author_email character varying DEFAULT '' NOT NULL,
+    author_name character varying DEFAULT '' NOT NULL,
+    created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp without time zone,
+    deleted_at timestamp without time zone,
+    data jsonb
+);
+
+{{ if not $sqlite}}
+
+CREATE SEQUENCE schedule_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+ALTER SEQUENCE schedule_seq OWNED BY schedule.id;
+ALTER TABLE ONLY schedule ALTER COLUMN id SET DEFAULT nextval('schedule_seq'::regclass);
+
+ALTER TABLE ONLY schedule
+    ADD CONSTRAINT schedule_pkey PRIMARY KEY (id);
+
+{{ end }}
+
+CREATE UNIQUE INDEX ix_schedule_ext_id ON schedule (ext_id);
+CREATE INDEX ix_schedule_site_id ON schedule (site_id);
+CREATE INDEX ix_schedule_status_run_at ON schedule (status, run_at);
+CREATE INDEX ix_schedule_created_at ON schedule (created_at);
+CREATE INDEX ix_schedule_deleted_at ON schedule (deleted_at);
@@ -0,0 +1,3 @@
+UPDATE demake_version SET version_num = 9;
+
+DROP INDEX ix_edge_to_id;
@@ -0,0 +1,5 @@
+UPDATE demake_version SET version_num = 10;
+
+/* Index for looking up where a node is used (the edges pointing to it) */
+
+CREATE INDEX ix_edge_to_id ON edge (to_id);
@@ -0,0 +1,6 @@
+UPDATE demake_version SET version_num = 10;
+
+DROP INDEX ix_site_ref_hash;
+DROP INDEX ix_site_hash;
+ALTER TABLE site_ref DROP COLUMN hash;
+ALTER TABLE site DROP COLUMN hash;
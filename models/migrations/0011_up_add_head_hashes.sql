@@ -0,0 +1,12 @@
+UPDATE demake_version SET version_num = 11;
+
+/* Sites and refs store the hash of their head, which is the same in all databases */
+
+ALTER TABLE site ADD COLUMN hash bytea;
+ALTER TABLE site_ref ADD COLUMN hash bytea;
+
+UPDATE site SET hash = (SELECT node.hash FROM node WHERE node.id = site.head_id);
+UPDATE site_ref SET hash = (SELECT node.hash FROM node WHERE node.id = site_ref.head_id);
+
+CREATE INDEX ix_site_hash ON site (hash);
+CREATE INDEX ix_site_ref_hash ON site_ref (hash);
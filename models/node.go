@@ -15,6 +15,9 @@ type Node struct {
 	Hash     []byte `json:"hash" db:"pk"`
 	Outgoing Edges  `json:"outgoing" db:"ignore"`
 	Incoming Edges  `json:"-" db:"ignore"`
+	// stubs only describe a node that has been stored before (e.g. the
+	// target of a reference), they are never saved themselves
+	Stub bool `json:"-" db:"ignore"`
 }
 
 func (n *Node) SetData(data any) error {
@@ -65,6 +68,18 @@ RETURNING
 
 func (n *Node) SaveTree(db orm.Transaction) error {
 
+	if n.Stub {
+		if n.ID != 0 {
+			return nil
+		}
+		id, err := nodeIDByHash(db, n.Hash)
+		if err != nil {
+			return fmt.Errorf("cannot find referenced node: %v", err)
+		}
+		n.ID = id
+		return nil
+	}
+
 	n.UpdatedAt = &orm.Time{time.Now()}
 
 	if rows, err := db.Query(insertNodeQuery, n.Hash, n.Type, n.Data, n.UpdatedAt.Get()); err != nil {
@@ -95,3 +110,50 @@ func (n *Node) SaveTree(db orm.Transaction) error {
 	return nil
 
 }
+
+// returns the ID of the (non-deleted) node with the given hash
+func nodeIDByHash(db orm.Transaction, hash []byte) (int64, error) {
+
+	rows, err := db.Query(`SELECT id FROM node WHERE hash = $1 AND deleted_at IS NULL`, hash)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	if !rows.Next() {
+		return 0, ErrNodeNotFound
+	}
+
+	var id int64
+
+	if err := rows.Scan(&id); err != nil {
+		return 0, fmt.Errorf("scan error: %v", err)
+	}
+
+	return id, nil
+}
+
+func nodeHashByID(db orm.Transaction, id int64) ([]byte, error) {
+
+	rows, err := db.Query(`SELECT hash FROM node WHERE id = $1`, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, ErrNodeNotFound
+	}
+
+	var hash []byte
+
+	if err := rows.Scan(&hash); err != nil {
+		return nil, fmt.Errorf("scan error: %v", err)
+	}
+
+	return hash, nil
+}
@@ -0,0 +1,149 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gospel-sh/gospel/orm"
+	"strconv"
+	"time"
+)
+
+// returns the head of the most recent commit of a site with the given hash
+var commitHeadByHashQuery = `
+SELECT
+	head_id
+FROM
+	"commit"
+WHERE
+	site_id = $1 AND hash = $2
+ORDER BY
+	id DESC
+LIMIT 1
+`
+
+// ResolveVersion returns the ID of the head node for a version of the site,
+// which can be given as a ref name, a hex-encoded commit ID or a hex or
+// base32-encoded node hash. Only versions that were committed to the site can
+// be resolved, so a hash can't be used to view arbitrary nodes.
+func (s *Site) ResolveVersion(db func() orm.DB, version string) (int64, error) {
+
+	if refNameRegexp.MatchString(version) {
+		if ref, err := s.Ref(db, version); err == nil {
+			return ref.HeadID, nil
+		} else if err != orm.NotFound {
+			return 0, err
+		}
+	}
+
+	if value, err := hex.DecodeString(version); err == nil && len(value) == 16 {
+		// this is the external ID of a commit
+		commit := orm.Init(&Commit{}, db)
+
+		if err := commit.ByExtID(value); err == nil && commit.SiteID == s.ID {
+			return commit.HeadID, nil
+		} else if err != nil && err != orm.NotFound {
+			return 0, err
+		}
+	}
+
+	hash, err := ParseHash(version)
+
+	if err != nil {
+		return 0, fmt.Errorf("unknown version '%s'", version)
+	}
+
+	return s.ResolveHash(db, hash)
+}
+
+// ResolveHash returns the ID of the head node with the given hash, which has
+// to be committed to the site
+func (s *Site) ResolveHash(db func() orm.DB, hash []byte) (int64, error) {
+
+	rows, err := db().Query(commitHeadByHashQuery, s.ID, hash)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	if !rows.Next() {
+		return 0, fmt.Errorf("unknown version '%s'", Base32Hash(hash))
+	}
+
+	var id int64
+
+	if err := rows.Scan(&id); err != nil {
+		return 0, fmt.Errorf("scan error: %v", err)
+	}
+
+	return id, nil
+}
+
+// VersionHash resolves a version of the site (see ResolveVersion) and returns
+// the base32-encoded hash of its head, which always refers to the same
+// content, unlike a ref name
+func (s *Site) VersionHash(db func() orm.DB, version string) (string, error) {
+
+	headID, err := s.ResolveVersion(db, version)
+
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := nodeHashByID(db(), headID)
+
+	if err != nil {
+		return "", err
+	}
+
+	return Base32Hash(hash), nil
+}
+
+// the message that is signed for a preview link
+func previewMessage(siteID, version string, expires int64) []byte {
+	return []byte(fmt.Sprintf("preview:%s:%s:%d", siteID, version, expires))
+}
+
+// SignPreview returns the signature for an unauthenticated preview link of
+// the given site version, which is valid until the given time. The version
+// has to be a hash (see VersionHash), so that the link keeps showing the
+// version that was shared even if a ref is updated later.
+func SignPreview(secret []byte, siteID, version string, expires time.Time) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(previewMessage(siteID, version, expires.Unix()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyPreview checks the signature and expiration time (a unix timestamp)
+// of a preview link
+func VerifyPreview(secret []byte, siteID, version, expires, signature string) error {
+
+	if len(secret) == 0 {
+		return fmt.Errorf("preview links are disabled")
+	}
+
+	if _, err := ParseHash(version); err != nil {
+		return fmt.Errorf("preview links need to refer to a version by its hash")
+	}
+
+	timestamp, err := strconv.ParseInt(expires, 10, 64)
+
+	if err != nil {
+		return fmt.Errorf("invalid expiration time")
+	}
+
+	expected := SignPreview(secret, siteID, version, time.Unix(timestamp, 0))
+
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	if time.Now().Unix() > timestamp {
+		return fmt.Errorf("the preview link has expired")
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package models_test
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+	"time"
+)
+
+func TestResolveVersion(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := make([]*models.Node, 0)
+
+	for _, tagType := range []string{"p", "h1", "h2"} {
+
+		node, err := models.Serialize(&Tag{Type: tagType, Meta: Meta{Language: "de"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := node.SaveTree(db); err != nil {
+			t.Fatal(err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	first, err := site.CommitHead(dbf, nodes[0], nil, "initial version")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CommitRef(dbf, models.DraftRef, nodes[1], nil, "draft"); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := map[string]int64{
+		models.PublishedRef:               nodes[0].ID,
+		models.DraftRef:                   nodes[1].ID,
+		first.ExtID.Hex():                 nodes[0].ID,
+		hex.EncodeToString(nodes[1].Hash): nodes[1].ID,
+		models.Base32Hash(nodes[0].Hash):  nodes[0].ID,
+	}
+
+	for version, expected := range versions {
+		if id, err := site.ResolveVersion(dbf, version); err != nil {
+			t.Fatalf("cannot resolve '%s': %v", version, err)
+		} else if id != expected {
+			t.Fatalf("expected '%s' to resolve to %d, got %d", version, expected, id)
+		}
+	}
+
+	draft, err := site.Ref(dbf, models.DraftRef)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash, err := draft.HeadHash(dbf); err != nil {
+		t.Fatal(err)
+	} else if string(hash) != string(nodes[1].Hash) {
+		t.Fatalf("unexpected head hash")
+	}
+
+	// share links pin the current version of a ref by its hash
+	if hash, err := site.VersionHash(dbf, models.DraftRef); err != nil {
+		t.Fatal(err)
+	} else if hash != models.Base32Hash(nodes[1].Hash) {
+		t.Fatalf("expected the draft to resolve to its hash")
+	}
+
+	// the node was saved but never committed to the site
+	if _, err := site.ResolveVersion(dbf, hex.EncodeToString(nodes[2].Hash)); err == nil {
+		t.Fatalf("expected an error for an uncommitted node")
+	}
+
+	if graph, err := models.GetGraphByHash(dbf, nodes[2].Hash); err != nil {
+		t.Fatal(err)
+	} else if graph.ID != nodes[2].ID {
+		t.Fatalf("expected to load the node by its hash")
+	}
+}
+
+func TestPreviewSignature(t *testing.T) {
+
+	secret := []byte("secret")
+	expires := time.Now().Add(time.Hour)
+	version := models.Base32Hash(models.MakeHash().Sum())
+	signature := models.SignPreview(secret, "site", version, expires)
+	timestamp := fmt.Sprintf("%d", expires.Unix())
+
+	if err := models.VerifyPreview(secret, "site", version, timestamp, signature); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := models.VerifyPreview(secret, "site", models.HexHash(models.MakeHash().Sum()), timestamp, signature); err == nil {
+		t.Fatalf("expected an error for a different version")
+	}
+
+	if err := models.VerifyPreview([]byte("other"), "site", version, timestamp, signature); err == nil {
+		t.Fatalf("expected an error for a different secret")
+	}
+
+	// links to refs would show later changes
+	signature = models.SignPreview(secret, "site", "draft", expires)
+
+	if err := models.VerifyPreview(secret, "site", "draft", timestamp, signature); err == nil {
+		t.Fatalf("expected an error for a ref name")
+	}
+
+	expired := time.Now().Add(-time.Hour)
+	signature = models.SignPreview(secret, "site", version, expired)
+
+	if err := models.VerifyPreview(secret, "site", version, fmt.Sprintf("%d", expired.Unix()), signature); err == nil {
+		t.Fatalf("expected an error for an expired link")
+	}
+}
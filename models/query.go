@@ -0,0 +1,469 @@
+package models
+
+import (
+	"fmt"
+	"github.com/gospel-sh/gospel/orm"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Path queries select nodes by the names of the edges leading to them, e.g.
+//
+//	plugins[*]/posts[type=blogPost]/title
+//
+// Steps are separated by '/' and consist of an edge name ('*' matches any
+// name) followed by any number of selectors, which must all match:
+//
+//	[*]          any edge (the same as no selector)
+//	[2]          the edge with index 2 (slices)
+//	[index=2]    the same
+//	[key=en]     the edge with key 'en' (maps)
+//	[type=post]  edges whose target node has the type 'post'
+//
+// Values can be quoted (e.g. [key="a/b"]) if they contain special
+// characters. Queries can be evaluated against a node tree in memory or
+// compiled to SQL.
+
+// A PathStep selects the edges of a node
+type PathStep struct {
+	// the name of the edge, empty for any name
+	Name  string
+	Index *int
+	Key   *string
+	// the type of the target node
+	Type string
+}
+
+// A PathQuery is a parsed path query
+type PathQuery struct {
+	Steps []*PathStep
+}
+
+// A PathMatch is a node selected by a path query
+type PathMatch struct {
+	// the path of the node, which is itself a query for the node, e.g.
+	// 'plugins[0]/posts[3]/title'
+	Path string
+	Node *Node
+}
+
+func isPathNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// reads a bare or quoted selector value
+func parsePathValue(expr string, pos int) (string, int, error) {
+
+	if pos < len(expr) && expr[pos] == '"' {
+
+		// we look for the closing quote, skipping escaped characters
+		end := pos + 1
+
+		for end < len(expr) && expr[end] != '"' {
+			if expr[end] == '\\' {
+				end++
+			}
+			end++
+		}
+
+		if end >= len(expr) {
+			return "", 0, fmt.Errorf("unterminated string at position %d", pos)
+		}
+
+		value, err := strconv.Unquote(expr[pos : end+1])
+
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid string at position %d: %v", pos, err)
+		}
+
+		return value, end + 1, nil
+	}
+
+	end := pos
+
+	for end < len(expr) && expr[end] != ']' {
+		end++
+	}
+
+	return expr[pos:end], end, nil
+}
+
+// parses a selector starting after the opening bracket
+func (s *PathStep) parseSelector(expr string, pos int) (int, error) {
+
+	if strings.HasPrefix(expr[pos:], "*]") {
+		return pos + 1, nil
+	}
+
+	start := pos
+
+	for pos < len(expr) && isPathNameChar(expr[pos]) {
+		pos++
+	}
+
+	name := expr[start:pos]
+
+	if pos < len(expr) && expr[pos] == ']' {
+		// a plain index, e.g. [2]
+		index, err := strconv.Atoi(name)
+		if err != nil || index < 0 {
+			return 0, fmt.Errorf("invalid index '%s' at position %d", name, start)
+		}
+		s.Index = &index
+		return pos, nil
+	}
+
+	if pos >= len(expr) || expr[pos] != '=' {
+		return 0, fmt.Errorf("expected '=' at position %d", pos)
+	}
+
+	value, pos, err := parsePathValue(expr, pos+1)
+
+	if err != nil {
+		return 0, err
+	}
+
+	switch name {
+	case "index":
+		index, err := strconv.Atoi(value)
+		if err != nil || index < 0 {
+			return 0, fmt.Errorf("invalid index '%s' at position %d", value, start)
+		}
+		s.Index = &index
+	case "key":
+		s.Key = &value
+	case "type":
+		s.Type = value
+	default:
+		return 0, fmt.Errorf("unknown selector '%s' at position %d", name, start)
+	}
+
+	return pos, nil
+}
+
+// ParsePathQuery parses a path query like 'plugins[*]/posts[type=blogPost]'
+func ParsePathQuery(expr string) (*PathQuery, error) {
+
+	query := &PathQuery{}
+	pos := 0
+
+	for {
+
+		step := &PathStep{}
+		start := pos
+
+		if pos < len(expr) && expr[pos] == '*' {
+			pos++
+		} else {
+			for pos < len(expr) && isPathNameChar(expr[pos]) {
+				pos++
+			}
+			if pos == start {
+				return nil, fmt.Errorf("expected an edge name at position %d", pos)
+			}
+			step.Name = expr[start:pos]
+		}
+
+		for pos < len(expr) && expr[pos] == '[' {
+
+			var err error
+
+			if pos, err = step.parseSelector(expr, pos+1); err != nil {
+				return nil, err
+			}
+
+			if pos >= len(expr) || expr[pos] != ']' {
+				return nil, fmt.Errorf("expected ']' at position %d", pos)
+			}
+
+			pos++
+		}
+
+		query.Steps = append(query.Steps, step)
+
+		if pos == len(expr) {
+			return query, nil
+		}
+
+		if expr[pos] != '/' {
+			return nil, fmt.Errorf("unexpected '%c' at position %d", expr[pos], pos)
+		}
+
+		pos++
+	}
+}
+
+// checks if the edge matches the step, apart from the type of its target
+func (s *PathStep) matchesEdge(edge *Edge) bool {
+
+	if s.Name != "" && edge.Name != s.Name {
+		return false
+	}
+
+	if s.Index != nil && (edge.Type != int(Slice) || edge.Index != *s.Index) {
+		return false
+	}
+
+	if s.Key != nil && (edge.Type != int(Map) || edge.Key != *s.Key) {
+		return false
+	}
+
+	return true
+}
+
+// returns the path of the edge in the query syntax
+func edgePath(name string, edgeType int, index int, key string) string {
+
+	switch Relation(edgeType) {
+	case Slice:
+		return fmt.Sprintf("%s[%d]", name, index)
+	case Map:
+		for i := 0; i < len(key); i++ {
+			if !isPathNameChar(key[i]) {
+				return fmt.Sprintf("%s[key=%s]", name, strconv.Quote(key))
+			}
+		}
+		if key == "" {
+			return fmt.Sprintf("%s[key=\"\"]", name)
+		}
+		return fmt.Sprintf("%s[key=%s]", name, key)
+	}
+
+	return name
+}
+
+// sorts edges in the order in which matches are returned, which is the same
+// for Match and Query
+func sortPathEdges(edges Edges) {
+	sort.SliceStable(edges, func(i, j int) bool {
+		if edges[i].Name != edges[j].Name {
+			return edges[i].Name < edges[j].Name
+		}
+		if edges[i].Index != edges[j].Index {
+			return edges[i].Index < edges[j].Index
+		}
+		return edges[i].Key < edges[j].Key
+	})
+}
+
+// Match evaluates the query against the given node and its descendants. An
+// error is returned if the query needs the edges of a stub.
+func (q *PathQuery) Match(node *Node) ([]*PathMatch, error) {
+
+	matches := []*PathMatch{{Node: node}}
+
+	for _, step := range q.Steps {
+
+		stepMatches := make([]*PathMatch, 0)
+
+		for _, match := range matches {
+
+			if match.Node.Stub {
+				return nil, fmt.Errorf("node %s is a stub and needs to be loaded first", match.Path)
+			}
+
+			edges := make(Edges, 0, len(match.Node.Outgoing))
+
+			for _, edge := range match.Node.Outgoing {
+				if step.matchesEdge(edge) && (step.Type == "" || edge.To.Type == step.Type) {
+					edges = append(edges, edge)
+				}
+			}
+
+			sortPathEdges(edges)
+
+			for _, edge := range edges {
+
+				path := edgePath(edge.Name, edge.Type, edge.Index, edge.Key)
+
+				if match.Path != "" {
+					path = match.Path + "/" + path
+				}
+
+				stepMatches = append(stepMatches, &PathMatch{Path: path, Node: edge.To})
+			}
+		}
+
+		matches = stepMatches
+	}
+
+	return matches, nil
+}
+
+// Select returns the nodes that match the given path query
+func (n *Node) Select(expr string) ([]*Node, error) {
+
+	query, err := ParsePathQuery(expr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := query.Match(n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*Node, len(matches))
+
+	for i, match := range matches {
+		nodes[i] = match.Node
+	}
+
+	return nodes, nil
+}
+
+// SQL compiles the query to SQL, which returns the matching nodes together
+// with the edges leading to them. The first argument is the ID of the root
+// node. Unlike Match, the query also follows references.
+func (q *PathQuery) SQL() (string, []any) {
+
+	args := []any{nil}
+	param := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	last := len(q.Steps)
+	columns := []string{
+		fmt.Sprintf("n%d.id", last),
+		fmt.Sprintf("n%d.hash", last),
+		fmt.Sprintf("n%d.type", last),
+		fmt.Sprintf("n%d.data", last),
+	}
+	joins := make([]string, 0, len(q.Steps)*2)
+	order := make([]string, 0, len(q.Steps)*3)
+
+	for i, step := range q.Steps {
+
+		e := fmt.Sprintf("e%d", i+1)
+		n := fmt.Sprintf("n%d", i+1)
+
+		// the parameters have to appear in ascending order
+		conditions := []string{}
+
+		if i == 0 {
+			conditions = append(conditions, fmt.Sprintf("%s.from_id = $1", e))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("%s.from_id = n%d.id", e, i))
+		}
+
+		conditions = append(conditions, fmt.Sprintf("%s.deleted_at IS NULL", e))
+
+		if step.Name != "" {
+			conditions = append(conditions, fmt.Sprintf("%s.name = %s", e, param(step.Name)))
+		}
+
+		if step.Index != nil {
+			conditions = append(conditions, fmt.Sprintf("%s.type = %s AND %s.ind = %s", e, param(int(Slice)), e, param(*step.Index)))
+		}
+
+		if step.Key != nil {
+			conditions = append(conditions, fmt.Sprintf("%s.type = %s AND %s.key = %s", e, param(int(Map)), e, param(*step.Key)))
+		}
+
+		if i == 0 {
+			joins = append(joins, fmt.Sprintf("edge %s", e))
+			joins = append(joins, fmt.Sprintf("JOIN node %s ON %s.id = %s.to_id AND %s", n, n, e, strings.Join(conditions, " AND ")))
+		} else {
+			joins = append(joins, fmt.Sprintf("JOIN edge %s ON %s", e, strings.Join(conditions, " AND ")))
+			joins = append(joins, fmt.Sprintf("JOIN node %s ON %s.id = %s.to_id", n, n, e))
+		}
+
+		nodeConditions := fmt.Sprintf("%s.deleted_at IS NULL", n)
+
+		if step.Type != "" {
+			nodeConditions += fmt.Sprintf(" AND %s.type = %s", n, param(step.Type))
+		}
+
+		joins[len(joins)-1] += " AND " + nodeConditions
+
+		columns = append(columns, e+".name", e+".type", e+".ind", e+".key")
+		order = append(order, e+".name", e+".ind", e+".key")
+	}
+
+	query := fmt.Sprintf(
+		"SELECT\n\t%s\nFROM\n\t%s\nORDER BY\n\t%s",
+		strings.Join(columns, ",\n\t"),
+		strings.Join(joins, "\n"),
+		strings.Join(order, ", "),
+	)
+
+	return query, args
+}
+
+// Query runs the compiled query against the graph of the node with the given
+// ID. The matched nodes are stubs, their graphs can be loaded with LoadStub.
+func (q *PathQuery) Query(db func() orm.DB, id int64) ([]*PathMatch, error) {
+
+	if len(q.Steps) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+
+	query, args := q.SQL()
+	args[0] = id
+
+	rows, err := db().Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	matches := make([]*PathMatch, 0)
+
+	for rows.Next() {
+
+		node := &Node{Stub: true}
+		names := make([]string, len(q.Steps))
+		types := make([]int, len(q.Steps))
+		indexes := make([]*int, len(q.Steps))
+		keys := make([]*string, len(q.Steps))
+
+		dest := []any{&node.ID, &node.Hash, &node.Type, &node.Data}
+
+		for i := range q.Steps {
+			dest = append(dest, &names[i], &types[i], &indexes[i], &keys[i])
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("scan error: %v", err)
+		}
+
+		path := make([]string, len(q.Steps))
+
+		for i := range q.Steps {
+
+			var index int
+			var key string
+
+			if indexes[i] != nil {
+				index = *indexes[i]
+			}
+
+			if keys[i] != nil {
+				key = *keys[i]
+			}
+
+			path[i] = edgePath(names[i], types[i], index, key)
+		}
+
+		matches = append(matches, &PathMatch{Path: strings.Join(path, "/"), Node: node})
+	}
+
+	return matches, nil
+}
+
+// Definition returns the definition of the matched node and its descendants
+// (see SiteDefinition), the node must not be a stub
+func (m *PathMatch) Definition() (map[string]any, error) {
+
+	if m.Node.Stub {
+		return nil, fmt.Errorf("node %s is a stub and needs to be loaded first", m.Path)
+	}
+
+	return nodeDefinition(m.Node, nil)
+}
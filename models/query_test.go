@@ -0,0 +1,147 @@
+package models_test
+
+import (
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+func TestPathQuery(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	tag := makeDiffTag()
+	tag.Attributes[0].Labels["a/b"] = &Label{Name: "slash", Value: "baz"}
+
+	node, err := models.Serialize(tag)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := map[string][]string{
+		"meta":                             {"meta"},
+		"children[*]/meta":                 {"children[0]/meta", "children[1]/meta"},
+		"children[1]":                      {"children[1]"},
+		"children[index=0]/meta":           {"children[0]/meta"},
+		"children[type=tag][1]":            {"children[1]"},
+		"children[type=label]":             {},
+		"attributes[0]/labels[key=test]":   {"attributes[0]/labels[key=test]"},
+		`attributes/labels[key="a/b"]`:     {`attributes[0]/labels[key="a/b"]`},
+		"attributes/labels":                {`attributes[0]/labels[key="a/b"]`, "attributes[0]/labels[key=test]"},
+		"*[type=meta]":                     {"meta"},
+		"*/*":                              {`attributes[0]/labels[key="a/b"]`, "attributes[0]/labels[key=test]", "children[0]/meta", "children[1]/meta"},
+		"meta/children":                    {},
+		"children[key=test]":               {},
+		"attributes[0]/labels[key=test]/*": {},
+	}
+
+	graph, err := models.GetGraphByID(dbf, node.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for expr, expected := range queries {
+
+		query, err := models.ParsePathQuery(expr)
+
+		if err != nil {
+			t.Fatalf("cannot parse '%s': %v", expr, err)
+		}
+
+		memoryMatches, err := query.Match(graph)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sqlMatches, err := query.Query(dbf, node.ID)
+
+		if err != nil {
+			t.Fatalf("cannot run '%s': %v", expr, err)
+		}
+
+		for _, matches := range [][]*models.PathMatch{memoryMatches, sqlMatches} {
+
+			if len(matches) != len(expected) {
+				t.Fatalf("'%s': expected %d matches, got %d", expr, len(expected), len(matches))
+			}
+
+			for i, match := range matches {
+
+				if match.Path != expected[i] {
+					t.Fatalf("'%s': expected path '%s', got '%s'", expr, expected[i], match.Path)
+				}
+
+				if match.Node.ID == 0 || match.Node.ID != memoryMatches[i].Node.ID {
+					t.Fatalf("'%s': unexpected node", expr)
+				}
+			}
+		}
+
+		// the path of a match selects the node itself
+		for _, match := range memoryMatches {
+			if nodes, err := graph.Select(match.Path); err != nil {
+				t.Fatal(err)
+			} else if len(nodes) != 1 || nodes[0] != match.Node {
+				t.Fatalf("'%s' doesn't select the matched node", match.Path)
+			}
+		}
+	}
+
+	// the matches of compiled queries are stubs that can be loaded
+	query, err := models.ParsePathQuery("attributes[0]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attributes, err := query.Query(dbf, node.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := attributes[0].Definition(); err == nil {
+		t.Fatalf("expected an error for a stub")
+	}
+
+	if err := models.LoadStub(dbf, attributes[0].Node, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if definition, err := attributes[0].Definition(); err != nil {
+		t.Fatal(err)
+	} else if definition["name"] != "class" || len(definition["labels"].(map[string]any)) != 2 {
+		t.Fatalf("unexpected definition: %v", definition)
+	}
+
+	for _, expr := range []string{"", "/meta", "meta/", "meta[", "meta[foo=bar]", "meta[-1]", "meta[key=\"a]", "me ta"} {
+		if _, err := models.ParsePathQuery(expr); err == nil {
+			t.Fatalf("expected an error for '%s'", expr)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/gospel-sh/gospel/orm"
 	"sort"
+	"strings"
 	"text/template"
 )
 
@@ -28,6 +29,9 @@ type GraphData struct {
 	EdgeCreatedAt *orm.Time
 	EdgeUpdatedAt *orm.Time
 	EdgeFollow    bool
+	Depth         int
+	Path          string
+	Expand        bool
 }
 
 type SortedGraphData []*GraphData
@@ -44,7 +48,8 @@ func (a SortedGraphData) Less(i, j int) bool {
 	return a[i].Index < a[j].Index
 }
 
-// returns the entire graph for a given node stopping at non-follow edges
+// returns the graph for a given node, stopping at non-follow edges and
+// the limits given in the load options
 var graphQuery = `
 {{$pgx:=false}}
 
@@ -70,7 +75,10 @@ WITH RECURSIVE
 		edge_data,
 		edge_created_at,
 		edge_updated_at,
-		edge_follow)
+		edge_follow,
+		depth,
+		path,
+		expand)
 	AS (
 		SELECT
 			''{{if $pgx}}::character varying{{end}},
@@ -89,11 +97,14 @@ WITH RECURSIVE
 			NULL{{if $pgx}}::BYTEA{{end}},
 			current_timestamp,
 			current_timestamp,
+			true,
+			0,
+			''{{if $pgx}}::text{{end}},
 			true
 		FROM
 			node
 		WHERE
-			id = $1
+			id = $1 AND deleted_at IS NULL
 		UNION SELECT
 			edge.name,
 			edge.key,
@@ -111,41 +122,56 @@ WITH RECURSIVE
 			edge.data,
 			edge.created_at,
 			edge.updated_at,
-			edge.follow
+			edge.follow,
+			{{if .MaxDepth}}graph.depth + 1{{else}}0{{end}},
+			{{if .Filter}}{{.Path}}{{else}}''{{if $pgx}}::text{{end}}{{end}},
+			edge.follow{{if .MaxDepth}} AND graph.depth + 1 < {{.MaxDepth}}{{end}}{{if .Filter}} AND {{.Filter}}{{end}}
 		FROM
 			edge
 		JOIN
 			node ON node.id = edge.to_id AND node.deleted_at IS NULL
 		JOIN
-			graph ON edge.from_id = graph.to_id AND graph.edge_follow = true
+			graph ON edge.from_id = graph.to_id AND graph.expand = true
+		{{if and .Filter (not .Stubs)}}
+		WHERE
+			{{.Filter}}
+		{{end}}
 	)
 SELECT * FROM graph;
 `
 
-func reconstructNode(data []*GraphData) (*Node, []*GraphData, error) {
+// builds the node that the given row points to and its descendants. Content
+// addressing lets identical subtrees share a node, so a node can be the target
+// of several edges. Every node is only built once and receives all incoming
+// edges, so shared subtrees are shared in memory as well.
+func reconstructNode(nodeData *GraphData, dataByID map[int64][]*GraphData, expanded map[int64]bool, nodes map[int64]*Node) *Node {
+
+	node, ok := nodes[nodeData.ToID]
+
+	// stubs that were built before are filled in if their edges were loaded
+	if ok && (!node.Stub || !expanded[node.ID]) {
+		return node
+	}
 
-	// we get the first data element and remove it from the list
-	nodeData := data[0]
-	data = data[1:]
+	if !ok {
+		// we initialize a new node
+		node = &Node{}
+		nodes[nodeData.ToID] = node
+	}
 
-	// we initialize a new node
-	node := &Node{}
 	node.ID = nodeData.ToID
 	node.Hash = nodeData.Hash
 	node.Type = nodeData.Type
 	node.CreatedAt = nodeData.NodeCreatedAt
 	node.UpdatedAt = nodeData.NodeUpdatedAt
 	node.Data = nodeData.Data
+	// nodes whose edges weren't loaded via any path are stubs
+	node.Stub = !expanded[node.ID]
 
-	// this assumes edges are ordered depth-first!!!
-	for len(data) > 0 {
-
-		if data[0].FromID != node.ID {
-			// the next edge doesn't belong to the same node, we break
-			break
-		}
+	// we sort the edges of the node by index
+	sort.Sort(SortedGraphData(dataByID[node.ID]))
 
-		edgeData := data[0]
+	for _, edgeData := range dataByID[node.ID] {
 
 		// we initialize a new edge
 		edge := MakeEdge()
@@ -157,68 +183,187 @@ func reconstructNode(data []*GraphData) (*Node, []*GraphData, error) {
 		edge.CreatedAt = edgeData.EdgeCreatedAt
 		edge.UpdatedAt = edgeData.EdgeUpdatedAt
 		edge.Data = edgeData.EdgeData
-
-		var toNode *Node
-		var err error
-
-		// we generate a new node and let it consume all its children
-		if toNode, data, err = reconstructNode(data); err != nil {
-			return nil, nil, err
-		}
+		edge.Follow = edgeData.EdgeFollow
 
 		// we link the edge to the nodes
-		edge.FromTo(node, toNode)
+		edge.FromTo(node, reconstructNode(edgeData, dataByID, expanded, nodes))
 	}
 
-	// we return the node and remaining data
-	return node, data, nil
+	return node
+}
 
+type LoadOptions struct {
+	// the maximum number of edges between the root and a loaded node (0
+	// means unlimited), nodes at the maximum depth are returned as stubs
+	MaxDepth int
+	// only edges on these paths (and their ancestors and descendants) are
+	// loaded, a path consists of edge names separated by '/', e.g. 'meta/title'
+	Include []string
+	// edges on these paths (and their descendants) aren't loaded
+	Exclude []string
+	// return the target nodes of edges that were excluded by Include or
+	// Exclude as stubs instead of omitting them
+	Stubs bool
 }
 
 type QueryContext struct {
-	DBType string
+	DBType   string
+	MaxDepth int
+	Stubs    bool
+	// the SQL expression for the path of an edge
+	Path string
+	// the SQL expression that decides if an edge is loaded
+	Filter string
 }
 
-func sortNodes(id int64, dataByID map[int64][]*GraphData) []*GraphData {
-	// we sort the edges for the given node by index
-	sort.Sort(SortedGraphData(dataByID[id]))
-	sortedList := make([]*GraphData, 0, 0)
-	for _, data := range dataByID[id] {
-		sortedList = append(sortedList, data)
-		// we add all the child nodes to the list
-		sortedList = append(sortedList, sortNodes(data.ToID, dataByID)...)
+// generates the SQL filter for the include and exclude paths of the options,
+// parameters are numbered starting at 2 as $1 is the ID of the root node
+func pathFilter(options *LoadOptions, path string, pgx bool) (string, []any) {
+
+	args := []any{}
+	param := func(value string) string {
+		args = append(args, value)
+		if pgx {
+			return fmt.Sprintf("$%d::text", len(args)+1)
+		}
+		return fmt.Sprintf("$%d", len(args)+1)
+	}
+
+	// checks if the value starts with the given path, we don't use LIKE as
+	// the path might contain wildcards
+	below := func(value, path string) string {
+		return fmt.Sprintf("substr(%[1]s, 1, length(%[2]s) + 1) = %[2]s || '/'", value, path)
 	}
-	return sortedList
+
+	conditions := []string{}
+
+	if len(options.Include) > 0 {
+		includes := []string{}
+		for _, include := range options.Include {
+			p := param(include)
+			// the edge is on the path, below it or one of its ancestors
+			includes = append(includes, fmt.Sprintf("%s = %s OR %s OR %s", path, p, below(path, p), below(p, path)))
+		}
+		conditions = append(conditions, "("+strings.Join(includes, " OR ")+")")
+	}
+
+	for _, exclude := range options.Exclude {
+		p := param(exclude)
+		conditions = append(conditions, fmt.Sprintf("NOT (%s = %s OR %s)", path, p, below(path, p)))
+	}
+
+	return strings.Join(conditions, " AND "), args
 }
 
-func GetQuery(db func() orm.DB) (string, error) {
+// returns the graph query for the given options and its additional arguments
+func GetQuery(db func() orm.DB, options *LoadOptions) (string, []any, error) {
 	settings := db().Settings()
 	templ, err := template.New("graph").Parse(graphQuery)
 
 	if err != nil {
-		return "", fmt.Errorf("cannot load query template: %v", err)
+		return "", nil, fmt.Errorf("cannot load query template: %v", err)
 	}
 
-	context := &QueryContext{DBType: settings.Type}
+	if options == nil {
+		options = &LoadOptions{}
+	}
+
+	context := &QueryContext{
+		DBType:   settings.Type,
+		MaxDepth: options.MaxDepth,
+		Stubs:    options.Stubs,
+		Path:     `CASE WHEN graph.path = '' THEN edge.name ELSE graph.path || '/' || edge.name END`,
+	}
+
+	var args []any
+
+	context.Filter, args = pathFilter(options, context.Path, settings.Type == "pgx")
 
 	output := bytes.NewBuffer(nil)
 
 	if err := templ.Execute(output, context); err != nil {
-		return "", err
+		return "", nil, err
+	}
+
+	return output.String(), args, nil
+}
+
+// LoadStub loads the edges of a stub node and the graph below them. Nodes
+// in the given map (e.g. from NodesByID of the graph that contains the stub)
+// are reused instead of being built again, so shared subtrees stay shared,
+// and the loaded nodes are added to it. The map can be nil.
+func LoadStub(db func() orm.DB, stub *Node, options *LoadOptions, nodes map[int64]*Node) error {
+
+	if nodes == nil {
+		nodes = map[int64]*Node{}
+	}
+
+	// the stub is filled in instead of being replaced by a new node
+	nodes[stub.ID] = stub
+
+	_, err := getGraph(db, stub.ID, options, nodes)
+
+	return err
+}
+
+// NodesByID returns the node and its descendants by their ID
+func (n *Node) NodesByID() map[int64]*Node {
+	nodes := map[int64]*Node{}
+	n.addNodesByID(nodes)
+	return nodes
+}
+
+func (n *Node) addNodesByID(nodes map[int64]*Node) {
+
+	if _, ok := nodes[n.ID]; ok {
+		return
 	}
 
-	return output.String(), nil
+	nodes[n.ID] = n
+
+	for _, edge := range n.Outgoing {
+		edge.To.addNodesByID(nodes)
+	}
 }
 
 func GetGraphByID(db func() orm.DB, id int64) (*Node, error) {
+	return GetGraph(db, id, nil)
+}
+
+// GetGraphByHash loads the graph for the node with the given hash. Unlike
+// node IDs, hashes are the same in all databases.
+func GetGraphByHash(db func() orm.DB, hash []byte) (*Node, error) {
+	return GetGraphWithHash(db, hash, nil)
+}
 
-	query, err := GetQuery(db)
+// GetGraphWithHash loads the graph for the node with the given hash, limited
+// by the given options
+func GetGraphWithHash(db func() orm.DB, hash []byte, options *LoadOptions) (*Node, error) {
+
+	id, err := nodeIDByHash(db(), hash)
 
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := db().Query(query, id)
+	return GetGraph(db, id, options)
+}
+
+// GetGraph loads the graph for the given node, limited by the given options
+func GetGraph(db func() orm.DB, id int64, options *LoadOptions) (*Node, error) {
+	return getGraph(db, id, options, map[int64]*Node{})
+}
+
+// loads the graph like GetGraph, nodes that are in the given map are reused
+func getGraph(db func() orm.DB, id int64, options *LoadOptions, nodes map[int64]*Node) (*Node, error) {
+
+	query, args, err := GetQuery(db, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db().Query(query, append([]any{id}, args...)...)
 
 	if err != nil {
 		return nil, err
@@ -246,6 +391,9 @@ func GetGraphByID(db func() orm.DB, id int64) (*Node, error) {
 			&graphData.EdgeCreatedAt,
 			&graphData.EdgeUpdatedAt,
 			&graphData.EdgeFollow,
+			&graphData.Depth,
+			&graphData.Path,
+			&graphData.Expand,
 		); err != nil {
 			return nil, fmt.Errorf("scan error: %v", err)
 		}
@@ -254,21 +402,32 @@ func GetGraphByID(db func() orm.DB, id int64) (*Node, error) {
 	}
 
 	if len(graphDataList) == 0 {
-		return nil, fmt.Errorf("not found")
+		return nil, ErrNodeNotFound
 	}
 
 	dataByID := make(map[int64][]*GraphData)
+	dataByEdgeID := make(map[int64]*GraphData)
+	// a node is expanded if its edges were loaded via any path
+	expanded := make(map[int64]bool)
 
 	// we generate a map of all edges
 	for _, node := range graphDataList {
+		if node.Expand {
+			expanded[node.ToID] = true
+		}
+		// if a node can be reached via different paths, we might get the
+		// same edge more than once
+		if _, ok := dataByEdgeID[node.EdgeID]; ok && node.EdgeID != 0 {
+			continue
+		}
+		dataByEdgeID[node.EdgeID] = node
 		dataByID[node.FromID] = append(dataByID[node.FromID], node)
 	}
 
-	// we sort the nodes depth-first
-	sortedNodes := sortNodes(0, dataByID)
-
-	// we add the edges in depth-first traversal
-	node, _, err := reconstructNode(sortedNodes)
+	// the root is the target of the only edge without a source
+	if len(dataByID[0]) != 1 {
+		return nil, fmt.Errorf("expected exactly one root node, got %d", len(dataByID[0]))
+	}
 
-	return node, err
+	return reconstructNode(dataByID[0][0], dataByID, expanded, nodes), nil
 }
@@ -0,0 +1,257 @@
+package models
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// a flat representation of a node and its outgoing edges, which refer to
+// other nodes by their hash
+type nodeRecord struct {
+	ID    int64           `json:"id"`
+	Hash  []byte          `json:"hash"`
+	Type  string          `json:"type"`
+	Data  json.RawMessage `json:"data"`
+	Edges []*edgeRecord   `json:"edges"`
+}
+
+type edgeRecord struct {
+	Name   string          `json:"name"`
+	Type   int             `json:"type"`
+	Key    string          `json:"key"`
+	Index  int             `json:"index"`
+	Follow bool            `json:"follow"`
+	Data   json.RawMessage `json:"data"`
+	To     []byte          `json:"to"`
+}
+
+// JSON-encoded 'null' values are converted back to nil, everything else is
+// compacted again as records might be stored in indented form
+func recordData(data json.RawMessage) []byte {
+	if data == nil || string(data) == "null" {
+		return nil
+	}
+	buffer := bytes.NewBuffer(nil)
+	if err := json.Compact(buffer, data); err != nil {
+		return []byte(data)
+	}
+	return buffer.Bytes()
+}
+
+func makeNodeRecord(node *Node) *nodeRecord {
+
+	record := &nodeRecord{
+		ID:    node.ID,
+		Hash:  node.Hash,
+		Type:  node.Type,
+		Data:  node.Data,
+		Edges: make([]*edgeRecord, 0, len(node.Outgoing)),
+	}
+
+	for _, edge := range node.Outgoing {
+		record.Edges = append(record.Edges, &edgeRecord{
+			Name:   edge.Name,
+			Type:   edge.Type,
+			Key:    edge.Key,
+			Index:  edge.Index,
+			Follow: edge.Follow,
+			Data:   edge.Data,
+			To:     edge.To.Hash,
+		})
+	}
+
+	return record
+}
+
+type recordBackend interface {
+	// returns nil if the record doesn't exist
+	getRecord(hash string) (*nodeRecord, error)
+	putRecord(hash string, record *nodeRecord) error
+	deleteRecord(hash string) error
+}
+
+// implements a GraphStore on top of a simple key-value backend
+type recordStore struct {
+	mutex   sync.RWMutex
+	backend recordBackend
+	lastID  int64
+	// maps node IDs to hex-encoded hashes
+	hashes map[int64]string
+}
+
+func makeRecordStore(backend recordBackend) recordStore {
+	return recordStore{
+		backend: backend,
+		hashes:  make(map[int64]string),
+	}
+}
+
+// registers an existing record, e.g. when loading it from disk
+func (s *recordStore) addRecord(record *nodeRecord) {
+	s.hashes[record.ID] = hex.EncodeToString(record.Hash)
+	if record.ID > s.lastID {
+		s.lastID = record.ID
+	}
+}
+
+func (s *recordStore) PutTree(node *Node) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.putTree(node)
+}
+
+func (s *recordStore) putTree(node *Node) error {
+
+	if node.Hash == nil {
+		return fmt.Errorf("node doesn't have a hash")
+	}
+
+	hash := hex.EncodeToString(node.Hash)
+
+	if node.Stub {
+		// stubs need to refer to an existing node
+		if record, err := s.backend.getRecord(hash); err != nil {
+			return err
+		} else if record == nil {
+			return fmt.Errorf("cannot find referenced node: %v", ErrNodeNotFound)
+		} else {
+			node.ID = record.ID
+		}
+		return nil
+	}
+
+	if record, err := s.backend.getRecord(hash); err != nil {
+		return err
+	} else if record != nil {
+		// the node already exists
+		node.ID = record.ID
+		return nil
+	}
+
+	// we first save all descendants
+	for _, edge := range node.Outgoing {
+		if err := s.putTree(edge.To); err != nil {
+			return err
+		}
+	}
+
+	s.lastID++
+	node.ID = s.lastID
+
+	for _, edge := range node.Outgoing {
+		edge.FromID = node.ID
+		edge.ToID = edge.To.ID
+	}
+
+	record := makeNodeRecord(node)
+
+	if err := s.backend.putRecord(hash, record); err != nil {
+		return err
+	}
+
+	s.addRecord(record)
+
+	return nil
+}
+
+func (s *recordStore) GetByID(id int64) (*Node, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	hash, ok := s.hashes[id]
+
+	if !ok {
+		return nil, ErrNodeNotFound
+	}
+
+	return s.getNode(hash, true)
+}
+
+func (s *recordStore) GetByHash(hash []byte) (*Node, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.getNode(hex.EncodeToString(hash), true)
+}
+
+// like the SQL store we stop following the graph at non-follow edges
+func (s *recordStore) getNode(hash string, follow bool) (*Node, error) {
+
+	record, err := s.backend.getRecord(hash)
+
+	if err != nil {
+		return nil, err
+	} else if record == nil {
+		return nil, ErrNodeNotFound
+	}
+
+	node := &Node{
+		ID:   record.ID,
+		Hash: record.Hash,
+		Type: record.Type,
+		Data: recordData(record.Data),
+	}
+
+	if !follow {
+		node.Stub = true
+		return node, nil
+	}
+
+	for _, edgeRecord := range record.Edges {
+
+		toNode, err := s.getNode(hex.EncodeToString(edgeRecord.To), edgeRecord.Follow)
+
+		if err == ErrNodeNotFound {
+			// the node was deleted
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		edge := MakeEdge()
+		edge.Name = edgeRecord.Name
+		edge.Type = edgeRecord.Type
+		edge.Key = edgeRecord.Key
+		edge.Index = edgeRecord.Index
+		edge.Follow = edgeRecord.Follow
+		edge.Data = recordData(edgeRecord.Data)
+
+		edge.FromTo(node, toNode)
+	}
+
+	return node, nil
+}
+
+func (s *recordStore) Exists(hash []byte) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	record, err := s.backend.getRecord(hex.EncodeToString(hash))
+
+	if err != nil {
+		return false, err
+	}
+
+	return record != nil, nil
+}
+
+func (s *recordStore) Delete(id int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hash, ok := s.hashes[id]
+
+	if !ok {
+		return ErrNodeNotFound
+	}
+
+	if err := s.backend.deleteRecord(hash); err != nil {
+		return err
+	}
+
+	delete(s.hashes, id)
+
+	return nil
+}
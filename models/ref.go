@@ -0,0 +1,111 @@
+package models
+
+import (
+	"reflect"
+)
+
+// Ref is a lazy reference to another model. It is stored as an edge that
+// isn't followed when loading a graph, so the referenced model is only
+// loaded when calling Load. This is useful for large shared content that
+// is linked from many places.
+type Ref[T any] struct {
+	node  *Node
+	model *T
+}
+
+func MakeRef[T any](model *T) Ref[T] {
+	return Ref[T]{model: model}
+}
+
+// returns the referenced model if it has been set or loaded already
+func (r Ref[T]) Get() *T {
+	return r.model
+}
+
+func (r *Ref[T]) Set(model *T) {
+	r.model = model
+	r.node = nil
+}
+
+// returns the hash of the referenced node, if known
+func (r Ref[T]) Hash() []byte {
+	if r.node == nil {
+		return nil
+	}
+	return r.node.Hash
+}
+
+// Load loads the referenced model from the given store (if necessary)
+func (r *Ref[T]) Load(store GraphStore) (*T, error) {
+
+	if r.model != nil || r.node == nil {
+		return r.model, nil
+	}
+
+	var node *Node
+	var err error
+
+	if r.node.ID != 0 {
+		node, err = store.GetByID(r.node.ID)
+	} else {
+		node, err = store.GetByHash(r.node.Hash)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	model, err := DeserializeType[T](node)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.model = model
+
+	return model, nil
+}
+
+func (r Ref[T]) referencedModel() any {
+	if r.model == nil {
+		return nil
+	}
+	return r.model
+}
+
+// returns a stub for the referenced node
+func (r Ref[T]) referencedNode() *Node {
+	if r.node == nil {
+		return nil
+	}
+	return &Node{
+		ID:   r.node.ID,
+		Hash: r.node.Hash,
+		Type: r.node.Type,
+		Stub: true,
+	}
+}
+
+func (r *Ref[T]) setReferencedNode(node *Node) {
+	r.node = &Node{
+		ID:   node.ID,
+		Hash: node.Hash,
+		Type: node.Type,
+	}
+	r.model = nil
+}
+
+type reference interface {
+	referencedModel() any
+	referencedNode() *Node
+}
+
+type settableReference interface {
+	setReferencedNode(node *Node)
+}
+
+var settableReferenceType = reflect.TypeOf((*settableReference)(nil)).Elem()
+
+func isReference(fieldType reflect.Type) bool {
+	return fieldType.Kind() == reflect.Struct && reflect.PointerTo(fieldType).Implements(settableReferenceType)
+}
@@ -0,0 +1,145 @@
+package models_test
+
+import (
+	"bytes"
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+type Library struct {
+	Name  string   `json:"name"`
+	Items []*Label `json:"items"`
+}
+
+type Page struct {
+	Title   string              `json:"title"`
+	Library models.Ref[Library] `json:"library"`
+}
+
+func testRef(t *testing.T, store models.GraphStore) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := models.Register[Library]("library"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := models.Register[Page]("page"); err != nil {
+		t.Fatal(err)
+	}
+
+	library := &Library{
+		Name: "media",
+		Items: []*Label{
+			{Name: "image", Value: "cat.png"},
+			{Name: "video", Value: "cat.mp4"},
+		},
+	}
+
+	page := &Page{
+		Title:   "Cats",
+		Library: models.MakeRef(library),
+	}
+
+	node, err := models.Serialize(page)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(node.Outgoing) != 1 || node.Outgoing[0].Follow {
+		t.Fatalf("expected a single non-follow edge")
+	}
+
+	if err := store.PutTree(node); err != nil {
+		t.Fatal(err)
+	}
+
+	loadedNode, err := store.GetByID(node.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loadedNode.Outgoing) != 1 || loadedNode.Outgoing[0].Follow {
+		t.Fatalf("expected the edge to be stored as non-follow edge")
+	}
+
+	if len(loadedNode.Outgoing[0].To.Outgoing) != 0 {
+		t.Fatalf("the referenced graph shouldn't be loaded")
+	}
+
+	loadedPage, err := models.DeserializeType[Page](loadedNode)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loadedPage.Library.Get() != nil {
+		t.Fatalf("the library shouldn't be loaded yet")
+	}
+
+	// serializing the page again should work without loading the reference
+	again, err := models.Serialize(loadedPage)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(again.Hash, node.Hash) {
+		t.Fatalf("hash changed after serializing again")
+	}
+
+	// we save a new version that still refers to the stored library
+	loadedPage.Title = "More cats"
+
+	changed, err := models.Serialize(loadedPage)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutTree(changed); err != nil {
+		t.Fatal(err)
+	}
+
+	if changed.Outgoing[0].To.ID != node.Outgoing[0].To.ID {
+		t.Fatalf("expected the reference to point to the stored library")
+	}
+
+	loadedLibrary, err := loadedPage.Library.Load(store)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loadedLibrary.Items) != 2 || loadedLibrary.Items[1].Value != "cat.mp4" {
+		t.Fatalf("library wasn't loaded correctly")
+	}
+}
+
+func TestRefMemoryStore(t *testing.T) {
+	testRef(t, models.MakeMemoryStore())
+}
+
+func TestRefSQLStore(t *testing.T) {
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRef(t, models.MakeSQLStore(func() orm.DB { return db }))
+}
@@ -28,6 +28,8 @@ type RelatedModelSchema struct {
 	Field       string
 	Optional    bool
 	ModelSchema *ModelSchema
+	// lazy relations are stored as non-follow edges (see Ref)
+	Lazy bool
 }
 
 type ModelSchemaField struct {
@@ -122,6 +124,17 @@ fieldsLoop:
 			fieldType = fieldType.Elem()
 		}
 
+		if isReference(fieldType) {
+			related = append(related, &RelatedModelSchema{
+				Type:     Struct,
+				Name:     fieldName,
+				Field:    field.Name,
+				Optional: true,
+				Lazy:     true,
+			})
+			continue fieldsLoop
+		}
+
 		switch fieldType.Kind() {
 		case reflect.Map:
 			// map
@@ -0,0 +1,343 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gospel-sh/gospel/orm"
+	"time"
+)
+
+type RehashResult struct {
+	// the number of graphs that were rehashed
+	Graphs int
+	// the number of updated sites, refs, commits, change requests, schedules
+	// and experiment variants
+	Sites          int
+	Refs           int
+	Commits        int
+	ChangeRequests int
+	Schedules      int
+	Variants       int
+}
+
+type rehasher struct {
+	db func() orm.DB
+	// maps the IDs of old root nodes to their rehashed versions
+	rehashed map[int64]*Node
+	// the rehashed graphs that need to be saved
+	graphs []*Node
+	// the updates of the sites, refs, etc., which are executed after saving
+	// the graphs within the same transaction
+	updates []rehashUpdate
+	result  *RehashResult
+}
+
+type rehashUpdate struct {
+	// returns the query and its arguments, graphs have their IDs at this point
+	query func() (string, []any)
+	// the counter in the result that is increased
+	counter *int
+}
+
+// rehashes the graph with the given root ID (if necessary) and returns the
+// new root, which doesn't have an ID until it is saved
+func (r *rehasher) rehash(id int64) (*Node, error) {
+
+	if node, ok := r.rehashed[id]; ok {
+		return node, nil
+	}
+
+	node, err := GetGraphByID(r.db, id)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load graph %d: %v", id, err)
+	}
+
+	// referenced graphs aren't loaded and keep their hash when serializing,
+	// so we rehash them first
+	if err := r.rehashReferences(node, map[*Node]bool{}); err != nil {
+		return nil, err
+	}
+
+	model, err := Deserialize(node)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot deserialize graph %d: %v", id, err)
+	}
+
+	newNode, err := Serialize(model)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot serialize graph %d: %v", id, err)
+	}
+
+	if bytes.Equal(newNode.Hash, node.Hash) {
+		// the graph already uses the current hash format
+		r.rehashed[id] = node
+		return node, nil
+	}
+
+	r.result.Graphs++
+	r.rehashed[id] = newNode
+	r.graphs = append(r.graphs, newNode)
+
+	return newNode, nil
+}
+
+func (r *rehasher) rehashReferences(node *Node, visited map[*Node]bool) error {
+
+	if visited[node] {
+		return nil
+	}
+
+	visited[node] = true
+
+	for _, edge := range node.Outgoing {
+
+		if edge.Follow {
+			if err := r.rehashReferences(edge.To, visited); err != nil {
+				return err
+			}
+			continue
+		}
+
+		referenced, err := r.rehash(edge.To.ID)
+
+		if err != nil {
+			return err
+		}
+
+		edge.To = referenced
+	}
+
+	return nil
+}
+
+// records an update that is executed if the graph with the given ID changed
+func (r *rehasher) update(counter *int, ids []int64, query func(nodes []*Node) (string, []any)) error {
+
+	nodes := make([]*Node, len(ids))
+	changed := false
+
+	for i, id := range ids {
+
+		node, err := r.rehash(id)
+
+		if err != nil {
+			return err
+		}
+
+		nodes[i] = node
+		changed = changed || node.ID != id
+	}
+
+	if !changed {
+		return nil
+	}
+
+	r.updates = append(r.updates, rehashUpdate{
+		query:   func() (string, []any) { return query(nodes) },
+		counter: counter,
+	})
+
+	return nil
+}
+
+// saves the rehashed graphs and executes the updates in one transaction
+func (r *rehasher) commit() error {
+
+	tx, err := r.db().Begin()
+
+	if err != nil {
+		return err
+	}
+
+	for _, node := range r.graphs {
+		if err := node.SaveTreeBatch(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("cannot save graph: %v", err)
+		}
+	}
+
+	for _, update := range r.updates {
+
+		query, args := update.query()
+
+		if _, err := tx.Exec(query, args...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("cannot update: %v", err)
+		}
+
+		(*update.counter)++
+	}
+
+	return tx.Commit()
+}
+
+// rehashes the version of an experiment variant if it is a node hash, ref
+// names and commit IDs stay valid
+func (r *rehasher) rehashVariant(variant *ExperimentVariant, now time.Time) error {
+
+	hash, err := ParseHash(variant.Version)
+
+	if err != nil || len(hash) != HashSize {
+		return nil
+	}
+
+	id, err := nodeIDByHash(r.db(), hash)
+
+	if err == ErrNodeNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return r.update(&r.result.Variants, []int64{id}, func(nodes []*Node) (string, []any) {
+
+		version := Base32Hash(nodes[0].Hash)
+
+		// we keep the encoding of the version
+		if len(variant.Version) == HashSize*2 {
+			version = HexHash(nodes[0].Hash)
+		}
+
+		return `UPDATE experiment_variant SET version = $1, updated_at = $2 WHERE id = $3`, []any{version, now, variant.ID}
+	})
+}
+
+// Rehash serializes the graphs of all site heads, refs, commits, change
+// requests and pending schedules again, which recalculates their hashes using
+// the current hash format, and points them to the new graphs. Referenced
+// graphs (`$ref`) are rehashed as well, and experiment variants whose version
+// is a node hash are updated. Everything is saved in one transaction, graphs
+// that already use the current format are left untouched. The old nodes
+// become unreachable and can be removed with GC.
+//
+// Hashes outside of the database can't be updated: signed preview links,
+// which always contain a hash, are rejected as unknown versions afterwards,
+// and site definitions with `$ref` need to be dumped again.
+func Rehash(db func() orm.DB) (*RehashResult, error) {
+
+	r := &rehasher{
+		db:       db,
+		rehashed: make(map[int64]*Node),
+		result:   &RehashResult{},
+	}
+
+	now := time.Now().UTC()
+
+	commits, err := orm.Objects[Commit](db, map[string]any{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, commit := range commits {
+
+		commit := commit
+
+		if err := r.update(&r.result.Commits, []int64{commit.HeadID}, func(nodes []*Node) (string, []any) {
+			return `UPDATE "commit" SET head_id = $1, hash = $2, updated_at = $3 WHERE id = $4`, []any{nodes[0].ID, nodes[0].Hash, now, commit.ID}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	refs, err := orm.Objects[SiteRef](db, map[string]any{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range refs {
+
+		ref := ref
+
+		if err := r.update(&r.result.Refs, []int64{ref.HeadID}, func(nodes []*Node) (string, []any) {
+			return `UPDATE site_ref SET head_id = $1, hash = $2, updated_at = $3 WHERE id = $4`, []any{nodes[0].ID, nodes[0].Hash, now, ref.ID}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	changeRequests, err := orm.Objects[ChangeRequest](db, map[string]any{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, changeRequest := range changeRequests {
+
+		changeRequest := changeRequest
+
+		if err := r.update(&r.result.ChangeRequests, []int64{changeRequest.HeadID, changeRequest.BaseID}, func(nodes []*Node) (string, []any) {
+			return `UPDATE change_request SET head_id = $1, hash = $2, base_id = $3, updated_at = $4 WHERE id = $5`, []any{nodes[0].ID, nodes[0].Hash, nodes[1].ID, now, changeRequest.ID}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	schedules, err := orm.Objects[Schedule](db, map[string]any{"status": SchedulePending})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, schedule := range schedules {
+
+		schedule := schedule
+
+		if schedule.HeadID == nil {
+			continue
+		}
+
+		if err := r.update(&r.result.Schedules, []int64{*schedule.HeadID}, func(nodes []*Node) (string, []any) {
+			return `UPDATE schedule SET head_id = $1, updated_at = $2 WHERE id = $3`, []any{nodes[0].ID, now, schedule.ID}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	variants, err := orm.Objects[ExperimentVariant](db, map[string]any{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, variant := range variants {
+		if err := r.rehashVariant(variant, now); err != nil {
+			return nil, err
+		}
+	}
+
+	sites, err := orm.Objects[Site](db, map[string]any{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, site := range sites {
+
+		site := site
+
+		if site.HeadID == nil {
+			continue
+		}
+
+		if err := r.update(&r.result.Sites, []int64{*site.HeadID}, func(nodes []*Node) (string, []any) {
+			return `UPDATE site SET head_id = $1, hash = $2, updated_at = $3 WHERE id = $4`, []any{nodes[0].ID, nodes[0].Hash, now, site.ID}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.commit(); err != nil {
+		return nil, err
+	}
+
+	for _, site := range sites {
+		InvalidateSite(site)
+	}
+
+	return r.result, nil
+}
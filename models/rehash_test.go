@@ -0,0 +1,203 @@
+package models_test
+
+import (
+	"bytes"
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/auth"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+func TestRehash(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	node, err := models.Serialize(makeDiffTag())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedHash := node.Hash
+
+	// we simulate a graph with an outdated hash format
+	node.Hash = []byte("outdated")
+
+	if err := node.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CommitHead(dbf, node, nil, "initial version"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := models.Rehash(dbf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Graphs != 1 || result.Sites != 1 || result.Refs != 1 || result.Commits != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	if err := site.ByID(site.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := models.GetGraphByID(dbf, *site.HeadID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(head.Hash, expectedHash) {
+		t.Fatalf("expected the site head to be rehashed")
+	}
+
+	// running it again doesn't change anything
+	if result, err := models.Rehash(dbf); err != nil {
+		t.Fatal(err)
+	} else if result.Graphs != 0 {
+		t.Fatalf("expected no graphs to be rehashed, got %d", result.Graphs)
+	}
+}
+
+func TestRehashReferences(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := models.Register[Library]("library"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := models.Register[Page]("page"); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	library := &Library{Name: "media", Items: []*Label{{Name: "image", Value: "cat.png"}}}
+
+	node, err := models.Serialize(&Page{Title: "Cats", Library: models.MakeRef(library)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedHash := node.Hash
+	libraryNode := node.Outgoing[0].To
+	expectedLibraryHash := libraryNode.Hash
+
+	// we simulate a page and a referenced library with an outdated hash format
+	node.Hash = bytes.Repeat([]byte{1}, models.HashSize)
+	libraryNode.Hash = bytes.Repeat([]byte{2}, models.HashSize)
+
+	if err := node.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CommitHead(dbf, node, nil, "initial version"); err != nil {
+		t.Fatal(err)
+	}
+
+	experiment, err := site.CreateExperiment(dbf, makeUser("reviewer@example.com", auth.ReviewerRole), "cats", []*models.ExperimentVariant{
+		{Name: "a", Version: models.HexHash(node.Hash), Weight: 1},
+		{Name: "b", Version: models.Base32Hash(node.Hash), Weight: 1},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := models.Rehash(dbf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Graphs != 2 || result.Variants != 2 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	if err := site.ByID(site.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := models.GetGraphByID(dbf, *site.HeadID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(head.Hash, expectedHash) {
+		t.Fatalf("expected the site head to be rehashed")
+	}
+
+	if !bytes.Equal(head.Outgoing[0].To.Hash, expectedLibraryHash) {
+		t.Fatalf("expected the referenced graph to be rehashed")
+	}
+
+	variants, err := experiment.Variants(dbf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, variant := range variants {
+
+		expected := models.HexHash(expectedHash)
+
+		if variant.Name == "b" {
+			expected = models.Base32Hash(expectedHash)
+		}
+
+		if variant.Version != expected {
+			t.Fatalf("expected version %s of variant %s, got %s", expected, variant.Name, variant.Version)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package models
+
+import (
+	"fmt"
+	"github.com/gospel-sh/gospel/orm"
+	"strings"
+	"time"
+)
+
+// the maximum number of rows per statement, which keeps the number of query
+// parameters well below the limits of SQLite and Postgres
+const saveBatchSize = 500
+
+// the state of a batched save
+type batchSave struct {
+	db orm.Transaction
+	// all node objects by hash, as identical subtrees can be represented by
+	// different objects
+	nodes map[string][]*Node
+	// the node objects that were collected, as loaded graphs share objects
+	collected map[*Node]bool
+	// the hashes of the nodes in the order they were found
+	hashes []string
+	// the IDs of the nodes that already exist
+	existing map[string]int64
+	// the nodes that need to be inserted, one object per hash
+	missing     []*Node
+	missingSeen map[string]bool
+	// the existing nodes that are reused by the tree
+	reused     []int64
+	reusedSeen map[string]bool
+}
+
+// collects all node objects of the tree
+func (b *batchSave) collect(node *Node) {
+
+	if b.collected[node] {
+		return
+	}
+
+	b.collected[node] = true
+	hash := string(node.Hash)
+
+	if _, ok := b.nodes[hash]; !ok {
+		b.hashes = append(b.hashes, hash)
+	}
+
+	b.nodes[hash] = append(b.nodes[hash], node)
+
+	for _, edge := range node.Outgoing {
+		b.collect(edge.To)
+	}
+}
+
+// sets the ID of all objects with the given hash
+func (b *batchSave) setID(hash string, id int64) {
+	for _, node := range b.nodes[hash] {
+		node.ID = id
+	}
+}
+
+// returns the values of a multi-row statement, e.g. '($1, $2, NULL), ($3, $4, NULL)'
+func paramRows(rows, columns int, suffix string) string {
+
+	values := make([]string, rows)
+
+	for i := 0; i < rows; i++ {
+		values[i] = fmt.Sprintf("(%s%s)", placeholders(i*columns+1, columns), suffix)
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// looks up the IDs of the nodes that already exist and sets them
+func (b *batchSave) loadExisting() error {
+
+	for start := 0; start < len(b.hashes); start += saveBatchSize {
+
+		end := start + saveBatchSize
+
+		if end > len(b.hashes) {
+			end = len(b.hashes)
+		}
+
+		args := make([]any, 0, end-start)
+
+		for _, hash := range b.hashes[start:end] {
+			args = append(args, []byte(hash))
+		}
+
+		query := fmt.Sprintf(`SELECT id, hash FROM node WHERE hash IN (%s) AND deleted_at IS NULL`, placeholders(1, len(args)))
+
+		rows, err := b.db.Query(query, args...)
+
+		if err != nil {
+			return fmt.Errorf("cannot check for node existence: %v", err)
+		}
+
+		for rows.Next() {
+
+			var id int64
+			var hash []byte
+
+			if err := rows.Scan(&id, &hash); err != nil {
+				rows.Close()
+				return fmt.Errorf("scan error: %v", err)
+			}
+
+			b.existing[string(hash)] = id
+			b.setID(string(hash), id)
+		}
+
+		rows.Close()
+	}
+
+	return nil
+}
+
+// determines which nodes need to be inserted, like SaveTree we don't descend
+// into nodes that already exist
+func (b *batchSave) plan(node *Node) error {
+
+	hash := string(node.Hash)
+
+	if id, ok := b.existing[hash]; ok {
+		// stubs only refer to existing nodes, they are never reused
+		if !node.Stub && !b.reusedSeen[hash] {
+			b.reusedSeen[hash] = true
+			b.reused = append(b.reused, id)
+		}
+		return nil
+	}
+
+	if node.Stub {
+		if node.ID != 0 {
+			return nil
+		}
+		return fmt.Errorf("cannot find referenced node: %v", ErrNodeNotFound)
+	}
+
+	if b.missingSeen[hash] {
+		return nil
+	}
+
+	b.missingSeen[hash] = true
+	b.missing = append(b.missing, node)
+
+	for _, edge := range node.Outgoing {
+		if err := b.plan(edge.To); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inserts the missing nodes and sets their IDs
+func (b *batchSave) insertNodes(now time.Time) error {
+
+	for start := 0; start < len(b.missing); start += saveBatchSize {
+
+		end := start + saveBatchSize
+
+		if end > len(b.missing) {
+			end = len(b.missing)
+		}
+
+		batch := b.missing[start:end]
+		args := make([]any, 0, len(batch)*3+1)
+
+		for _, node := range batch {
+			args = append(args, node.Hash, node.Type, node.Data)
+		}
+
+		args = append(args, now)
+
+		// another transaction might have inserted the node in the meantime
+		query := fmt.Sprintf(`
+INSERT INTO node
+	(
+		hash,
+		type,
+		data,
+		updated_at
+	)
+VALUES
+	%s
+ON CONFLICT
+	(hash)
+WHERE
+	deleted_at IS NULL
+DO UPDATE SET updated_at = $%d
+RETURNING
+	id, hash, updated_at, created_at
+`, paramRows(len(batch), 3, ", NULL"), len(args))
+
+		rows, err := b.db.Query(query, args...)
+
+		if err != nil {
+			return fmt.Errorf("cannot insert nodes: %v", err)
+		}
+
+		for rows.Next() {
+
+			var id int64
+			var hash []byte
+			var updatedAt, createdAt *orm.Time
+
+			if err := rows.Scan(&id, &hash, &updatedAt, &createdAt); err != nil {
+				rows.Close()
+				return fmt.Errorf("cannot scan ID: %v", err)
+			}
+
+			for _, node := range b.nodes[string(hash)] {
+				node.ID = id
+				node.UpdatedAt = updatedAt
+				node.CreatedAt = createdAt
+			}
+		}
+
+		rows.Close()
+	}
+
+	return nil
+}
+
+// marks the reused nodes as updated, which protects them from the GC
+func (b *batchSave) touchReused(now time.Time) error {
+
+	for start := 0; start < len(b.reused); start += saveBatchSize {
+
+		end := start + saveBatchSize
+
+		if end > len(b.reused) {
+			end = len(b.reused)
+		}
+
+		args := []any{now}
+
+		for _, id := range b.reused[start:end] {
+			args = append(args, id)
+		}
+
+		query := fmt.Sprintf(`UPDATE node SET updated_at = $1 WHERE id IN (%s)`, placeholders(2, len(args)-1))
+
+		if _, err := b.db.Exec(query, args...); err != nil {
+			return fmt.Errorf("cannot update nodes: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// identifies an edge row by the columns of its unique index
+func edgeRowKey(fromID, toID int64, name string, index int, key string, edgeType int) string {
+	return fmt.Sprintf("%d/%d/%d/%d/%q/%q", fromID, toID, index, edgeType, name, key)
+}
+
+// inserts the outgoing edges of the inserted nodes and sets their IDs
+func (b *batchSave) insertEdges(now time.Time) error {
+
+	edges := make([]*Edge, 0, len(b.missing))
+
+	for _, node := range b.missing {
+		for _, edge := range node.Outgoing {
+
+			if edge.From == nil || edge.From.ID == 0 {
+				return fmt.Errorf("'From' node missing or doesn't have an ID")
+			}
+
+			if edge.To == nil || edge.To.ID == 0 {
+				return fmt.Errorf("'To' node missing or doesn't have an ID")
+			}
+
+			edge.FromID = edge.From.ID
+			edge.ToID = edge.To.ID
+
+			if edge.ExtID == nil {
+				edge.ExtID = &orm.UUID{}
+				if err := edge.ExtID.Generate(); err != nil {
+					return err
+				}
+			}
+
+			edges = append(edges, edge)
+		}
+	}
+
+	for start := 0; start < len(edges); start += saveBatchSize {
+
+		end := start + saveBatchSize
+
+		if end > len(edges) {
+			end = len(edges)
+		}
+
+		batch := edges[start:end]
+		args := make([]any, 0, len(batch)*9+1)
+		edgesByKey := make(map[string]*Edge, len(batch))
+
+		for _, edge := range batch {
+			args = append(args, edge.ExtID.Bytes(), edge.FromID, edge.ToID, edge.Name, edge.Type, edge.Index, edge.Key, edge.Data, edge.Follow)
+			edgesByKey[edgeRowKey(edge.FromID, edge.ToID, edge.Name, edge.Index, edge.Key, edge.Type)] = edge
+		}
+
+		args = append(args, now.UTC())
+
+		query := fmt.Sprintf(`
+INSERT INTO edge
+	(
+		ext_id,
+		from_id,
+		to_id,
+		name,
+		type,
+		ind,
+		key,
+		data,
+		follow,
+		updated_at
+	)
+VALUES
+	%s
+ON CONFLICT
+	(from_id, to_id, name, ind, key, type)
+WHERE
+	deleted_at IS NULL
+DO UPDATE SET updated_at = $%d
+RETURNING
+	id, from_id, to_id, name, ind, key, type, updated_at, created_at
+`, paramRows(len(batch), 9, ", NULL"), len(args))
+
+		rows, err := b.db.Query(query, args...)
+
+		if err != nil {
+			return fmt.Errorf("cannot insert edges: %v", err)
+		}
+
+		inserted := 0
+
+		for rows.Next() {
+
+			var id, fromID, toID int64
+			var name, key string
+			var index, edgeType int
+			var updatedAt, createdAt *orm.Time
+
+			if err := rows.Scan(&id, &fromID, &toID, &name, &index, &key, &edgeType, &updatedAt, &createdAt); err != nil {
+				rows.Close()
+				return fmt.Errorf("cannot scan ID: %v", err)
+			}
+
+			// the rows aren't necessarily returned in the order of the values
+			if edge, ok := edgesByKey[edgeRowKey(fromID, toID, name, index, key, edgeType)]; ok {
+				edge.ID = id
+				edge.UpdatedAt = updatedAt
+				edge.CreatedAt = createdAt
+				inserted++
+			}
+		}
+
+		rows.Close()
+
+		if inserted != len(batch) {
+			return fmt.Errorf("cannot insert edges: expected %d rows, got %d", len(batch), inserted)
+		}
+	}
+
+	return nil
+}
+
+// SaveTreeBatch saves the node and its descendants like SaveTree and sets
+// the same IDs, but uses a few multi-row statements instead of one statement
+// per node and edge. It first checks which nodes already exist, then inserts
+// the missing nodes and their edges. It should be called within a
+// transaction, so that no partial trees are saved.
+func (n *Node) SaveTreeBatch(db orm.Transaction) error {
+
+	b := &batchSave{
+		db:          db,
+		nodes:       map[string][]*Node{},
+		collected:   map[*Node]bool{},
+		existing:    map[string]int64{},
+		missingSeen: map[string]bool{},
+		reusedSeen:  map[string]bool{},
+	}
+
+	b.collect(n)
+
+	if err := b.loadExisting(); err != nil {
+		return err
+	}
+
+	if err := b.plan(n); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	if err := b.insertNodes(now); err != nil {
+		return err
+	}
+
+	if err := b.touchReused(now); err != nil {
+		return err
+	}
+
+	return b.insertEdges(now)
+}
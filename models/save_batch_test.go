@@ -0,0 +1,304 @@
+package models_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+// returns the IDs of all nodes of the tree in depth-first order
+func treeIDs(node *models.Node) []int64 {
+	ids := []int64{node.ID}
+	for _, edge := range node.Outgoing {
+		ids = append(ids, treeIDs(edge.To)...)
+	}
+	return ids
+}
+
+// maps the IDs of a rolled back transaction to the ones of another one
+type idMapping struct {
+	forward, backward map[int64]int64
+}
+
+func makeIDMapping() *idMapping {
+	return &idMapping{forward: map[int64]int64{}, backward: map[int64]int64{}}
+}
+
+// checks that the IDs are used consistently in both transactions
+func (m *idMapping) match(a, b int64) bool {
+	if id, ok := m.forward[a]; ok && id != b {
+		return false
+	}
+	if id, ok := m.backward[b]; ok && id != a {
+		return false
+	}
+	m.forward[a], m.backward[b] = b, a
+	return true
+}
+
+// compares the IDs that the batched save and SaveTree set on the same tree,
+// which might be numbered differently as they were saved in different
+// transactions. SaveTree doesn't set the IDs of nodes below existing ones,
+// which we skip.
+func compareSavedIDs(t *testing.T, batch, single *models.Node, nodes, edges *idMapping) {
+
+	if single.ID != 0 && !nodes.match(batch.ID, single.ID) {
+		t.Fatalf("node %d doesn't match node %d", batch.ID, single.ID)
+	}
+
+	for i, edge := range batch.Outgoing {
+
+		singleEdge := single.Outgoing[i]
+
+		if (edge.ID == 0) != (singleEdge.ID == 0) || !edges.match(edge.ID, singleEdge.ID) {
+			t.Fatalf("edge %d doesn't match edge %d", edge.ID, singleEdge.ID)
+		}
+
+		compareSavedIDs(t, edge.To, singleEdge.To, nodes, edges)
+	}
+}
+
+// checks that the saved edges of the tree have the ID of the matching row
+func compareEdgeRows(t *testing.T, db orm.DB, node *models.Node) {
+
+	for _, edge := range node.Outgoing {
+
+		if edge.ID != 0 {
+
+			rows, err := db.Query(`SELECT from_id, to_id, name, ind, key FROM edge WHERE id = $1`, edge.ID)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var fromID, toID int64
+			var name, key string
+			var index int
+
+			if !rows.Next() {
+				rows.Close()
+				t.Fatalf("edge %d doesn't exist", edge.ID)
+			} else if err := rows.Scan(&fromID, &toID, &name, &index, &key); err != nil {
+				rows.Close()
+				t.Fatal(err)
+			}
+
+			rows.Close()
+
+			if fromID != edge.From.ID || toID != edge.To.ID || name != edge.Name || index != edge.Index || key != edge.Key {
+				t.Fatalf("edge %d belongs to another row", edge.ID)
+			}
+		}
+
+		compareEdgeRows(t, db, edge.To)
+	}
+}
+
+func TestSaveTreeBatch(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeChild := func(tagType string) *Tag {
+		return &Tag{
+			Type: tagType,
+			Meta: Meta{Language: "de"},
+			Attributes: []*Attribute{
+				{Name: "class", Value: "foo", Labels: map[string]*Label{"a": {Name: "a", Value: "b"}}},
+			},
+		}
+	}
+
+	// identical children are represented by different node objects
+	tag := &Tag{
+		Type:     "div",
+		Meta:     Meta{Language: "de"},
+		Children: []*Tag{makeChild("p"), makeChild("p"), makeChild("h1")},
+	}
+
+	for i, change := range []func(){
+		func() {},
+		func() { tag.Children[2].Type = "h2" },
+		func() { tag.Children = append(tag.Children, makeChild("h3")) },
+	} {
+
+		change()
+
+		// we save the tree the usual way first and roll the changes back
+		singleNode, err := models.Serialize(tag)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err := db.Begin()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := singleNode.SaveTree(tx); err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+
+		node, err := models.Serialize(tag)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err = db.Begin()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := node.SaveTreeBatch(tx); err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, edge := range node.Outgoing {
+			if i == 0 && edge.ID == 0 {
+				t.Fatalf("expected the edges to be saved")
+			}
+		}
+
+		// saving the same tree again the usual way needs to return the same IDs
+		otherNode, err := models.Serialize(tag)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := otherNode.SaveTree(db); err != nil {
+			t.Fatal(err)
+		}
+
+		if otherNode.ID != node.ID {
+			t.Fatalf("%d: expected ID %d, got %d", i, otherNode.ID, node.ID)
+		}
+
+		// the batched save sets the IDs of all nodes, not only of the ones
+		// saved the usual way
+		ids := treeIDs(node)
+
+		for _, id := range ids {
+			if id == 0 {
+				t.Fatalf("%d: expected all nodes to have an ID", i)
+			}
+		}
+
+		graph, err := models.GetGraphByID(func() orm.DB { return db }, node.ID)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(graph.Hash, node.Hash) {
+			t.Fatalf("%d: hashes don't match", i)
+		}
+
+		if graphIDs := treeIDs(graph); len(graphIDs) != len(ids) {
+			t.Fatalf("%d: expected %d nodes, got %d", i, len(ids), len(graphIDs))
+		} else {
+			for j, id := range graphIDs {
+				if ids[j] != id {
+					t.Fatalf("%d: IDs don't match", i)
+				}
+			}
+		}
+
+		compareSavedIDs(t, node, singleNode, makeIDMapping(), makeIDMapping())
+		compareEdgeRows(t, db, node)
+	}
+}
+
+func TestSaveTreeBatchSharedNodes(t *testing.T) {
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every node has two edges to the same child object, like loaded graphs
+	// with shared subtrees, so there are 2^levels paths to the last node
+	levels := 40
+	var child *models.Node
+
+	for i := 0; i < levels; i++ {
+
+		node := &models.Node{
+			Type: "test",
+			Hash: []byte(fmt.Sprintf("shared%d", i)),
+		}
+
+		if err := node.SetData(map[string]any{"level": i}); err != nil {
+			t.Fatal(err)
+		}
+
+		if child != nil {
+			for j := 0; j < 2; j++ {
+				edge := models.MakeEdge()
+				edge.Name = "children"
+				edge.Type = int(models.Slice)
+				edge.Index = j
+				edge.FromTo(node, child)
+			}
+		}
+
+		child = node
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := child.SaveTreeBatch(tx); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countNodes(t, db); n != levels {
+		t.Fatalf("expected %d nodes, got %d", levels, n)
+	}
+}
@@ -0,0 +1,479 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/auth"
+	"github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+	"sync"
+	"time"
+)
+
+const (
+	// publishes a given change request
+	SchedulePublish = "publish"
+	// removes a route from the draft and published versions of a site
+	ScheduleExpireRoute = "expire-route"
+)
+
+const (
+	SchedulePending   = "pending"
+	ScheduleRunning   = "running"
+	ScheduleDone      = "done"
+	ScheduleFailed    = "failed"
+	ScheduleCancelled = "cancelled"
+)
+
+// schedules that are running for longer than this were most likely
+// interrupted by a crash or restart and are pending again
+const ScheduleLease = 15 * time.Minute
+
+// A schedule runs an action on a site at a given time. Schedules are stored
+// in the database, so they survive restarts of the server.
+type Schedule struct {
+	orm.DBModel
+	orm.JSONModel
+	SiteID int64
+	Action string
+	// the head of the change request, which keeps it from being removed by
+	// the GC until the schedule ran
+	HeadID *int64 `db:"head_id"`
+	// the change request to publish, which is checked to be approved and
+	// to still apply when the schedule runs
+	ChangeRequestID *int64 `db:"change_request_id"`
+	// the route to expire
+	Route string
+	RunAt *orm.Time
+	// the commit that was created when running the action
+	CommitID       *int64 `db:"commit_id"`
+	Status         string
+	Error          string
+	AuthorSource   string
+	AuthorSourceID []byte
+	AuthorEMail    string `db:"col:author_email"`
+	AuthorName     string
+}
+
+func (s *Schedule) Save() error {
+	return orm.Save(s)
+}
+
+func (s *Schedule) ByExtID(id []byte) error {
+	return orm.LoadOne(s, map[string]any{"ext_id": id})
+}
+
+func (s *Schedule) ByID(id int64) error {
+	return orm.LoadOne(s, map[string]any{"id": id})
+}
+
+// sets the author fields from a user profile
+func (s *Schedule) SetAuthor(author auth.UserProfile) {
+	if author == nil {
+		return
+	}
+	s.AuthorSource = author.Source()
+	s.AuthorSourceID = author.SourceID()
+	s.AuthorEMail = author.EMail()
+	s.AuthorName = author.DisplayName()
+}
+
+// returns true if the given user created the schedule
+func (s *Schedule) IsAuthor(user auth.UserProfile) bool {
+	if user == nil {
+		return false
+	}
+	return s.AuthorSource == user.Source() && s.AuthorEMail == user.EMail() && bytes.Equal(s.AuthorSourceID, user.SourceID())
+}
+
+// CanManageSchedules returns true if the user can schedule changes of the
+// published version that don't go through a change request, and cancel the
+// schedules of other users
+func CanManageSchedules(user auth.UserProfile) bool {
+	return auth.HasRole(user, auth.ReviewerRole) || auth.HasRole(user, auth.AdminRole)
+}
+
+// CanCancel returns true if the user created the schedule or can manage
+// schedules
+func (s *Schedule) CanCancel(user auth.UserProfile) bool {
+	return s.IsAuthor(user) || CanManageSchedules(user)
+}
+
+// Schedules returns the schedules of the site
+func (s *Site) Schedules(db func() orm.DB) ([]*Schedule, error) {
+	return orm.Objects[Schedule](db, map[string]any{"site_id": s.ID})
+}
+
+func (s *Site) schedule(db func() orm.DB, schedule *Schedule, at time.Time, author auth.UserProfile) (*Schedule, error) {
+
+	orm.Init(schedule, db)
+
+	schedule.SiteID = s.ID
+	schedule.Status = SchedulePending
+	schedule.RunAt = &orm.Time{Time: at.UTC()}
+	schedule.SetAuthor(author)
+
+	if err := schedule.Save(); err != nil {
+		return nil, fmt.Errorf("cannot save schedule: %v", err)
+	}
+
+	return schedule, nil
+}
+
+// ScheduleChangeRequest publishes the given change request at the given time.
+// The change request has to be approved until then.
+func (s *Site) ScheduleChangeRequest(db func() orm.DB, changeRequest *ChangeRequest, at time.Time, author auth.UserProfile) (*Schedule, error) {
+
+	if changeRequest.SiteID != s.ID {
+		return nil, fmt.Errorf("the change request belongs to another site")
+	}
+
+	return s.schedule(db, &Schedule{Action: SchedulePublish, ChangeRequestID: &changeRequest.ID, HeadID: &changeRequest.HeadID}, at, author)
+}
+
+// ScheduleRouteExpiry removes the route with the given path from the site
+// at the given time. As this changes the published version without a change
+// request, only reviewers and admins can schedule it.
+func (s *Site) ScheduleRouteExpiry(db func() orm.DB, route string, at time.Time, author auth.UserProfile) (*Schedule, error) {
+
+	if !CanManageSchedules(author) {
+		return nil, fmt.Errorf("only reviewers can schedule route expiries")
+	}
+
+	if route == "" {
+		return nil, fmt.Errorf("please specify a route")
+	}
+
+	return s.schedule(db, &Schedule{Action: ScheduleExpireRoute, Route: route}, at, author)
+}
+
+// Cancel cancels a pending schedule. Only its author, reviewers and admins
+// can cancel it.
+func (s *Schedule) Cancel(db func() orm.DB, user auth.UserProfile) error {
+
+	if !s.CanCancel(user) {
+		return fmt.Errorf("only the author or a reviewer can cancel the schedule")
+	}
+
+	claimed, err := s.claim(db, ScheduleCancelled)
+
+	if err != nil {
+		return err
+	}
+
+	if !claimed {
+		return fmt.Errorf("the schedule isn't pending anymore")
+	}
+
+	return nil
+}
+
+// changes the status of a pending schedule, which makes sure that only one
+// process runs it
+func (s *Schedule) claim(db func() orm.DB, status string) (bool, error) {
+
+	rows, err := db().Query(`UPDATE schedule SET status = $1, updated_at = $2 WHERE id = $3 AND status = $4 RETURNING id`, status, time.Now().UTC(), s.ID, SchedulePending)
+
+	if err != nil {
+		return false, fmt.Errorf("cannot update schedule: %v", err)
+	}
+
+	claimed := rows.Next()
+	rows.Close()
+
+	if claimed {
+		s.Status = status
+	}
+
+	return claimed, nil
+}
+
+// runs the action of the schedule and returns the created commit
+func (s *Schedule) run(db func() orm.DB) (*Commit, error) {
+
+	site := orm.Init(&Site{}, db)
+
+	if err := site.ByID(s.SiteID); err != nil {
+		return nil, fmt.Errorf("cannot load site: %v", err)
+	}
+
+	switch s.Action {
+	case SchedulePublish:
+
+		// only reviewed changes are published
+		if s.ChangeRequestID == nil {
+			return nil, fmt.Errorf("nothing to publish")
+		}
+
+		changeRequest := orm.Init(&ChangeRequest{}, db)
+
+		if err := changeRequest.ByID(*s.ChangeRequestID); err != nil {
+			return nil, fmt.Errorf("cannot load change request: %v", err)
+		}
+
+		return changeRequest.Publish(db, site, nil)
+
+	case ScheduleExpireRoute:
+		return site.expireRoute(db, s.Route)
+	}
+
+	return nil, fmt.Errorf("unknown action '%s'", s.Action)
+}
+
+// a version of a ref without the expired route, which is saved but not
+// committed yet
+type routeRemoval struct {
+	refName string
+	// the head the route was removed from
+	headID int64
+	head   *Node
+}
+
+// removes all routes with the given path from the DOM of the given ref and
+// saves the result, returns nil if the ref doesn't contain the route
+func (s *Site) removeRoute(db func() orm.DB, refName, route string) (*routeRemoval, error) {
+
+	ref, err := s.Ref(db, refName)
+
+	if err == orm.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	node, err := MakeSQLStore(db).GetByID(ref.HeadID)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load '%s': %v", refName, err)
+	}
+
+	siteGraph, err := DeserializeType[SiteGraph](node)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot deserialize '%s': %v", refName, err)
+	}
+
+	if !removeRouteFromElement(&siteGraph.DOM, route) {
+		return nil, nil
+	}
+
+	newNode, err := Serialize(siteGraph)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := MakeSQLStore(db).PutTree(newNode); err != nil {
+		return nil, err
+	}
+
+	return &routeRemoval{refName: refName, headID: ref.HeadID, head: newNode}, nil
+}
+
+// removes the route from the draft and published versions of the site and
+// returns the published commit. We remove the route from the draft as well,
+// otherwise it would be published again with the next change. Both versions
+// are prepared before either ref is updated, and each ref is only updated if
+// its head didn't change in the meantime.
+func (s *Site) expireRoute(db func() orm.DB, route string) (*Commit, error) {
+
+	removals := make([]*routeRemoval, 0, 2)
+
+	for _, refName := range []string{DraftRef, PublishedRef} {
+
+		removal, err := s.removeRoute(db, refName, route)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot remove route from '%s': %v", refName, err)
+		}
+
+		if removal != nil {
+			removals = append(removals, removal)
+		}
+	}
+
+	var published *Commit
+	message := fmt.Sprintf("Expire route '%s'", route)
+
+	for i, removal := range removals {
+
+		commit, err := s.CompareAndCommitRef(db, removal.refName, &Node{ID: removal.headID}, removal.head, nil, message)
+
+		if err != nil {
+			if i > 0 {
+				// running the expiry again only updates the remaining refs
+				return nil, fmt.Errorf("the route was removed from '%s', but not from '%s': %v", removals[0].refName, removal.refName, err)
+			}
+			return nil, err
+		}
+
+		if removal.refName == PublishedRef {
+			published = commit
+		}
+	}
+
+	return published, nil
+}
+
+// removes all routes with the given path from the element and its
+// descendants and returns true if any route was removed
+func removeRouteFromElement(element *gospel.HTMLElement, route string) bool {
+
+	removed := false
+	children := make([]any, 0, len(element.Children))
+
+	for _, child := range element.Children {
+		switch c := child.(type) {
+		case *gospel.RouteConfig:
+			if c.Route == route {
+				removed = true
+				continue
+			}
+			if e, ok := c.Element.(*gospel.HTMLElement); ok && removeRouteFromElement(e, route) {
+				removed = true
+			}
+		case *gospel.HTMLElement:
+			if removeRouteFromElement(c, route) {
+				removed = true
+			}
+		}
+		children = append(children, child)
+	}
+
+	element.Children = children
+
+	return removed
+}
+
+// makes schedules pending again that are running for longer than the lease
+func requeueSchedules(db func() orm.DB, now time.Time) error {
+	if _, err := db().Exec(`UPDATE schedule SET status = $1, updated_at = $2 WHERE status = $3 AND COALESCE(updated_at, created_at) < $4`, SchedulePending, now.UTC(), ScheduleRunning, now.Add(-ScheduleLease).UTC()); err != nil {
+		return fmt.Errorf("cannot requeue schedules: %v", err)
+	}
+	return nil
+}
+
+// RunSchedules runs all pending schedules that are due and returns the
+// number of schedules that were run. Failed schedules aren't retried, but
+// schedules that are running for longer than ScheduleLease are run again.
+// If the audit log can't be written, the remaining schedules are still run
+// and the error is returned at the end.
+func RunSchedules(db func() orm.DB, now time.Time) (int, error) {
+
+	if err := requeueSchedules(db, now); err != nil {
+		return 0, err
+	}
+
+	rows, err := db().Query(`SELECT id FROM schedule WHERE status = $1 AND run_at <= $2 AND deleted_at IS NULL ORDER BY run_at, id`, SchedulePending, now.UTC())
+
+	if err != nil {
+		return 0, err
+	}
+
+	ids := make([]int64, 0)
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan error: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	rows.Close()
+
+	n := 0
+	var auditErr error
+
+	for _, id := range ids {
+
+		schedule := orm.Init(&Schedule{}, db)
+
+		if err := schedule.ByID(id); err != nil {
+			return n, err
+		}
+
+		// another process might have claimed the schedule in the meantime
+		if claimed, err := schedule.claim(db, ScheduleRunning); err != nil {
+			return n, err
+		} else if !claimed {
+			continue
+		}
+
+		n++
+
+		commit, err := schedule.run(db)
+
+		if err != nil {
+			schedule.Status = ScheduleFailed
+			schedule.Error = err.Error()
+		} else {
+			schedule.Status = ScheduleDone
+			if commit != nil {
+				schedule.CommitID = &commit.ID
+			}
+		}
+
+		if err := schedule.Save(); err != nil {
+			return n, fmt.Errorf("cannot update schedule: %v", err)
+		}
+
+		if err := audit.Log(db, nil, nil, audit.ScheduleRun, schedule.ExtID.Hex(), nil, map[string]any{"action": schedule.Action, "status": schedule.Status, "error": schedule.Error}); err != nil {
+			auditErr = fmt.Errorf("cannot write audit log: %v", err)
+		}
+	}
+
+	return n, auditErr
+}
+
+// Scheduler periodically runs due schedules in the background
+type Scheduler struct {
+	db       func() orm.DB
+	interval time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func MakeScheduler(db func() orm.DB, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		db:       db,
+		interval: interval,
+	}
+}
+
+// Start runs the scheduler until Stop is called. Schedules that became due
+// while the server wasn't running are run right away.
+func (s *Scheduler) Start() {
+
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+
+	go func() {
+
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+
+			if _, err := RunSchedules(s.db, time.Now()); err != nil {
+				fmt.Printf("Cannot run schedules: %v\n", err)
+			}
+
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the scheduler and waits until the current run is finished
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
@@ -0,0 +1,276 @@
+package models_test
+
+import (
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/auth"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+	"time"
+)
+
+func makeSiteGraph(routes ...string) *models.SiteGraph {
+
+	children := make([]any, 0, len(routes))
+
+	for _, route := range routes {
+		children = append(children, &gospel.RouteConfig{
+			Route:   route,
+			Element: &gospel.HTMLElement{Tag: "p"},
+		})
+	}
+
+	return &models.SiteGraph{
+		DOM: gospel.HTMLElement{Tag: "div", Children: children},
+	}
+}
+
+func headRoutes(t *testing.T, dbf func() orm.DB, headID int64) []string {
+
+	node, err := models.GetGraphByID(dbf, headID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	siteGraph, err := models.DeserializeType[models.SiteGraph](node)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := make([]string, 0)
+
+	for _, child := range siteGraph.DOM.Children {
+		if route, ok := child.(*gospel.RouteConfig); ok {
+			routes = append(routes, route.Route)
+		}
+	}
+
+	return routes
+}
+
+func TestSchedules(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	editor := makeUser("editor@example.com")
+	reviewer := makeUser("reviewer@example.com", auth.ReviewerRole)
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := make([]*models.Node, 0)
+
+	for _, routes := range [][]string{{"/", "/sale"}, {"/", "/sale", "/new"}} {
+
+		node, err := models.Serialize(makeSiteGraph(routes...))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := node.SaveTree(db); err != nil {
+			t.Fatal(err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if _, err := site.CommitHead(dbf, nodes[0], nil, "initial version"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CreateRef(dbf, models.DraftRef, models.PublishedRef); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CommitRef(dbf, models.DraftRef, nodes[1], editor, "new route"); err != nil {
+		t.Fatal(err)
+	}
+
+	changeRequest, err := site.ProposeChange(dbf, models.DraftRef, editor, "new route")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := changeRequest.Review(dbf, reviewer, models.ReviewApprove, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	publish, err := site.ScheduleChangeRequest(dbf, changeRequest, now.Add(time.Hour), editor)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// route expiries change the published version without a review
+	if _, err := site.ScheduleRouteExpiry(dbf, "/sale", now.Add(2*time.Hour), editor); err == nil {
+		t.Fatalf("expected an error as only reviewers can schedule route expiries")
+	}
+
+	expiry, err := site.ScheduleRouteExpiry(dbf, "/sale", now.Add(2*time.Hour), reviewer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, err := site.ScheduleRouteExpiry(dbf, "/", now.Add(time.Hour), reviewer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cancelled.Cancel(dbf, editor); err == nil {
+		t.Fatalf("expected an error as only the author or a reviewer can cancel the schedule")
+	}
+
+	if err := cancelled.Cancel(dbf, reviewer); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cancelled.Cancel(dbf, reviewer); err == nil {
+		t.Fatalf("expected an error as the schedule was already cancelled")
+	}
+
+	// nothing is due yet
+	if n, err := models.RunSchedules(dbf, now); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("expected no schedules to run, got %d", n)
+	}
+
+	if n, err := models.RunSchedules(dbf, now.Add(90*time.Minute)); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected one schedule to run, got %d", n)
+	}
+
+	if err := publish.ByID(publish.ID); err != nil {
+		t.Fatal(err)
+	} else if publish.Status != models.ScheduleDone || publish.CommitID == nil {
+		t.Fatalf("expected the publishing to be done, got '%s' (%s)", publish.Status, publish.Error)
+	}
+
+	if err := site.ByID(site.ID); err != nil {
+		t.Fatal(err)
+	} else if *site.HeadID != nodes[1].ID {
+		t.Fatalf("expected the new head to be published")
+	}
+
+	if n, err := models.RunSchedules(dbf, now.Add(3*time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected one schedule to run, got %d", n)
+	}
+
+	if err := expiry.ByID(expiry.ID); err != nil {
+		t.Fatal(err)
+	} else if expiry.Status != models.ScheduleDone {
+		t.Fatalf("expected the expiry to be done, got '%s' (%s)", expiry.Status, expiry.Error)
+	}
+
+	for _, refName := range []string{models.PublishedRef, models.DraftRef} {
+
+		ref, err := site.Ref(dbf, refName)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, route := range headRoutes(t, dbf, ref.HeadID) {
+			if route == "/sale" {
+				t.Fatalf("expected the route to be removed from '%s'", refName)
+			}
+		}
+	}
+
+	if err := site.ByID(site.ID); err != nil {
+		t.Fatal(err)
+	} else if routes := headRoutes(t, dbf, *site.HeadID); len(routes) != 2 {
+		t.Fatalf("expected two routes to remain, got %v", routes)
+	}
+
+	// the cancelled schedule never runs
+	if n, err := models.RunSchedules(dbf, now.Add(4*time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("expected no schedules to run, got %d", n)
+	}
+
+	// heads are only published through change requests
+	rawHead := orm.Init(&models.Schedule{
+		SiteID: site.ID,
+		Action: models.SchedulePublish,
+		HeadID: &nodes[0].ID,
+		Status: models.SchedulePending,
+		RunAt:  &orm.Time{Time: now.UTC()},
+	}, dbf)
+
+	if err := rawHead.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := models.RunSchedules(dbf, now.Add(4*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rawHead.ByID(rawHead.ID); err != nil {
+		t.Fatal(err)
+	} else if rawHead.Status != models.ScheduleFailed {
+		t.Fatalf("expected publishing a head without change request to fail, got '%s'", rawHead.Status)
+	}
+
+	// the process crashed while the schedule was running
+	interrupted, err := site.ScheduleRouteExpiry(dbf, "/new", now, reviewer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`UPDATE schedule SET status = $1, updated_at = $2 WHERE id = $3`, models.ScheduleRunning, now.UTC(), interrupted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := models.RunSchedules(dbf, now.Add(5*time.Minute)); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("expected the running schedule to be left alone, got %d", n)
+	}
+
+	if n, err := models.RunSchedules(dbf, now.Add(models.ScheduleLease+time.Minute)); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected the interrupted schedule to run again, got %d", n)
+	}
+
+	if err := interrupted.ByID(interrupted.ID); err != nil {
+		t.Fatal(err)
+	} else if interrupted.Status != models.ScheduleDone {
+		t.Fatalf("expected the interrupted schedule to be done, got '%s' (%s)", interrupted.Status, interrupted.Error)
+	}
+}
@@ -6,6 +6,11 @@ import (
 	"sort"
 )
 
+// HashVersion is mixed into every node hash and needs to be increased
+// whenever the hash format changes. Existing graphs can then be migrated
+// using Rehash.
+const HashVersion = 1
+
 func Serialize(model any) (*Node, error) {
 
 	hash := MakeHash()
@@ -30,6 +35,12 @@ func Serialize(model any) (*Node, error) {
 		return nil, fmt.Errorf("unknown node type: %T", model)
 	}
 
+	// we include the hash version and the type name, so that different
+	// types with identical fields never produce the same hash
+	if err := hash.Add([]any{"version", HashVersion, "type", schema.Name}); err != nil {
+		return nil, fmt.Errorf("cannot add type hash: %v", err)
+	}
+
 	node := &Node{}
 	data := map[string]any{}
 
@@ -69,6 +80,13 @@ func Serialize(model any) (*Node, error) {
 			continue
 		}
 
+		if relatedSchema.Lazy {
+			if err := serializeReference(node, hash, relatedSchema, fieldValue); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		switch relatedSchema.Type {
 		case Struct:
 			// we might have an interface that points to a pointer that points to a struct
@@ -186,3 +204,42 @@ func Serialize(model any) (*Node, error) {
 
 	return node, nil
 }
+
+// adds a non-follow edge for a reference to the given node
+func serializeReference(node *Node, hash *Hash, relatedSchema *RelatedModelSchema, fieldValue reflect.Value) error {
+
+	for fieldValue.Kind() == reflect.Pointer {
+		fieldValue = fieldValue.Elem()
+	}
+
+	ref, ok := fieldValue.Interface().(reference)
+
+	if !ok {
+		return fmt.Errorf("%s: expected a reference", relatedSchema.Name)
+	}
+
+	var relatedNode *Node
+
+	if model := ref.referencedModel(); model != nil {
+		var err error
+		if relatedNode, err = Serialize(model); err != nil {
+			return fmt.Errorf("cannot serialize referenced model %s: %v", relatedSchema.Name, err)
+		}
+	} else if relatedNode = ref.referencedNode(); relatedNode == nil {
+		// this is an empty reference
+		return nil
+	}
+
+	edge := MakeEdge()
+	edge.Type = int(Struct)
+	edge.Name = relatedSchema.Name
+	// we don't follow references when loading the graph
+	edge.Follow = false
+	edge.FromTo(node, relatedNode)
+
+	if err := hash.Add([]any{"ref", edge.Type, "name", edge.Name, "hash", relatedNode.Hash}); err != nil {
+		return fmt.Errorf("cannot add reference hash: %v", err)
+	}
+
+	return nil
+}
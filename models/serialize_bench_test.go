@@ -185,6 +185,94 @@ func BenchmarkDeepTree(b *testing.B) {
 
 }
 
+// like BenchmarkDeepTree, but with batched inserts in a transaction
+func BenchmarkDeepTreeBatch(b *testing.B) {
+
+	if err := registerModels(); err != nil {
+		b.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	tag := &Tag{
+		Type:       "p",
+		Meta:       Meta{Language: "de"},
+		Attributes: []*Attribute{},
+		Children:   []*Tag{},
+	}
+
+	currentChild := tag
+
+	// we create a tree with a depth of 51 nodes
+	for i := 0; i < 50; i++ {
+		childTag := &Tag{
+			Type:       fmt.Sprintf("h%d", i),
+			Attributes: []*Attribute{},
+			Children:   []*Tag{},
+			Meta:       Meta{Language: "de"},
+		}
+		currentChild.Children = append(currentChild.Children, childTag)
+		currentChild = childTag
+	}
+
+	b.ResetTimer()
+	b.StopTimer()
+
+	for i := 0; i < b.N; i++ {
+
+		db, err := kt.DB(settings)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.StartTimer()
+
+		tx, err := db.Begin()
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		node, err := models.Serialize(tag)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		// we store the node a first time
+		if err := node.SaveTreeBatch(tx); err != nil {
+			b.Fatalf("cannot store node")
+		}
+
+		// we modify the innermost child
+		currentChild.Type = "foo"
+
+		newNode, err := models.Serialize(tag)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		// we store the node a first time
+		if err := newNode.SaveTreeBatch(tx); err != nil {
+			b.Fatalf("cannot store node")
+		}
+
+		if err := tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+
+	}
+
+}
+
 func BenchmarkDeepRead(b *testing.B) {
 
 	if err := registerModels(); err != nil {
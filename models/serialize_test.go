@@ -81,6 +81,43 @@ func registerModels() error {
 	return nil
 }
 
+// has the same fields as a label
+type Caption struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func TestTypeHash(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := models.Register[Caption]("caption"); err != nil {
+		t.Fatal(err)
+	}
+
+	label, err := models.Serialize(&Label{Name: "foo", Value: "bar"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caption, err := models.Serialize(&Caption{Name: "foo", Value: "bar"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(label.Data) != string(caption.Data) {
+		t.Fatalf("expected identical data")
+	}
+
+	if hex.EncodeToString(label.Hash) == hex.EncodeToString(caption.Hash) {
+		t.Fatalf("expected different hashes for different types")
+	}
+}
+
 type RoutesPlugin struct {
 	Prefix string `json:"prefix"`
 }
@@ -236,7 +273,7 @@ func TestSerialize(t *testing.T) {
 		t.Fatalf("data doesn't match: %s vs. %s", string(styleEdge.To.Data), expected)
 	}
 
-	h := "faf218cb19d48110fe8be0ac889d9d56056db79803d0f769ad68776d233e0901"
+	h := "c91dd38bc7e1bfbe1f9b1fe48a2e09ac518d59f87f693f039504f39ef34beb39"
 	if hex.EncodeToString(classEdge.To.Hash) != h {
 		t.Fatalf("invalid hash, expected '%s', got '%s'", h, hex.EncodeToString(classEdge.To.Hash))
 	}
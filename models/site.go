@@ -1,21 +1,29 @@
 package models
 
 import (
+	"fmt"
 	"github.com/gospel-sh/gospel"
 	"github.com/gospel-sh/gospel/orm"
+	"time"
 )
 
 type Site struct {
 	orm.DBModel `db:"table:project"`
 	orm.JSONModel
 	HeadID      *int64 `db:"head_id"`
+	Hash        []byte
+	CommitID    *int64 `db:"commit_id"`
 	Name        string
 	Hostname    string
 	Description string
 }
 
 func (c *Site) Save() error {
-	return orm.Save(c)
+	if err := orm.Save(c); err != nil {
+		return err
+	}
+	InvalidateSite(c)
+	return nil
 }
 
 func (c *Site) ByExtID(id []byte) error {
@@ -30,6 +38,88 @@ func (c *Site) ByHostname(hostname string) error {
 	return orm.LoadOne(c, map[string]any{"hostname": hostname})
 }
 
+// HeadHash returns the hash of the published version of the site
+func (s *Site) HeadHash(db func() orm.DB) ([]byte, error) {
+
+	if s.HeadID == nil {
+		return nil, fmt.Errorf("site doesn't have a head")
+	}
+
+	if s.Hash != nil {
+		return s.Hash, nil
+	}
+
+	return nodeHashByID(db(), *s.HeadID)
+}
+
+// updates only the name and description, so the head of the site isn't
+// overwritten with an outdated one
+func (s *Site) saveMetadata(db func() orm.DB) error {
+
+	if _, err := db().Exec(`UPDATE site SET name = $1, description = $2, updated_at = $3 WHERE id = $4`, s.Name, s.Description, time.Now().UTC(), s.ID); err != nil {
+		return fmt.Errorf("cannot save site: %v", err)
+	}
+
+	InvalidateSite(s)
+
+	return nil
+}
+
+// removes a newly created site with its refs and commits if it couldn't be
+// committed, so the hostname can be used again, and returns the error that
+// caused the failure
+func (s *Site) removeCreated(db func() orm.DB, cause error) error {
+
+	tx, err := db().Begin()
+
+	if err != nil {
+		return fmt.Errorf("cannot remove site: %v (after: %v)", err, cause)
+	}
+
+	for _, query := range []string{
+		`UPDATE site SET head_id = NULL, hash = NULL, commit_id = NULL WHERE id = $1`,
+		`DELETE FROM site_ref WHERE site_id = $1`,
+		`DELETE FROM "commit" WHERE site_id = $1`,
+		`DELETE FROM site WHERE id = $1`,
+	} {
+		if _, err := tx.Exec(query, s.ID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("cannot remove site: %v (after: %v)", err, cause)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot remove site: %v (after: %v)", err, cause)
+	}
+
+	InvalidateSite(s)
+
+	return cause
+}
+
+// LoadMeta loads only the metadata of the current site graph, which is a
+// lot cheaper than loading the entire graph.
+func (s *Site) LoadMeta(db func() orm.DB) (*SiteMeta, error) {
+
+	if s.HeadID == nil {
+		return nil, fmt.Errorf("site doesn't have a head")
+	}
+
+	node, err := GetGraph(db, *s.HeadID, &LoadOptions{Include: []string{"meta"}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	edges := node.Outgoing.FilterByName("meta")
+
+	if len(edges) != 1 {
+		return nil, fmt.Errorf("expected exactly one meta edge, got %d", len(edges))
+	}
+
+	return DeserializeType[SiteMeta](edges[0].To)
+}
+
 type SitePlugin interface {
 }
 
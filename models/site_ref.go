@@ -0,0 +1,431 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/demakes/demake/auth"
+	"github.com/gospel-sh/gospel/orm"
+	"regexp"
+	"time"
+)
+
+const (
+	// the ref that the editor writes to
+	DraftRef = "draft"
+	// the ref that is served on the hostname of the site
+	PublishedRef = "published"
+)
+
+var refNameRegexp = regexp.MustCompile(`^[a-z0-9\-_]+$`)
+
+// A named ref points to a version of a site, e.g. its draft or published
+// version. Each ref has its own history of commits.
+type SiteRef struct {
+	orm.DBModel
+	orm.JSONModel
+	SiteID   int64
+	Name     string
+	HeadID   int64
+	Hash     []byte
+	CommitID *int64 `db:"commit_id"`
+}
+
+func (r *SiteRef) Save() error {
+	return orm.Save(r)
+}
+
+func (r *SiteRef) ByID(id int64) error {
+	return orm.LoadOne(r, map[string]any{"id": id})
+}
+
+// Ref returns the ref with the given name, or orm.NotFound
+func (s *Site) Ref(db func() orm.DB, name string) (*SiteRef, error) {
+
+	ref := orm.Init(&SiteRef{}, db)
+
+	if err := orm.LoadOne(ref, map[string]any{"site_id": s.ID, "name": name}); err != nil {
+		return nil, err
+	}
+
+	return ref, nil
+}
+
+func (s *Site) Refs(db func() orm.DB) ([]*SiteRef, error) {
+	return orm.Objects[SiteRef](db, map[string]any{"site_id": s.ID})
+}
+
+// Draft returns the draft ref of the site, creating it from the published
+// version if it doesn't exist yet.
+func (s *Site) Draft(db func() orm.DB) (*SiteRef, error) {
+
+	ref, err := s.Ref(db, DraftRef)
+
+	if err == orm.NotFound {
+		return s.CreateRef(db, DraftRef, PublishedRef)
+	}
+
+	return ref, err
+}
+
+// CreateRef creates a new ref that points to the same version as an
+// existing one.
+func (s *Site) CreateRef(db func() orm.DB, name, from string) (*SiteRef, error) {
+
+	if !refNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid ref name '%s'", name)
+	}
+
+	if _, err := s.Ref(db, name); err == nil {
+		return nil, fmt.Errorf("ref '%s' already exists", name)
+	} else if err != orm.NotFound {
+		return nil, err
+	}
+
+	var headID int64
+	var hash []byte
+	var commitID *int64
+	var err error
+
+	if from == PublishedRef && s.HeadID != nil {
+		// the published ref might not exist yet for older sites
+		headID, commitID = *s.HeadID, s.CommitID
+		if hash, err = s.HeadHash(db); err != nil {
+			return nil, fmt.Errorf("cannot load head: %v", err)
+		}
+	} else if fromRef, err := s.Ref(db, from); err != nil {
+		return nil, fmt.Errorf("cannot load ref '%s': %v", from, err)
+	} else {
+		headID, commitID = fromRef.HeadID, fromRef.CommitID
+		if hash, err = fromRef.HeadHash(db); err != nil {
+			return nil, fmt.Errorf("cannot load head: %v", err)
+		}
+	}
+
+	ref := orm.Init(&SiteRef{
+		SiteID:   s.ID,
+		Name:     name,
+		HeadID:   headID,
+		Hash:     hash,
+		CommitID: commitID,
+	}, db)
+
+	if err := ref.Save(); err != nil {
+		return nil, fmt.Errorf("cannot save ref: %v", err)
+	}
+
+	return ref, nil
+}
+
+// returned when a ref doesn't point to the expected head anymore, e.g.
+// because someone else committed to it in the meantime
+type HeadConflictError struct {
+	Ref string
+	// the head that the change was based on
+	Expected int64
+	// the current head of the ref (0 if it doesn't exist)
+	Actual int64
+}
+
+func (e *HeadConflictError) Error() string {
+	return fmt.Sprintf("ref '%s' points to %d instead of %d", e.Ref, e.Actual, e.Expected)
+}
+
+// updates the head and commit of a ref, but only if they haven't changed
+var updateRefQuery = `
+UPDATE
+	site_ref
+SET
+	head_id = $1,
+	hash = $2,
+	commit_id = $3,
+	updated_at = $4
+WHERE
+	id = $5 AND head_id = $6 AND COALESCE(commit_id, 0) = $7
+RETURNING
+	id
+`
+
+// points the site to the given head and commit, unlike Site.Save this doesn't
+// overwrite other fields with possibly stale values
+var updateSiteHeadQuery = `
+UPDATE
+	site
+SET
+	head_id = $1,
+	hash = $2,
+	commit_id = $3,
+	updated_at = $4
+WHERE
+	id = $5
+`
+
+// CommitRef records the given (already saved) node as a new commit on the
+// given ref, creating the ref if necessary. The head of the site always
+// mirrors the published ref, which is what is served on its hostname.
+func (s *Site) CommitRef(db func() orm.DB, name string, node *Node, author auth.UserProfile, message string) (*Commit, error) {
+
+	var err error
+
+	// without an expected head we only need to make sure that concurrent
+	// commits don't overwrite each other, so we simply try again
+	for i := 0; i < 3; i++ {
+
+		var commit *Commit
+
+		if commit, err = s.CompareAndCommitRef(db, name, nil, node, author, message); err == nil {
+			return commit, nil
+		} else if _, ok := err.(*HeadConflictError); !ok {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// CompareAndCommitRef works like CommitRef, but only succeeds if the ref
+// still points to the expected head, which is matched by its ID or (if the
+// ID is 0) its hash. Otherwise, a *HeadConflictError is returned. If the
+// expected head is nil, the current head of the ref is used.
+func (s *Site) CompareAndCommitRef(db func() orm.DB, name string, expected *Node, node *Node, author auth.UserProfile, message string) (*Commit, error) {
+
+	if s.ID == 0 {
+		return nil, fmt.Errorf("site needs to be saved first")
+	}
+
+	if node.ID == 0 {
+		return nil, fmt.Errorf("node needs to be saved first")
+	}
+
+	if !refNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid ref name '%s'", name)
+	}
+
+	ref, err := s.Ref(db, name)
+
+	if err == orm.NotFound {
+		if expected != nil {
+			return nil, &HeadConflictError{Ref: name, Expected: expected.ID}
+		}
+		ref = orm.Init(&SiteRef{SiteID: s.ID, Name: name}, db)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot load ref: %v", err)
+	}
+
+	if expected != nil {
+		if matches, err := ref.headMatches(db, expected); err != nil {
+			return nil, err
+		} else if !matches {
+			return nil, &HeadConflictError{Ref: name, Expected: expected.ID, Actual: ref.HeadID}
+		}
+	}
+
+	commit := orm.Init(&Commit{
+		SiteID:   s.ID,
+		ParentID: ref.CommitID,
+		HeadID:   node.ID,
+		Hash:     node.Hash,
+		Message:  message,
+	}, db)
+
+	commit.SetAuthor(author)
+
+	if err := commit.Save(); err != nil {
+		return nil, fmt.Errorf("cannot save commit: %v", err)
+	}
+
+	var site *Site
+
+	if name == PublishedRef {
+		// the site head is updated together with the ref
+		site = s
+	}
+
+	if ref.ID == 0 {
+		// this is a new ref
+		ref.HeadID = commit.HeadID
+		ref.Hash = commit.Hash
+		ref.CommitID = &commit.ID
+
+		if err := ref.Save(); err != nil {
+			return nil, fmt.Errorf("cannot create ref: %v", err)
+		}
+
+		if site != nil {
+			if err := site.setHead(db(), commit); err != nil {
+				return nil, err
+			}
+		}
+	} else if err := ref.compareAndSwap(db, commit, site); err != nil {
+		// the commit isn't part of any history, so we remove it again
+		if _, deleteErr := db().Exec(`DELETE FROM "commit" WHERE id = $1`, commit.ID); deleteErr != nil {
+			return nil, fmt.Errorf("cannot remove commit: %v (after: %v)", deleteErr, err)
+		}
+		return nil, err
+	}
+
+	if site != nil {
+		site.HeadID = &commit.HeadID
+		site.Hash = commit.Hash
+		site.CommitID = &commit.ID
+		InvalidateSite(site)
+	}
+
+	return commit, nil
+}
+
+// HeadHash returns the hash of the head of the ref, which (unlike the ID of
+// the head) is the same in all databases
+func (r *SiteRef) HeadHash(db func() orm.DB) ([]byte, error) {
+
+	if r.Hash != nil {
+		return r.Hash, nil
+	}
+
+	return nodeHashByID(db(), r.HeadID)
+}
+
+func (r *SiteRef) headMatches(db func() orm.DB, expected *Node) (bool, error) {
+
+	if expected.ID != 0 {
+		return r.HeadID == expected.ID, nil
+	}
+
+	hash, err := r.HeadHash(db)
+
+	if err != nil {
+		return false, fmt.Errorf("cannot load head: %v", err)
+	}
+
+	return bytes.Equal(hash, expected.Hash), nil
+}
+
+// points the site to the head of the given commit
+func (s *Site) setHead(db orm.Transaction, commit *Commit) error {
+	if _, err := db.Exec(updateSiteHeadQuery, commit.HeadID, commit.Hash, commit.ID, time.Now().UTC(), s.ID); err != nil {
+		return fmt.Errorf("cannot update site head: %v", err)
+	}
+	return nil
+}
+
+// points the ref to the given commit if it hasn't changed since it was
+// loaded. If a site is given, its head is updated in the same transaction.
+func (r *SiteRef) compareAndSwap(db func() orm.DB, commit *Commit, site *Site) error {
+
+	var commitID int64
+
+	if r.CommitID != nil {
+		commitID = *r.CommitID
+	}
+
+	tx, err := db().Begin()
+
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(updateRefQuery, commit.HeadID, commit.Hash, commit.ID, time.Now().UTC(), r.ID, r.HeadID, commitID)
+
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("cannot update ref: %v", err)
+	}
+
+	updated := rows.Next()
+	rows.Close()
+
+	if !updated {
+
+		tx.Rollback()
+
+		// someone else updated the ref in the meantime
+		current := orm.Init(&SiteRef{}, db)
+
+		if err := current.ByID(r.ID); err != nil {
+			return fmt.Errorf("cannot reload ref: %v", err)
+		}
+
+		return &HeadConflictError{Ref: r.Name, Expected: r.HeadID, Actual: current.HeadID}
+	}
+
+	if site != nil {
+		if err := site.setHead(tx, commit); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r.HeadID = commit.HeadID
+	r.Hash = commit.Hash
+	r.CommitID = &commit.ID
+
+	return nil
+}
+
+// PromoteRef makes the version of one ref the version of another one, e.g.
+// to publish the draft of a site. This creates a new commit on the target.
+func (s *Site) PromoteRef(db func() orm.DB, from, to string, author auth.UserProfile) (*Commit, error) {
+
+	fromRef, err := s.Ref(db, from)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load ref '%s': %v", from, err)
+	}
+
+	var expected *Node
+
+	if toRef, err := s.Ref(db, to); err == nil {
+		if toRef.HeadID == fromRef.HeadID {
+			return nil, fmt.Errorf("'%s' is already up to date", to)
+		}
+		expected = &Node{ID: toRef.HeadID}
+	} else if err != orm.NotFound {
+		return nil, err
+	}
+
+	hash, err := fromRef.HeadHash(db)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load head of '%s': %v", from, err)
+	}
+
+	node := &Node{
+		ID:   fromRef.HeadID,
+		Hash: hash,
+	}
+
+	return s.CompareAndCommitRef(db, to, expected, node, author, fmt.Sprintf("Promote '%s' to '%s'", from, to))
+}
+
+// RefHistory returns the commits of the given ref, starting with the latest one.
+func (s *Site) RefHistory(db func() orm.DB, name string) ([]*Commit, error) {
+
+	ref, err := s.Ref(db, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.historyFrom(db, ref.CommitID)
+}
+
+// RevertRef makes the version of the given commit the head of the given
+// ref again, by creating a new commit on top of the current one.
+func (s *Site) RevertRef(db func() orm.DB, name string, commit *Commit, author auth.UserProfile) (*Commit, error) {
+
+	if commit.SiteID != s.ID {
+		return nil, fmt.Errorf("commit doesn't belong to this site")
+	}
+
+	node := &Node{
+		ID:   commit.HeadID,
+		Hash: commit.Hash,
+	}
+
+	message := fmt.Sprintf("Revert to '%s'", commit.Message)
+
+	return s.CommitRef(db, name, node, author, message)
+}
@@ -0,0 +1,242 @@
+package models_test
+
+import (
+	"bytes"
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+func TestSiteRefs(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := make([]*models.Node, 0)
+
+	for _, tagType := range []string{"p", "h1", "h2"} {
+
+		node, err := models.Serialize(&Tag{Type: tagType, Meta: Meta{Language: "de"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := node.SaveTree(db); err != nil {
+			t.Fatal(err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if _, err := site.CommitHead(dbf, nodes[0], nil, "initial version"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CreateRef(dbf, models.DraftRef, models.PublishedRef); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range nodes[1:] {
+		if _, err := site.CommitRef(dbf, models.DraftRef, node, nil, node.Type); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if *site.HeadID != nodes[0].ID {
+		t.Fatalf("changes to the draft shouldn't be published")
+	}
+
+	draft, err := site.Draft(dbf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if draft.HeadID != nodes[2].ID {
+		t.Fatalf("expected the draft to point to the latest version")
+	}
+
+	if history, err := site.RefHistory(dbf, models.DraftRef); err != nil {
+		t.Fatal(err)
+	} else if len(history) != 3 {
+		t.Fatalf("expected 3 commits in the draft, got %d", len(history))
+	}
+
+	if _, err := site.PromoteRef(dbf, models.DraftRef, models.PublishedRef, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if *site.HeadID != nodes[2].ID {
+		t.Fatalf("expected the draft to be published")
+	}
+
+	if history, err := site.History(dbf); err != nil {
+		t.Fatal(err)
+	} else if len(history) != 2 {
+		t.Fatalf("expected 2 published commits, got %d", len(history))
+	}
+
+	if _, err := site.PromoteRef(dbf, models.DraftRef, models.PublishedRef, nil); err == nil {
+		t.Fatalf("expected an error as there is nothing to publish")
+	}
+
+	if _, err := site.CreateRef(dbf, "Invalid Name", models.DraftRef); err == nil {
+		t.Fatalf("expected an error for an invalid ref name")
+	}
+
+	if refs, err := site.Refs(dbf); err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 2 {
+		t.Fatalf("expected 2 refs, got %d", len(refs))
+	}
+
+	// publishing only updates the head, so it doesn't overwrite changes that
+	// were made to a stale copy of the site in the meantime
+	renamed := orm.Init(&models.Site{}, dbf)
+
+	if err := renamed.ByID(site.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	renamed.Name = "renamed"
+
+	if err := renamed.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := site.CommitHead(dbf, nodes[0], nil, "revert"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := renamed.ByID(site.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if renamed.Name != "renamed" || *renamed.HeadID != nodes[0].ID {
+		t.Fatalf("expected the renamed site to point to the new head")
+	}
+}
+
+func TestCompareAndCommitRef(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	site := orm.Init(&models.Site{Name: "test", Hostname: "test.example"}, dbf)
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := make([]*models.Node, 0)
+
+	for _, tagType := range []string{"p", "h1", "h2"} {
+
+		node, err := models.Serialize(&Tag{Type: tagType, Meta: Meta{Language: "de"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := node.SaveTree(db); err != nil {
+			t.Fatal(err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if _, err := site.CommitRef(dbf, models.DraftRef, nodes[0], nil, "initial version"); err != nil {
+		t.Fatal(err)
+	}
+
+	// two editors start from the same version, the first one saves...
+	if _, err := site.CompareAndCommitRef(dbf, models.DraftRef, &models.Node{ID: nodes[0].ID}, nodes[1], nil, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// ...so the second one gets a conflict
+	_, err = site.CompareAndCommitRef(dbf, models.DraftRef, &models.Node{ID: nodes[0].ID}, nodes[2], nil, "second")
+
+	conflict, ok := err.(*models.HeadConflictError)
+
+	if !ok {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+
+	if conflict.Expected != nodes[0].ID || conflict.Actual != nodes[1].ID {
+		t.Fatalf("unexpected conflict: %v", conflict)
+	}
+
+	// the expected head can also be given by its hash
+	if _, err := site.CompareAndCommitRef(dbf, models.DraftRef, &models.Node{Hash: nodes[1].Hash}, nodes[2], nil, "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	if history, err := site.RefHistory(dbf, models.DraftRef); err != nil {
+		t.Fatal(err)
+	} else if len(history) != 3 {
+		t.Fatalf("expected 3 commits in the draft, got %d", len(history))
+	}
+
+	// the hash of the head is stored together with it
+	if ref, err := site.Ref(dbf, models.DraftRef); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(ref.Hash, nodes[2].Hash) {
+		t.Fatalf("expected the ref to store the hash of its head")
+	}
+
+	if _, err := site.CommitRef(dbf, models.PublishedRef, nodes[2], nil, "publish"); err != nil {
+		t.Fatal(err)
+	}
+
+	loadedSite := orm.Init(&models.Site{}, dbf)
+
+	if err := loadedSite.ByID(site.ID); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(loadedSite.Hash, nodes[2].Hash) {
+		t.Fatalf("expected the site to store the hash of its head")
+	}
+
+	if _, err := site.CompareAndCommitRef(dbf, "missing", &models.Node{ID: nodes[0].ID}, nodes[2], nil, ""); err == nil {
+		t.Fatalf("expected a conflict for a missing ref")
+	}
+}
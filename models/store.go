@@ -0,0 +1,141 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gospel-sh/gospel/orm"
+)
+
+var ErrNodeNotFound = errors.New("not found")
+
+// returned when deleting a node that is still used by another node or head
+var ErrNodeInUse = errors.New("node is still in use")
+
+// GraphStore is a backend that stores graphs of content-addressed nodes.
+type GraphStore interface {
+	// saves the node and all its descendants and sets their IDs
+	PutTree(node *Node) error
+	// returns the graph starting at the node with the given ID
+	GetByID(id int64) (*Node, error)
+	// returns the graph starting at the node with the given hash
+	GetByHash(hash []byte) (*Node, error)
+	// checks if a node with the given hash exists
+	Exists(hash []byte) (bool, error)
+	// deletes the node with the given ID and its outgoing edges, descendants
+	// are kept as they might be shared with other graphs. The SQL store
+	// returns ErrNodeInUse for nodes that are the target of an edge or a head.
+	Delete(id int64) error
+}
+
+// SQLStore stores graphs in the 'node' and 'edge' tables of a database.
+type SQLStore struct {
+	db func() orm.DB
+}
+
+func MakeSQLStore(db func() orm.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (s *SQLStore) PutTree(node *Node) error {
+
+	tx, err := s.db().Begin()
+
+	if err != nil {
+		return err
+	}
+
+	if err := node.SaveTreeBatch(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) GetByID(id int64) (*Node, error) {
+	return GetGraphByID(s.db, id)
+}
+
+func (s *SQLStore) nodeID(hash []byte) (int64, error) {
+	return nodeIDByHash(s.db(), hash)
+}
+
+func (s *SQLStore) GetByHash(hash []byte) (*Node, error) {
+
+	id, err := s.nodeID(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetByID(id)
+}
+
+func (s *SQLStore) Exists(hash []byte) (bool, error) {
+
+	if _, err := s.nodeID(hash); err == ErrNodeNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// returns how often the node is used by edges or as a head
+var nodeUsesQuery = `
+SELECT
+	COUNT(*)
+FROM (
+	SELECT to_id AS id FROM edge WHERE to_id = $1 AND deleted_at IS NULL
+	UNION ALL
+	SELECT head_id AS id FROM site WHERE head_id = $1
+	UNION ALL
+	SELECT head_id AS id FROM "commit" WHERE head_id = $1
+	UNION ALL
+	SELECT head_id AS id FROM site_ref WHERE head_id = $1
+	UNION ALL
+	SELECT head_id AS id FROM change_request WHERE head_id = $1 OR base_id = $1
+	UNION ALL
+	SELECT head_id AS id FROM schedule WHERE head_id = $1
+) AS uses
+`
+
+// checks within the transaction that the node exists and isn't used
+func checkUnused(tx orm.Transaction, ids []int64) ([]int64, error) {
+
+	for _, id := range ids {
+
+		if _, err := nodeHashByID(tx, id); err != nil {
+			return nil, err
+		}
+
+		rows, err := tx.Query(nodeUsesQuery, id)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot check if the node is used: %v", err)
+		}
+
+		var uses int
+
+		if rows.Next() {
+			if err := rows.Scan(&uses); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("scan error: %v", err)
+			}
+		}
+
+		rows.Close()
+
+		if uses > 0 {
+			return nil, ErrNodeInUse
+		}
+	}
+
+	return ids, nil
+}
+
+func (s *SQLStore) Delete(id int64) error {
+	_, _, err := sweep(s.db, []int64{id}, &GCOptions{}, checkUnused)
+	return err
+}
@@ -0,0 +1,200 @@
+package models_test
+
+import (
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+func testGraphStore(t *testing.T, store models.GraphStore) {
+
+	node, err := models.Serialize(makeDiffTag())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, err := store.Exists(node.Hash); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatalf("node shouldn't exist yet")
+	}
+
+	if err := store.PutTree(node); err != nil {
+		t.Fatal(err)
+	}
+
+	if node.ID == 0 {
+		t.Fatalf("expected the node to have an ID")
+	}
+
+	if exists, err := store.Exists(node.Hash); err != nil {
+		t.Fatal(err)
+	} else if !exists {
+		t.Fatalf("node should exist")
+	}
+
+	byID, err := store.GetByID(node.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changes := models.Diff(node, byID); len(changes) != 0 {
+		t.Fatalf("loaded graph doesn't match, %d changes", len(changes))
+	}
+
+	byHash, err := store.GetByHash(node.Hash)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if byHash.ID != node.ID {
+		t.Fatalf("expected ID %d, got %d", node.ID, byHash.ID)
+	}
+
+	tag, err := models.DeserializeType[Tag](byHash)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tag.Attributes[0].Labels["test"].Value != "bar" {
+		t.Fatalf("unexpected label value")
+	}
+
+	// saving the same tree again should return the same ID
+	again, err := models.Serialize(makeDiffTag())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutTree(again); err != nil {
+		t.Fatal(err)
+	}
+
+	if again.ID != node.ID {
+		t.Fatalf("expected the existing node to be reused")
+	}
+
+	if err := store.Delete(node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetByID(node.ID); err != models.ErrNodeNotFound {
+		t.Fatalf("expected the node to be deleted, got %v", err)
+	}
+
+	// the children are still there
+	if exists, err := store.Exists(node.Outgoing[0].To.Hash); err != nil {
+		t.Fatal(err)
+	} else if !exists {
+		t.Fatalf("children shouldn't be deleted")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	testGraphStore(t, models.MakeMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := t.TempDir()
+
+	store, err := models.MakeFileStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testGraphStore(t, store)
+
+	node, err := models.Serialize(&Tag{Type: "p", Meta: Meta{Language: "en"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutTree(node); err != nil {
+		t.Fatal(err)
+	}
+
+	// we reopen the store to make sure IDs are indexed again
+	if store, err = models.MakeFileStore(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded, err := store.GetByID(node.ID); err != nil {
+		t.Fatal(err)
+	} else if changes := models.Diff(node, loaded); len(changes) != 0 {
+		t.Fatalf("loaded graph doesn't match, %d changes", len(changes))
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+	store := models.MakeSQLStore(dbf)
+
+	testGraphStore(t, store)
+
+	node, err := models.Serialize(makeDiffTag())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutTree(node); err != nil {
+		t.Fatal(err)
+	}
+
+	// children of another node can't be deleted
+	if err := store.Delete(node.Outgoing[0].To.ID); err != models.ErrNodeInUse {
+		t.Fatalf("expected ErrNodeInUse, got %v", err)
+	}
+
+	// heads of sites can't be deleted either
+	site := orm.Init(&models.Site{Name: "store", Hostname: "store.example.com"}, dbf)
+	site.HeadID = &node.ID
+
+	if err := site.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(node.ID); err != models.ErrNodeInUse {
+		t.Fatalf("expected ErrNodeInUse, got %v", err)
+	}
+
+	if err := store.Delete(-1); err != models.ErrNodeNotFound {
+		t.Fatalf("expected ErrNodeNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,344 @@
+package models
+
+import (
+	"fmt"
+	"github.com/gospel-sh/gospel/orm"
+	"sort"
+)
+
+// collects the ancestors of the given node and prunes them to the nodes that
+// are reachable from the current heads of site refs, so that old versions in
+// the history of the refs are ignored. UNION removes duplicate rows, so every
+// node is visited once, no matter how many paths lead to it.
+var usageCTE = `
+WITH RECURSIVE
+	ancestors(id) AS (
+		SELECT
+			CAST($1 AS BIGINT)
+		UNION SELECT
+			edge.from_id
+		FROM
+			edge
+		JOIN
+			ancestors ON edge.to_id = ancestors.id
+		WHERE
+			edge.deleted_at IS NULL
+	),
+	reachable(id) AS (
+		SELECT
+			site_ref.head_id
+		FROM
+			site_ref
+		JOIN
+			ancestors ON ancestors.id = site_ref.head_id
+		WHERE
+			site_ref.deleted_at IS NULL
+		UNION SELECT
+			edge.to_id
+		FROM
+			edge
+		JOIN
+			reachable ON edge.from_id = reachable.id
+		JOIN
+			ancestors ON ancestors.id = edge.to_id
+		WHERE
+			edge.deleted_at IS NULL
+	)
+`
+
+// returns the refs whose head contains the given node
+var usageRefsQuery = usageCTE + `
+SELECT
+	site_ref.id
+FROM
+	site_ref
+JOIN
+	reachable ON reachable.id = site_ref.head_id
+WHERE
+	site_ref.deleted_at IS NULL
+ORDER BY
+	site_ref.site_id, site_ref.name
+`
+
+// returns the edges between the heads of the refs and the given node
+var usageEdgesQuery = usageCTE + `
+SELECT
+	edge.from_id,
+	edge.to_id,
+	edge.name,
+	edge.type,
+	edge.ind,
+	edge.key
+FROM
+	edge
+JOIN
+	reachable ON reachable.id = edge.from_id
+JOIN
+	ancestors ON ancestors.id = edge.to_id
+WHERE
+	edge.deleted_at IS NULL
+`
+
+// returns the nodes with an edge to the given node
+var parentsQuery = `
+SELECT
+	edge.id,
+	edge.name,
+	edge.key,
+	edge.ind,
+	edge.type,
+	node.id,
+	node.hash,
+	node.type
+FROM
+	edge
+JOIN
+	node ON node.id = edge.from_id AND node.deleted_at IS NULL
+WHERE
+	edge.to_id = $1 AND edge.deleted_at IS NULL
+ORDER BY
+	node.id, edge.name, edge.ind, edge.key
+`
+
+// A RefUsage is a ref of a site whose head contains a node
+type RefUsage struct {
+	Site *Site
+	Ref  *SiteRef
+	// the paths from the head to the node in the query syntax, e.g.
+	// 'dom/children[0]', the path of the head itself is empty
+	Paths []string
+}
+
+// NodeUsage describes where a node is used
+type NodeUsage struct {
+	// the incoming edges of the node, their source nodes are stubs
+	Parents Edges
+	// the refs that contain the node, only the current heads are considered
+	// and not the history of the refs
+	Refs []*RefUsage
+}
+
+// Sites returns the distinct sites that use the node
+func (u *NodeUsage) Sites() []*Site {
+
+	sites := make([]*Site, 0, len(u.Refs))
+	seen := map[int64]bool{}
+
+	for _, ref := range u.Refs {
+		if !seen[ref.Site.ID] {
+			seen[ref.Site.ID] = true
+			sites = append(sites, ref.Site)
+		}
+	}
+
+	return sites
+}
+
+func findParents(db func() orm.DB, node *Node) (Edges, error) {
+
+	rows, err := db().Query(parentsQuery, node.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	parents := make(Edges, 0)
+
+	for rows.Next() {
+
+		edge := MakeEdge()
+		parent := &Node{Stub: true}
+		var key *string
+		var index *int
+
+		if err := rows.Scan(&edge.ID, &edge.Name, &key, &index, &edge.Type, &parent.ID, &parent.Hash, &parent.Type); err != nil {
+			return nil, fmt.Errorf("scan error: %v", err)
+		}
+
+		if key != nil {
+			edge.Key = *key
+		}
+
+		if index != nil {
+			edge.Index = *index
+		}
+
+		edge.FromTo(parent, node)
+		parents = append(parents, edge)
+	}
+
+	return parents, nil
+}
+
+// returns the edges between the heads of the refs and the given node by the
+// ID of their source node
+func usageEdges(db func() orm.DB, node *Node) (map[int64]Edges, error) {
+
+	rows, err := db().Query(usageEdgesQuery, node.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	edges := map[int64]Edges{}
+
+	for rows.Next() {
+
+		edge := &Edge{}
+		var key *string
+		var index *int
+
+		if err := rows.Scan(&edge.FromID, &edge.ToID, &edge.Name, &edge.Type, &index, &key); err != nil {
+			return nil, fmt.Errorf("scan error: %v", err)
+		}
+
+		if key != nil {
+			edge.Key = *key
+		}
+
+		if index != nil {
+			edge.Index = *index
+		}
+
+		edges[edge.FromID] = append(edges[edge.FromID], edge)
+	}
+
+	return edges, nil
+}
+
+// returns the paths from the node with the given ID to the target node, the
+// paths of each node are only built once
+func usagePaths(id, targetID int64, edges map[int64]Edges, paths map[int64][]string) []string {
+
+	if id == targetID {
+		return []string{""}
+	}
+
+	if nodePaths, ok := paths[id]; ok {
+		return nodePaths
+	}
+
+	nodePaths := make([]string, 0)
+
+	for _, edge := range edges[id] {
+
+		segment := edgePath(edge.Name, edge.Type, edge.Index, edge.Key)
+
+		for _, path := range usagePaths(edge.ToID, targetID, edges, paths) {
+			if path == "" {
+				nodePaths = append(nodePaths, segment)
+			} else {
+				nodePaths = append(nodePaths, segment+"/"+path)
+			}
+		}
+	}
+
+	sort.Strings(nodePaths)
+	paths[id] = nodePaths
+
+	return nodePaths
+}
+
+func findRefs(db func() orm.DB, node *Node) ([]*RefUsage, error) {
+
+	rows, err := db().Query(usageRefsQuery, node.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	usages := make([]*RefUsage, 0)
+
+	for rows.Next() {
+
+		usage := &RefUsage{Ref: orm.Init(&SiteRef{}, db)}
+
+		if err := rows.Scan(&usage.Ref.ID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan error: %v", err)
+		}
+
+		usages = append(usages, usage)
+	}
+
+	rows.Close()
+
+	if len(usages) == 0 {
+		return usages, nil
+	}
+
+	edges, err := usageEdges(db, node)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load edges: %v", err)
+	}
+
+	sites := map[int64]*Site{}
+	paths := map[int64][]string{}
+
+	for _, usage := range usages {
+
+		if err := usage.Ref.ByID(usage.Ref.ID); err != nil {
+			return nil, fmt.Errorf("cannot load ref: %v", err)
+		}
+
+		usage.Paths = usagePaths(usage.Ref.HeadID, node.ID, edges, paths)
+
+		site, ok := sites[usage.Ref.SiteID]
+
+		if !ok {
+
+			site = orm.Init(&Site{}, db)
+
+			if err := site.ByID(usage.Ref.SiteID); err != nil {
+				return nil, fmt.Errorf("cannot load site: %v", err)
+			}
+
+			sites[site.ID] = site
+		}
+
+		usage.Site = site
+	}
+
+	return usages, nil
+}
+
+// FindUsage returns the nodes and site refs that use the given node (which
+// needs an ID or a hash), e.g. to see which sites are affected by changing a
+// shared component. The incoming edges of the node are set to its parents.
+func FindUsage(db func() orm.DB, node *Node) (*NodeUsage, error) {
+
+	if node.ID == 0 {
+
+		id, err := nodeIDByHash(db(), node.Hash)
+
+		if err != nil {
+			return nil, err
+		}
+
+		node.ID = id
+	}
+
+	node.Incoming = nil
+
+	parents, err := findParents(db, node)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load parents: %v", err)
+	}
+
+	refs, err := findRefs(db, node)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load refs: %v", err)
+	}
+
+	return &NodeUsage{
+		Parents: parents,
+		Refs:    refs,
+	}, nil
+}
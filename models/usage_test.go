@@ -0,0 +1,139 @@
+package models_test
+
+import (
+	"github.com/demakes/demake"
+	"github.com/demakes/demake/models"
+	kt "github.com/demakes/demake/testing"
+	"github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+	"testing"
+)
+
+func TestFindUsage(t *testing.T) {
+
+	if err := registerModels(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := sites.LoadSettings()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kt.DB(settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbf := func() orm.DB { return db }
+
+	// both sites use the same paragraph element for their routes
+	for _, hostname := range []string{"a.example", "b.example"} {
+
+		site := orm.Init(&models.Site{Name: hostname, Hostname: hostname}, dbf)
+
+		if err := site.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		node, err := models.Serialize(makeSiteGraph("/", "/"+hostname))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := node.SaveTree(db); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := site.CommitHead(dbf, node, nil, "initial version"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := site.CreateRef(dbf, models.DraftRef, models.PublishedRef); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paragraph, err := models.Serialize(&gospel.HTMLElement{Tag: "p"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &models.Node{Hash: paragraph.Hash}
+
+	usage, err := models.FindUsage(dbf, node)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the paragraph is used by the routes, the '/' routes of both sites are
+	// identical and share a node
+	if len(usage.Parents) != 3 || len(node.Incoming) != 3 {
+		t.Fatalf("expected 3 parents, got %d", len(usage.Parents))
+	}
+
+	for _, edge := range usage.Parents {
+		if edge.To != node || !edge.From.Stub || edge.From.ID == 0 {
+			t.Fatalf("unexpected parent edge")
+		}
+	}
+
+	// the published and draft refs of both sites
+	if len(usage.Refs) != 4 {
+		t.Fatalf("expected 4 refs, got %d", len(usage.Refs))
+	}
+
+	if sites := usage.Sites(); len(sites) != 2 || sites[0].Hostname != "a.example" || sites[1].Hostname != "b.example" {
+		t.Fatalf("expected both sites")
+	}
+
+	for _, ref := range usage.Refs {
+		// the paragraph is used by both routes of a site
+		if len(ref.Paths) != 2 || ref.Paths[0] != "dom/children[0]/element" || ref.Paths[1] != "dom/children[1]/element" {
+			t.Fatalf("unexpected paths: %v", ref.Paths)
+		}
+	}
+
+	// the head of a site is used by its refs with an empty path
+	published, err := usage.Refs[0].Ref.HeadHash(dbf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headUsage, err := models.FindUsage(dbf, &models.Node{Hash: published})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(headUsage.Parents) != 0 || len(headUsage.Refs) != 2 || headUsage.Refs[0].Paths[0] != "" {
+		t.Fatalf("unexpected usage of the head")
+	}
+
+	// versions in the history of a ref aren't considered
+	empty, err := models.Serialize(makeSiteGraph())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := empty.SaveTree(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := usage.Refs[0].Site.CommitRef(dbf, models.DraftRef, empty, nil, "remove routes"); err != nil {
+		t.Fatal(err)
+	}
+
+	if usage, err := models.FindUsage(dbf, &models.Node{Hash: paragraph.Hash}); err != nil {
+		t.Fatal(err)
+	} else if len(usage.Refs) != 3 || len(usage.Parents) != 3 {
+		t.Fatalf("expected the old draft to be ignored, got %d refs", len(usage.Refs))
+	}
+}
@@ -12,6 +12,11 @@ type Settings struct {
 	Test     bool                  `json:"test"`
 	Database *orm.DatabaseSettings `json:"database"`
 	Auth     *AuthSettings         `json:"auth"`
+	// the secret for signing preview links, which are disabled if it is empty
+	PreviewSecret string `json:"previewSecret"`
+	// the addresses or networks of reverse proxies, whose X-Forwarded-For
+	// header is used to determine the IP of clients in the audit log
+	TrustedProxies []string `json:"trustedProxies"`
 }
 
 type AuthSettings struct {
@@ -0,0 +1,103 @@
+package ui
+
+import (
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/auth"
+	. "github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+	"time"
+)
+
+// shows the most recent entries of the audit log, filtered by actor,
+// action, target and date
+func AuditLog(c Context) Element {
+
+	db := func() orm.DB { return UseDB(c) }
+
+	if !auth.HasRole(UseUser(c), auth.AdminRole) {
+		return Div("Only admins can view the audit log.")
+	}
+
+	form := MakeFormData(c, "auditFilter", POST)
+	actor := form.Var("actor", "")
+	action := form.Var("action", "")
+	target := form.Var("target", "")
+	since := form.Var("since", "")
+	until := form.Var("until", "")
+	error := Var(c, "")
+
+	form.OnSubmit(func() {})
+
+	filter := &audit.Filter{
+		ActorEMail: actor.Get(),
+		Action:     action.Get(),
+		TargetID:   target.Get(),
+		Limit:      200,
+	}
+
+	if since.Get() != "" {
+		if t, err := time.Parse("2006-01-02", since.Get()); err != nil {
+			error.Set(Fmt("invalid date '%s'", since.Get()))
+		} else {
+			filter.Since = t
+		}
+	}
+
+	if until.Get() != "" {
+		if t, err := time.Parse("2006-01-02", until.Get()); err != nil {
+			error.Set(Fmt("invalid date '%s'", until.Get()))
+		} else {
+			// the date is inclusive, so we filter until the end of the day
+			filter.Until = t.Add(24 * time.Hour)
+		}
+	}
+
+	entries, err := audit.Entries(db, filter)
+
+	if err != nil {
+		return Div(Fmt("cannot load audit log: %v", err))
+	}
+
+	rows := make([]Element, len(entries))
+
+	for i, entry := range entries {
+		rows[i] = Tr(
+			Td(entry.CreatedAt.String()),
+			Td(entry.ActorEMail),
+			Td(entry.IP),
+			Td(entry.Action),
+			Td(entry.TargetID),
+			Td(entry.Before),
+			Td(entry.After),
+		)
+	}
+
+	return Div(
+		H2("Audit log"),
+		If(error.Get() != "", P(error.Get())),
+		form.Form(
+			Input(Placeholder("e-mail of the user"), Value(actor)),
+			Input(Placeholder("action, e.g. site.create"), Value(action)),
+			Input(Placeholder("target ID"), Value(target)),
+			Input(Placeholder("since (YYYY-MM-DD)"), Value(since)),
+			Input(Placeholder("until (YYYY-MM-DD)"), Value(until)),
+			Button(
+				Type("submit"),
+				"filter",
+			),
+		),
+		Table(
+			Tr(
+				Th("time"),
+				Th("user"),
+				Th("IP"),
+				Th("action"),
+				Th("target"),
+				Th("before"),
+				Th("after"),
+			),
+			rows,
+		),
+		P(Fmt("Showing up to %d entries, use 'demake audit export' to export the entire log.", filter.Limit)),
+	)
+}
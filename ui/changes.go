@@ -0,0 +1,239 @@
+package ui
+
+import (
+	"encoding/hex"
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/auth"
+	"github.com/demakes/demake/models"
+	. "github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+)
+
+// lists the change requests of a site
+func SiteChangeRequests(c Context, siteID string) Element {
+
+	db := func() orm.DB { return UseDB(c) }
+	router := UseRouter(c)
+
+	site, err := useSite(c, siteID)
+
+	if err != nil {
+		return Div(err.Error())
+	}
+
+	changeRequests, err := site.ChangeRequests(db)
+
+	if err != nil {
+		return Div(Fmt("cannot load change requests: %v", err))
+	}
+
+	items := make([]Element, len(changeRequests))
+
+	// we show the most recent change requests first
+	for i, changeRequest := range changeRequests {
+		items[len(changeRequests)-1-i] = Li(
+			A(
+				Href(router.URL(Fmt("/sites/changes/%s/%s", site.ExtID.Hex(), changeRequest.ExtID.Hex()))),
+				IfElse(changeRequest.Description != "", changeRequest.Description, "(no description)"),
+			),
+			" // ",
+			changeRequest.RefName,
+			" // ",
+			changeRequest.AuthorEMail,
+			" // ",
+			changeRequest.Status,
+		)
+	}
+
+	return Div(
+		H2(Fmt("Change requests of %s", site.Name)),
+		SiteRefs(c, site),
+		Ul(
+			items,
+		),
+		A(Href(router.URL(Fmt("/sites/edit/%s", site.ExtID.Hex()))), "back to editor"),
+	)
+}
+
+// shows a change request with its changes and reviews, and allows
+// reviewing and publishing it
+func SiteChangeRequest(c Context, siteID, changeRequestID string) Element {
+
+	db := func() orm.DB { return UseDB(c) }
+	router := UseRouter(c)
+	user := UseUser(c)
+	error := Var(c, "")
+
+	site, err := useSite(c, siteID)
+
+	if err != nil {
+		return Div(err.Error())
+	}
+
+	id, err := hex.DecodeString(changeRequestID)
+
+	if err != nil {
+		return Div("invalid change request ID")
+	}
+
+	changeRequest := orm.Init(&models.ChangeRequest{}, db)
+
+	if err := changeRequest.ByExtID(id); err != nil || changeRequest.SiteID != site.ID {
+		return Div("cannot find change request")
+	}
+
+	changes, err := changeRequest.Changes(db)
+
+	if err != nil {
+		return Div(Fmt("cannot load changes: %v", err))
+	}
+
+	reviews, err := changeRequest.Reviews(db)
+
+	if err != nil {
+		return Div(Fmt("cannot load reviews: %v", err))
+	}
+
+	path := Fmt("/sites/changes/%s/%s", site.ExtID.Hex(), changeRequest.ExtID.Hex())
+
+	reviewItems := make([]Element, len(reviews))
+
+	for i, review := range reviews {
+		reviewItems[i] = Li(
+			review.AuthorEMail,
+			" // ",
+			review.Action,
+			If(review.Message != "", F(": ", review.Message)),
+			" // ",
+			review.CreatedAt.String(),
+		)
+	}
+
+	// creates a form for reviewing the change request with the given action,
+	// only comments have a message
+	reviewForm := func(action, label string) Element {
+
+		form := MakeFormData(c, Fmt("review-%s", action), POST)
+		message := form.Var("message", "")
+
+		form.OnSubmit(func() {
+			status := changeRequest.Status
+			if _, err := changeRequest.Review(db, user, action, message.Get()); err != nil {
+				error.Set(Fmt("cannot review: %v", err))
+				return
+			}
+			if err := Audit(c, audit.ChangeReview, changeRequest.ExtID.Hex(), map[string]any{"status": status}, map[string]any{"status": changeRequest.Status, "action": action}); err != nil {
+				error.Set(err.Error())
+				return
+			}
+			router.RedirectTo(path)
+		})
+
+		if action != models.ReviewComment {
+			return form.Form(
+				Styles(Display("inline")),
+				Button(
+					Type("submit"),
+					label,
+				),
+			)
+		}
+
+		return form.Form(
+			Textarea(
+				Attrib("rows")("3"),
+				Placeholder("comment"),
+				Value(message),
+			),
+			Button(
+				Type("submit"),
+				label,
+			),
+		)
+	}
+
+	publishForm := MakeFormData(c, "publish", POST)
+
+	publishForm.OnSubmit(func() {
+		commit, err := changeRequest.Publish(db, site, user)
+		if err != nil {
+			if _, ok := err.(*models.HeadConflictError); ok {
+				error.Set("The published version changed since these changes were proposed, please propose them again.")
+				return
+			}
+			error.Set(Fmt("cannot publish: %v", err))
+			return
+		}
+		if err := Audit(c, audit.ChangePublish, changeRequest.ExtID.Hex(), nil, map[string]any{"site": site.ExtID.Hex(), "head": Hex(changeRequest.Hash), "commit": commit.ExtID.Hex()}); err != nil {
+			error.Set(err.Error())
+			return
+		}
+		router.RedirectTo(path)
+	})
+
+	scheduleForm := MakeFormData(c, "schedule", POST)
+	at := scheduleForm.Var("at", "")
+
+	scheduleForm.OnSubmit(func() {
+		runAt, err := parseScheduleTime(at.Get())
+		if err != nil {
+			error.Set(err.Error())
+			return
+		}
+		schedule, err := site.ScheduleChangeRequest(db, changeRequest, runAt, user)
+		if err != nil {
+			error.Set(Fmt("cannot schedule publishing: %v", err))
+			return
+		}
+		if err := Audit(c, audit.ScheduleCreate, schedule.ExtID.Hex(), nil, map[string]any{"site": site.ExtID.Hex(), "action": schedule.Action, "changeRequest": changeRequest.ExtID.Hex(), "runAt": schedule.RunAt.String()}); err != nil {
+			error.Set(err.Error())
+			return
+		}
+		router.RedirectTo(Fmt("/sites/schedules/%s", site.ExtID.Hex()))
+	})
+
+	canReview := changeRequest.Status == models.ChangeRequestOpen && auth.HasRole(user, auth.ReviewerRole) && !changeRequest.IsAuthor(user)
+
+	return Div(
+		H2(IfElse(changeRequest.Description != "", changeRequest.Description, "(no description)")),
+		P(
+			Fmt("Proposed by %s from '%s' // %s // ", changeRequest.AuthorEMail, changeRequest.RefName, changeRequest.CreatedAt.String()),
+			Strong(changeRequest.Status),
+		),
+		If(error.Get() != "", P(error.Get())),
+		PreviewLinks(c, site, Hex(changeRequest.Hash)),
+		H3("Changes"),
+		DiffView(changes),
+		H3("Reviews"),
+		Ul(
+			reviewItems,
+		),
+		reviewForm(models.ReviewComment, "comment"),
+		If(
+			canReview,
+			F(
+				reviewForm(models.ReviewApprove, "approve"),
+				reviewForm(models.ReviewReject, "reject"),
+			),
+		),
+		If(
+			changeRequest.Status == models.ChangeRequestApproved,
+			F(
+				publishForm.Form(
+					Button(
+						Type("submit"),
+						"publish",
+					),
+				),
+				scheduleForm.Form(
+					Input(Placeholder("YYYY-MM-DD HH:MM (UTC)"), Value(at)),
+					Button(
+						Type("submit"),
+						"schedule publishing",
+					),
+				),
+			),
+		),
+		A(Href(router.URL(Fmt("/sites/changes/%s", site.ExtID.Hex()))), "back to change requests"),
+	)
+}
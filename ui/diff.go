@@ -0,0 +1,123 @@
+package ui
+
+import (
+	"github.com/demakes/demake/models"
+	. "github.com/gospel-sh/gospel"
+)
+
+func changeSymbol(change *models.Change) string {
+	switch change.Type {
+	case models.Added:
+		return "+"
+	case models.Removed:
+		return "-"
+	}
+	return "~"
+}
+
+func changeColor(change *models.Change) string {
+	switch change.Type {
+	case models.Added:
+		return "#3a3"
+	case models.Removed:
+		return "#a33"
+	}
+	return "#a73"
+}
+
+func nodeSummary(node *models.Node) string {
+	return Fmt("%s %s", node.Type, string(node.Data))
+}
+
+func DiffView(changes []*models.Change) Element {
+
+	if len(changes) == 0 {
+		return P("No changes.")
+	}
+
+	changeItems := make([]Element, len(changes))
+
+	for i, change := range changes {
+
+		path := change.Path
+
+		if path == "" {
+			path = "(root)"
+		}
+
+		var details any
+
+		switch change.Type {
+		case models.Added:
+			details = Code(nodeSummary(change.To))
+		case models.Removed:
+			details = Code(nodeSummary(change.From))
+		case models.Changed:
+			details = F(
+				Code(nodeSummary(change.From)),
+				" → ",
+				Code(nodeSummary(change.To)),
+			)
+		}
+
+		changeItems[i] = Li(
+			Styles(
+				Color(changeColor(change)),
+			),
+			Strong(changeSymbol(change), " ", path),
+			" ",
+			details,
+		)
+	}
+
+	return Ul(
+		Styles(
+			ListStyle("none"),
+			PaddingLeft(0),
+		),
+		changeItems,
+	)
+}
+
+func ConflictView(conflicts []*models.Conflict) Element {
+
+	if len(conflicts) == 0 {
+		return P("There were no conflicts.")
+	}
+
+	conflictItems := make([]Element, len(conflicts))
+
+	for i, conflict := range conflicts {
+
+		path := conflict.Path
+
+		if path == "" {
+			path = "(root)"
+		}
+
+		ours, theirs := "(removed)", "(removed)"
+
+		if conflict.Ours != nil {
+			ours = nodeSummary(conflict.Ours)
+		}
+
+		if conflict.Theirs != nil {
+			theirs = nodeSummary(conflict.Theirs)
+		}
+
+		conflictItems[i] = Li(
+			Strong(path),
+			" yours: ",
+			Code(ours),
+			" theirs: ",
+			Code(theirs),
+		)
+	}
+
+	return Div(
+		P(Fmt("%d conflict(s), your version was kept:", len(conflicts))),
+		Ul(
+			conflictItems,
+		),
+	)
+}
@@ -3,12 +3,18 @@ package ui
 import (
 	"encoding/hex"
 	"fmt"
+	"github.com/demakes/demake/audit"
 	"github.com/demakes/demake/models"
 	. "github.com/gospel-sh/gospel"
 	"github.com/gospel-sh/gospel/orm"
+	"strconv"
 )
 
 func EditSite(c Context, siteID string) Element {
+	return EditSiteRef(c, siteID, models.DraftRef)
+}
+
+func EditSiteRef(c Context, siteID, refName string) Element {
 
 	id, err := hex.DecodeString(siteID)
 	db := UseDB(c)
@@ -29,21 +35,44 @@ func EditSite(c Context, siteID string) Element {
 		return Div("cannot find site")
 	}
 
-	siteGraph, err := GetGraph(site, dbf)
+	if refName == models.PublishedRef {
+		return Div("The published version can't be edited directly, please edit the draft and publish it.")
+	}
+
+	var ref *models.SiteRef
+
+	if refName == models.DraftRef {
+		ref, err = site.Draft(dbf)
+	} else {
+		ref, err = site.Ref(dbf, refName)
+	}
+
+	if err != nil {
+		return Div(Fmt("Cannot load ref '%s': %v", refName, err))
+	}
+
+	siteGraph, err := GetGraph(ref.HeadID, dbf)
 
 	if err != nil {
 		return Div(Fmt("Cannot load site: %v", err))
 	}
 
-	return SiteEditor(c, site, siteGraph, dbf)
+	return SiteEditor(c, site, ref, siteGraph, dbf)
 }
 
-func SiteEditor(c Context, site *models.Site, siteGraph *models.SiteGraph, dbf func() orm.DB) Element {
+func SiteEditor(c Context, site *models.Site, ref *models.SiteRef, siteGraph *models.SiteGraph, dbf func() orm.DB) Element {
 
 	form := MakeFormData(c, "editor", POST)
 	source := form.Var("source", siteGraph.DOM.RenderCode())
+	message := form.Var("message", "")
+	// the hash of the reviewed version, saving requires a review first
+	reviewed := form.Var("reviewed", "")
+	// the ID of the head the changes are based on
+	base := form.Var("base", Fmt("%d", ref.HeadID))
 	router := UseRouter(c)
 	error := Var(c, "")
+	changes := Var[[]*models.Change](c, nil)
+	conflicts := Var[[]*models.Conflict](c, nil)
 
 	onSubmit := func() {
 
@@ -63,6 +92,14 @@ func SiteEditor(c Context, site *models.Site, siteGraph *models.SiteGraph, dbf f
 			return
 		}
 
+		// we serialize the current version to compare it with the new one
+		currentNode, err := models.Serialize(siteGraph)
+
+		if err != nil {
+			error.Set(Fmt("cannot serialize current site: %v", err))
+			return
+		}
+
 		siteGraph.DOM = *element
 
 		node, err := models.Serialize(siteGraph)
@@ -72,16 +109,64 @@ func SiteEditor(c Context, site *models.Site, siteGraph *models.SiteGraph, dbf f
 			return
 		}
 
-		if err := node.SaveTree(dbf()); err != nil {
+		// someone else saved the site in the meantime, so we merge our
+		// changes with theirs and let the user review the result
+		merge := func(theirs *models.Node, headID int64) {
+
+			mergedGraph, mergedNode, mergeConflicts, err := mergeEditorChanges(dbf, base.Get(), node, theirs)
+
+			if err != nil {
+				error.Set(Fmt("cannot merge your changes: %v", err))
+				return
+			}
+
+			source.Set(mergedGraph.DOM.RenderCode())
+			base.Set(Fmt("%d", headID))
+			conflicts.Set(mergeConflicts)
+			changes.Set(models.Diff(theirs, mergedNode))
+			reviewed.Set(Hex(mergedNode.Hash))
+		}
+
+		if base.Get() != Fmt("%d", ref.HeadID) {
+			merge(currentNode, ref.HeadID)
+			return
+		}
+
+		if reviewed.Get() != Hex(node.Hash) {
+			// we show the changes before saving them
+			changes.Set(models.Diff(currentNode, node))
+			reviewed.Set(Hex(node.Hash))
+			return
+		}
+
+		if err := models.MakeSQLStore(dbf).PutTree(node); err != nil {
 			error.Set(Fmt("cannot save tree: %v", err))
 			return
 		}
 
-		site.HeadID = &node.ID
+		// we only commit if nobody else did so since we loaded the ref
+		if commit, err := site.CompareAndCommitRef(dbf, ref.Name, &models.Node{ID: ref.HeadID}, node, UseUser(c), message.Get()); err != nil {
+
+			if conflict, ok := err.(*models.HeadConflictError); ok {
 
-		if err := site.Save(); err != nil {
-			error.Set("cannot save site")
+				theirs, err := models.MakeSQLStore(dbf).GetByID(conflict.Actual)
+
+				if err != nil {
+					error.Set(Fmt("cannot load the current version: %v", err))
+					return
+				}
+
+				merge(theirs, conflict.Actual)
+				return
+			}
+
+			error.Set(Fmt("cannot commit: %v", err))
 			return
+		} else {
+			if err := Audit(c, audit.RefCommit, site.ExtID.Hex(), map[string]any{"ref": ref.Name, "head": Hex(currentNode.Hash)}, map[string]any{"ref": ref.Name, "head": Hex(node.Hash), "commit": commit.ExtID.Hex()}); err != nil {
+				error.Set(err.Error())
+				return
+			}
 		}
 
 		fmt.Println(router.CurrentPath())
@@ -93,15 +178,74 @@ func SiteEditor(c Context, site *models.Site, siteGraph *models.SiteGraph, dbf f
 	form.OnSubmit(onSubmit)
 
 	return form.Form(
+		P(Fmt("Editing '%s'", ref.Name)),
 		If(error.Get() != "", P(error.Get())),
+		If(
+			conflicts.Get() != nil,
+			Div(
+				P("Someone else saved this site in the meantime, their changes were merged with yours."),
+				ConflictView(conflicts.Get()),
+			),
+		),
+		If(
+			changes.Get() != nil,
+			Div(
+				H3("Review your changes"),
+				DiffView(changes.Get()),
+			),
+		),
+		Input(
+			Type("hidden"),
+			Value(reviewed),
+		),
+		Input(
+			Type("hidden"),
+			Value(base),
+		),
 		Textarea(
 			Attrib("rows")("20"),
 			Styles(Width(Px(600))),
 			Value(source),
 		),
+		Input(
+			Placeholder("describe your change"),
+			Value(message),
+		),
 		Button(
 			Type("submit"),
-			"Update",
+			IfElse(changes.Get() != nil, "Save", "Review changes"),
 		),
+		A(Href(router.URL(Fmt("/sites/history/%s/ref/%s", site.ExtID.Hex(), ref.Name))), "history"),
 	)
 }
+
+// merges the changes of the user with the ones that were saved since the
+// editor was opened, using the head the user started from as the ancestor
+func mergeEditorChanges(dbf func() orm.DB, baseID string, ours, theirs *models.Node) (*models.SiteGraph, *models.Node, []*models.Conflict, error) {
+
+	id, err := strconv.ParseInt(baseID, 10, 64)
+
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid base ID")
+	}
+
+	base, err := models.MakeSQLStore(dbf).GetByID(id)
+
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot load base version: %v", err)
+	}
+
+	merged, conflicts, err := models.Merge(base, ours, theirs)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	mergedGraph, err := models.DeserializeType[models.SiteGraph](merged)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return mergedGraph, merged, conflicts, nil
+}
@@ -0,0 +1,203 @@
+package ui
+
+import (
+	"fmt"
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/auth"
+	"github.com/demakes/demake/models"
+	. "github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+	"strconv"
+	"strings"
+)
+
+// parses variants in the form 'name version weight', one per line
+func parseVariants(value string) ([]*models.ExperimentVariant, error) {
+
+	variants := make([]*models.ExperimentVariant, 0)
+
+	for _, line := range strings.Split(value, "\n") {
+
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid variant '%s', expected 'name version weight'", line)
+		}
+
+		weight, err := strconv.Atoi(fields[2])
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight '%s'", fields[2])
+		}
+
+		variants = append(variants, &models.ExperimentVariant{
+			Name:    fields[0],
+			Version: fields[1],
+			Weight:  weight,
+		})
+	}
+
+	return variants, nil
+}
+
+// starts or stops the experiment and returns the audit action
+func toggleExperiment(db func() orm.DB, user auth.UserProfile, experiment *models.Experiment) (string, error) {
+
+	if experiment.Active {
+		return audit.ExperimentStop, experiment.Stop(db)
+	}
+
+	return audit.ExperimentStart, experiment.Start(db, user)
+}
+
+// shows the experiments of a site with their results
+func SiteExperiments(c Context, siteID string) Element {
+
+	db := func() orm.DB { return UseDB(c) }
+	router := UseRouter(c)
+	error := Var(c, "")
+
+	site, err := useSite(c, siteID)
+
+	if err != nil {
+		return Div(err.Error())
+	}
+
+	experiments, err := site.Experiments(db)
+
+	if err != nil {
+		return Div(Fmt("cannot load experiments: %v", err))
+	}
+
+	// only reviewers and admins can create and start experiments
+	canManage := models.CanManageExperiments(UseUser(c))
+
+	experimentItems := make([]Element, len(experiments))
+
+	for i, experiment := range experiments {
+
+		experiment := experiment
+
+		variants, err := experiment.Variants(db)
+
+		if err != nil {
+			return Div(Fmt("cannot load variants: %v", err))
+		}
+
+		var total int64
+
+		for _, variant := range variants {
+			total += variant.Exposures
+		}
+
+		variantItems := make([]Element, len(variants))
+
+		for j, variant := range variants {
+
+			share := 0.0
+
+			if total > 0 {
+				share = 100 * float64(variant.Exposures) / float64(total)
+			}
+
+			variantItems[j] = Li(
+				Fmt("%s (%s, weight %d): %d visitors (%.1f%%)", variant.Name, variant.Version, variant.Weight, variant.Exposures, share),
+			)
+		}
+
+		form := MakeFormData(c, Fmt("experiment-%s", experiment.ExtID.Hex()), POST)
+
+		form.OnSubmit(func() {
+
+			action, err := toggleExperiment(db, UseUser(c), experiment)
+
+			if err != nil {
+				error.Set(Fmt("cannot update experiment: %v", err))
+				return
+			}
+
+			if err := Audit(c, action, experiment.ExtID.Hex(), nil, map[string]any{"site": site.ExtID.Hex()}); err != nil {
+				error.Set(err.Error())
+				return
+			}
+
+			router.RedirectTo(Fmt("/sites/experiments/%s", site.ExtID.Hex()))
+		})
+
+		experimentItems[i] = Li(
+			experiment.Name,
+			If(experiment.Active, " (running)"),
+			If(
+				experiment.Active || canManage,
+				form.Form(
+					Styles(Display("inline")),
+					" // ",
+					Button(
+						Type("submit"),
+						IfElse(experiment.Active, "stop", "start"),
+					),
+				),
+			),
+			Ul(variantItems),
+		)
+	}
+
+	newForm := MakeFormData(c, "newExperiment", POST)
+	name := newForm.Var("name", "")
+	variants := newForm.Var("variants", Fmt("a %s 50\n", models.PublishedRef))
+
+	newForm.OnSubmit(func() {
+
+		parsedVariants, err := parseVariants(variants.Get())
+
+		if err != nil {
+			error.Set(err.Error())
+			return
+		}
+
+		experiment, err := site.CreateExperiment(db, UseUser(c), name.Get(), parsedVariants)
+
+		if err != nil {
+			error.Set(Fmt("cannot create experiment: %v", err))
+			return
+		}
+
+		if err := Audit(c, audit.ExperimentCreate, experiment.ExtID.Hex(), nil, map[string]any{"site": site.ExtID.Hex(), "name": experiment.Name, "variants": variants.Get()}); err != nil {
+			error.Set(err.Error())
+			return
+		}
+
+		router.RedirectTo(Fmt("/sites/experiments/%s", site.ExtID.Hex()))
+	})
+
+	return Div(
+		H2(Fmt("Experiments of %s", site.Name)),
+		If(error.Get() != "", P(error.Get())),
+		Ul(
+			experimentItems,
+		),
+		If(
+			canManage,
+			F(
+				H3("New experiment"),
+				newForm.Form(
+					Input(Placeholder("name"), Value(name)),
+					P("One variant per line: name, version (published ref, published commit or hash of an approved change) and weight"),
+					Textarea(
+						Attrib("rows")("5"),
+						Value(variants),
+					),
+					Button(
+						Type("submit"),
+						"create experiment",
+					),
+				),
+			),
+		),
+		A(Href(router.URL(Fmt("/sites/edit/%s", site.ExtID.Hex()))), "back to editor"),
+	)
+}
@@ -0,0 +1,125 @@
+package ui
+
+import (
+	"encoding/hex"
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/models"
+	. "github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+)
+
+func SiteHistory(c Context, siteID string) Element {
+	return SiteRefHistory(c, siteID, models.DraftRef)
+}
+
+func SiteRefHistory(c Context, siteID, refName string) Element {
+
+	db := func() orm.DB { return UseDB(c) }
+	router := UseRouter(c)
+
+	site, err := useSite(c, siteID)
+
+	if err != nil {
+		return Div(err.Error())
+	}
+
+	commits, err := site.RefHistory(db, refName)
+
+	if err != nil {
+		return Div(Fmt("cannot load history: %v", err))
+	}
+
+	commitItems := make([]Element, len(commits))
+
+	for i, commit := range commits {
+		commitItems[i] = Li(
+			A(
+				Href(router.URL(Fmt("/sites/history/%s/%s", site.ExtID.Hex(), commit.ExtID.Hex()))),
+				IfElse(commit.Message != "", commit.Message, "(no message)"),
+			),
+			" // ",
+			commit.AuthorEMail,
+			" // ",
+			commit.CreatedAt.String(),
+			If(i == 0, " (current)"),
+		)
+	}
+
+	return Div(
+		H2(Fmt("History of %s (%s)", site.Name, refName)),
+		SiteRefs(c, site),
+		Ul(
+			commitItems,
+		),
+		A(Href(router.URL(Fmt("/sites/edit/%s", site.ExtID.Hex()))), "back to editor"),
+	)
+}
+
+func SiteCommit(c Context, siteID, commitID string) Element {
+
+	db := func() orm.DB { return UseDB(c) }
+	router := UseRouter(c)
+	error := Var(c, "")
+
+	site, err := useSite(c, siteID)
+
+	if err != nil {
+		return Div(err.Error())
+	}
+
+	id, err := hex.DecodeString(commitID)
+
+	if err != nil {
+		return Div("invalid commit ID")
+	}
+
+	commit := orm.Init(&models.Commit{}, db)
+
+	if err := commit.ByExtID(id); err != nil || commit.SiteID != site.ID {
+		return Div("cannot find commit")
+	}
+
+	graph, err := commit.Graph(db)
+
+	if err != nil {
+		return Div(Fmt("cannot load commit: %v", err))
+	}
+
+	siteGraph, err := models.DeserializeType[models.SiteGraph](graph)
+
+	if err != nil {
+		return Div(Fmt("cannot deserialize commit: %v", err))
+	}
+
+	form := MakeFormData(c, "revert", POST)
+
+	onSubmit := func() {
+		// we restore the version in the draft, from where it can be published
+		if _, err := site.RevertRef(db, models.DraftRef, commit, UseUser(c)); err != nil {
+			error.Set(Fmt("cannot revert: %v", err))
+			return
+		}
+		if err := Audit(c, audit.RefRevert, site.ExtID.Hex(), nil, map[string]any{"ref": models.DraftRef, "commit": commit.ExtID.Hex()}); err != nil {
+			error.Set(err.Error())
+			return
+		}
+		router.RedirectTo(Fmt("/sites/history/%s", site.ExtID.Hex()))
+	}
+
+	form.OnSubmit(onSubmit)
+
+	return Div(
+		H2(IfElse(commit.Message != "", commit.Message, "(no message)")),
+		P(commit.AuthorEMail, " // ", commit.CreatedAt.String(), " // ", models.Base32Hash(commit.Hash)),
+		PreviewLinks(c, site, commit.ExtID.Hex()),
+		Pre(siteGraph.DOM.RenderCode()),
+		form.Form(
+			If(error.Get() != "", P(error.Get())),
+			Button(
+				Type("submit"),
+				"Restore this version in the draft",
+			),
+		),
+		A(Href(router.URL(Fmt("/sites/history/%s", site.ExtID.Hex()))), "back to history"),
+	)
+}
@@ -1,8 +1,10 @@
 package ui
 
 import (
+	"github.com/demakes/demake/audit"
 	"github.com/demakes/demake/auth"
 	. "github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
 	"net/http"
 	"time"
 )
@@ -62,9 +64,19 @@ func Login(c Context) Element {
 
 		// we check the token
 		if profile, err := passwordProvider.GetWithPassword(email.Get(), password.Get()); err != nil {
+			if err := Audit(c, audit.LoginFailed, "", nil, map[string]any{"email": email.Get()}); err != nil {
+				error.Set(err.Error())
+				return
+			}
 			error.Set("invalid password or username")
 			return
 		} else {
+			// the user isn't stored in the context yet, and we don't log in
+			// users if the login can't be recorded
+			if err := audit.Log(func() orm.DB { return UseDB(c) }, c.Request(), profile, audit.Login, "", nil, nil); err != nil {
+				error.Set(Fmt("cannot log in, the login couldn't be recorded in the audit log: %v", err))
+				return
+			}
 			w := c.ResponseWriter()
 			http.SetCookie(w, &http.Cookie{Path: "/", Name: "auth", Value: Hex(profile.AccessToken().Token()), Secure: false, HttpOnly: true, Expires: time.Now().Add(365 * 24 * 7 * time.Hour)})
 			router.RedirectTo("")
@@ -1,6 +1,7 @@
 package ui
 
 import (
+	"github.com/demakes/demake/audit"
 	. "github.com/gospel-sh/gospel"
 	"net/http"
 	"time"
@@ -10,6 +11,14 @@ func Logout(c Context) Element {
 
 	w := c.ResponseWriter()
 
+	auditError := ""
+
+	if UseUser(c) != nil {
+		if err := Audit(c, audit.Logout, "", nil, nil); err != nil {
+			auditError = err.Error()
+		}
+	}
+
 	http.SetCookie(w, &http.Cookie{Path: "/", Name: "auth", Value: "", Secure: false, HttpOnly: true, Expires: time.Unix(0, 0)})
 
 	// we clear the context
@@ -32,6 +41,7 @@ func Logout(c Context) Element {
 					"You have been logged out. ",
 					A(Href(UseRouter(c).URL("/login")), "Log back in."),
 				),
+				If(auditError != "", P(auditError)),
 			),
 		),
 	)
@@ -0,0 +1,81 @@
+package ui
+
+import (
+	"github.com/demakes/demake/models"
+	. "github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+	"net/url"
+	"time"
+)
+
+// how long shared preview links are valid
+const PreviewLinkValidity = 7 * 24 * time.Hour
+
+func SetPreviewSecret(c Context, secret []byte) {
+	GlobalVar(c, "previewSecret", secret)
+}
+
+func UsePreviewSecret(c Context) []byte {
+	return UseGlobal[[]byte](c, "previewSecret")
+}
+
+// returns the path of the preview for a version of the site
+func previewPath(site *models.Site, version string) string {
+	return Fmt("/sites/view/%s/at/%s", site.ExtID.Hex(), version)
+}
+
+// shows a link to the preview of a site version and allows creating a signed
+// link for it that can be shared with people without an account
+func PreviewLinks(c Context, site *models.Site, version string) Element {
+
+	db := func() orm.DB { return UseDB(c) }
+	router := UseRouter(c)
+	secret := UsePreviewSecret(c)
+	form := MakeFormData(c, Fmt("share-%s", version), POST)
+	link := Var(c, "")
+	error := Var(c, "")
+
+	form.OnSubmit(func() {
+
+		// we sign the hash of the version, so the link doesn't show later
+		// changes of a ref
+		hash, err := site.VersionHash(db, version)
+
+		if err != nil {
+			error.Set(Fmt("cannot create share link: %v", err))
+			return
+		}
+
+		expires := time.Now().Add(PreviewLinkValidity)
+		signature := models.SignPreview(secret, site.ExtID.Hex(), hash, expires)
+
+		query := url.Values{}
+		query.Set("expires", Fmt("%d", expires.Unix()))
+		query.Set("signature", signature)
+
+		link.Set(router.URL(previewPath(site, hash)) + "?" + query.Encode())
+	})
+
+	return Div(
+		If(error.Get() != "", P(error.Get())),
+		A(Href(router.URL(previewPath(site, version))), "preview"),
+		If(
+			len(secret) > 0,
+			form.Form(
+				Styles(Display("inline")),
+				" // ",
+				Button(
+					Type("submit"),
+					"create share link",
+				),
+			),
+		),
+		If(
+			link.Get() != "",
+			P(
+				"This link is valid for 7 days: ",
+				A(Href(link.Get()), link.Get()),
+			),
+		),
+	)
+}
@@ -0,0 +1,118 @@
+package ui
+
+import (
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/models"
+	. "github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+)
+
+// lists the refs of a site and allows proposing them for publishing or
+// creating new ones
+func SiteRefs(c Context, site *models.Site) Element {
+
+	db := func() orm.DB { return UseDB(c) }
+	router := UseRouter(c)
+	error := Var(c, "")
+
+	refs, err := site.Refs(db)
+
+	if err != nil {
+		return Div(Fmt("cannot load refs: %v", err))
+	}
+
+	refItems := make([]Element, len(refs))
+
+	for i, ref := range refs {
+
+		refName := ref.Name
+
+		var publishForm Element
+
+		if refName != models.PublishedRef {
+
+			form := MakeFormData(c, Fmt("publish-%s", refName), POST)
+
+			description := form.Var("description", "")
+
+			// changes can only be published after they were approved
+			form.OnSubmit(func() {
+				changeRequest, err := site.ProposeChange(db, refName, UseUser(c), description.Get())
+				if err != nil {
+					error.Set(Fmt("cannot propose '%s': %v", refName, err))
+					return
+				}
+				if err := Audit(c, audit.ChangePropose, changeRequest.ExtID.Hex(), nil, map[string]any{"site": site.ExtID.Hex(), "ref": refName, "head": Hex(changeRequest.Hash)}); err != nil {
+					error.Set(err.Error())
+					return
+				}
+				router.RedirectTo(Fmt("/sites/changes/%s/%s", site.ExtID.Hex(), changeRequest.ExtID.Hex()))
+			})
+
+			publishForm = form.Form(
+				Styles(Display("inline")),
+				Input(Placeholder("describe the changes"), Value(description)),
+				Button(
+					Type("submit"),
+					"propose for publishing",
+				),
+			)
+		}
+
+		refItems[i] = Li(
+			A(
+				Href(router.URL(Fmt("/sites/history/%s/ref/%s", site.ExtID.Hex(), refName))),
+				refName,
+			),
+			" // ",
+			A(
+				Href(router.URL(previewPath(site, refName))),
+				"preview",
+			),
+			If(
+				refName != models.PublishedRef,
+				F(
+					" // ",
+					A(
+						Href(router.URL(Fmt("/sites/edit/%s/ref/%s", site.ExtID.Hex(), refName))),
+						"edit",
+					),
+					" // ",
+					publishForm,
+				),
+			),
+			If(site.HeadID != nil && ref.HeadID == *site.HeadID, " (live)"),
+		)
+	}
+
+	newRefForm := MakeFormData(c, "newRef", POST)
+	name := newRefForm.Var("name", "")
+
+	newRefForm.OnSubmit(func() {
+		ref, err := site.CreateRef(db, name.Get(), models.DraftRef)
+		if err != nil {
+			error.Set(Fmt("cannot create ref: %v", err))
+			return
+		}
+		if err := Audit(c, audit.RefCreate, site.ExtID.Hex(), nil, map[string]any{"ref": ref.Name, "from": models.DraftRef}); err != nil {
+			error.Set(err.Error())
+			return
+		}
+		router.RedirectTo(Fmt("/sites/edit/%s/ref/%s", site.ExtID.Hex(), name.Get()))
+	})
+
+	return Div(
+		If(error.Get() != "", P(error.Get())),
+		Ul(
+			refItems,
+		),
+		A(Href(router.URL(Fmt("/sites/changes/%s", site.ExtID.Hex()))), "change requests"),
+		newRefForm.Form(
+			Input(Placeholder("name of the new branch"), Value(name)),
+			Button(
+				Type("submit"),
+				"create branch from draft",
+			),
+		),
+	)
+}
@@ -3,6 +3,7 @@ package ui
 import (
 	"encoding/hex"
 	"fmt"
+	"github.com/demakes/demake/audit"
 	"github.com/demakes/demake/auth"
 	"github.com/demakes/demake/models"
 	. "github.com/gospel-sh/gospel"
@@ -17,6 +18,17 @@ func UseDB(c Context) orm.DB {
 	return UseGlobal[orm.DB](c, "db")
 }
 
+// records an action of the current user in the audit log. If this fails, the
+// error is shown to the user instead of continuing, even though the action
+// itself was already performed.
+func Audit(c Context, action, targetID string, before, after any) error {
+	db := func() orm.DB { return UseDB(c) }
+	if err := audit.Log(db, c.Request(), UseUser(c), action, targetID, before, after); err != nil {
+		return fmt.Errorf("the action was performed, but it couldn't be recorded in the audit log: %v", err)
+	}
+	return nil
+}
+
 func SetUser(c Context, user auth.UserProfile) {
 	GlobalVar(c, "user", user)
 }
@@ -104,6 +116,14 @@ func AuthorizedContent(c Context) Element {
 					"/sites",
 					Sites,
 				),
+				Route(
+					"/audit$",
+					AuditLog,
+				),
+				Route(
+					"/usage$",
+					NodeUsage,
+				),
 				Route(
 					"",
 					NotFound,
@@ -113,12 +133,9 @@ func AuthorizedContent(c Context) Element {
 	)
 }
 
-func GetGraph(site *models.Site, dbf func() orm.DB) (*models.SiteGraph, error) {
-	if site.HeadID == nil {
-		return nil, fmt.Errorf("site doesn't have a head")
-	}
+func GetGraph(headID int64, dbf func() orm.DB) (*models.SiteGraph, error) {
 
-	graph, err := models.GetGraphByID(dbf, *site.HeadID)
+	graph, err := models.MakeSQLStore(dbf).GetByID(headID)
 
 	if err != nil {
 		return nil, fmt.Errorf("cannot get graph: %v", err)
@@ -136,11 +153,26 @@ func GetGraph(site *models.Site, dbf func() orm.DB) (*models.SiteGraph, error) {
 
 func ServeSite(db orm.DB, site *models.Site) func(c Context) Element {
 
+	return func(c Context) Element {
+
+		if site.HeadID == nil {
+			return Div("Cannot load site: site doesn't have a head")
+		}
+
+		return ServeSiteVersion(db, *site.HeadID)(c)
+	}
+
+}
+
+// serves the version of a site with the given head
+func ServeSiteVersion(db orm.DB, headID int64) func(c Context) Element {
+
 	dbf := func() orm.DB { return db }
 
 	return func(c Context) Element {
 
-		siteGraph, err := GetGraph(site, dbf)
+		// the graph is shared between requests, so we must not modify it
+		siteGraph, err := models.CachedSiteGraph(dbf, headID)
 
 		if err != nil {
 			return Div(Fmt("Cannot load site: %v", err))
@@ -157,7 +189,53 @@ func ServeSite(db orm.DB, site *models.Site) func(c Context) Element {
 
 }
 
-func Root(db orm.DB, profileProvider auth.UserProfileProvider) func(c Context) Element {
+// serves a specific version of a site, which requires either a logged-in
+// user or a valid signed preview link
+func PreviewSite(c Context, siteID, version string) Element {
+
+	db := UseDB(c)
+	router := UseRouter(c)
+	signed := UseUser(c) == nil
+
+	if signed {
+
+		query := c.Request().URL.Query()
+
+		if query.Get("signature") == "" {
+			router.RedirectTo("/login")
+			return nil
+		}
+
+		if err := models.VerifyPreview(UsePreviewSecret(c), siteID, version, query.Get("expires"), query.Get("signature")); err != nil {
+			return Div(Fmt("Cannot show preview: %v", err))
+		}
+	}
+
+	site, err := useSite(c, siteID)
+
+	if err != nil {
+		return Div(err.Error())
+	}
+
+	var headID int64
+
+	if signed {
+		// signed links always refer to a version by its hash, which was
+		// checked by VerifyPreview
+		hash, _ := models.ParseHash(version)
+		headID, err = site.ResolveHash(func() orm.DB { return db }, hash)
+	} else {
+		headID, err = site.ResolveVersion(func() orm.DB { return db }, version)
+	}
+
+	if err != nil {
+		return Div(Fmt("Cannot load version: %v", err))
+	}
+
+	return ServeSiteVersion(db, headID)(c)
+}
+
+func Root(db orm.DB, profileProvider auth.UserProfileProvider, previewSecret []byte) func(c Context) Element {
 
 	dbf := func() orm.DB { return db }
 
@@ -165,6 +243,7 @@ func Root(db orm.DB, profileProvider auth.UserProfileProvider) func(c Context) E
 
 		SetDB(c, db)
 		SetProfileProvider(c, profileProvider)
+		SetPreviewSecret(c, previewSecret)
 
 		// if the user isn't logged in, we redirect to the login screen
 		if user, err := profileProvider.Get(c.Request()); err == nil {
@@ -176,6 +255,7 @@ func Root(db orm.DB, profileProvider auth.UserProfileProvider) func(c Context) E
 
 		site := router.Match(
 			c,
+			Route(`/sites/view/([a-f0-9\-]+)/at/([a-z0-9\-_]+)$`, PreviewSite),
 			Route(`/sites/view/([a-f0-9\-]+)`, func(c Context, siteID string) Element {
 
 				id, err := hex.DecodeString(siteID)
@@ -0,0 +1,153 @@
+package ui
+
+import (
+	"fmt"
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/models"
+	. "github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+	"strings"
+	"time"
+)
+
+// the format of scheduled times, which are always given in UTC
+const scheduleTimeFormat = "2006-01-02 15:04"
+
+func parseScheduleTime(value string) (time.Time, error) {
+
+	t, err := time.ParseInLocation(scheduleTimeFormat, strings.TrimSpace(value), time.UTC)
+
+	if err != nil {
+		return t, fmt.Errorf("invalid time '%s', expected 'YYYY-MM-DD HH:MM' (UTC)", value)
+	}
+
+	return t, nil
+}
+
+// lists the schedules of a site and allows scheduling route expiries
+func SiteSchedules(c Context, siteID string) Element {
+
+	db := func() orm.DB { return UseDB(c) }
+	router := UseRouter(c)
+	user := UseUser(c)
+	error := Var(c, "")
+
+	site, err := useSite(c, siteID)
+
+	if err != nil {
+		return Div(err.Error())
+	}
+
+	schedules, err := site.Schedules(db)
+
+	if err != nil {
+		return Div(Fmt("cannot load schedules: %v", err))
+	}
+
+	path := Fmt("/sites/schedules/%s", site.ExtID.Hex())
+
+	items := make([]Element, len(schedules))
+
+	// we show the most recent schedules first
+	for i, schedule := range schedules {
+
+		schedule := schedule
+
+		cancelForm := MakeFormData(c, Fmt("cancel-%s", schedule.ExtID.Hex()), POST)
+
+		cancelForm.OnSubmit(func() {
+			if err := schedule.Cancel(db, user); err != nil {
+				error.Set(Fmt("cannot cancel schedule: %v", err))
+				return
+			}
+			if err := Audit(c, audit.ScheduleCancel, schedule.ExtID.Hex(), map[string]any{"status": models.SchedulePending}, map[string]any{"status": schedule.Status}); err != nil {
+				error.Set(err.Error())
+				return
+			}
+			router.RedirectTo(path)
+		})
+
+		description := "publish"
+
+		if schedule.Action == models.ScheduleExpireRoute {
+			description = Fmt("expire route '%s'", schedule.Route)
+		} else if schedule.ChangeRequestID != nil {
+			description = "publish change request"
+		}
+
+		items[len(schedules)-1-i] = Li(
+			description,
+			" // ",
+			schedule.RunAt.Time.UTC().Format(scheduleTimeFormat),
+			" UTC // ",
+			schedule.AuthorEMail,
+			" // ",
+			Strong(schedule.Status),
+			If(schedule.Error != "", F(": ", schedule.Error)),
+			If(
+				schedule.Status == models.SchedulePending && schedule.CanCancel(user),
+				cancelForm.Form(
+					Styles(Display("inline")),
+					" // ",
+					Button(
+						Type("submit"),
+						"cancel",
+					),
+				),
+			),
+		)
+	}
+
+	expiryForm := MakeFormData(c, "expireRoute", POST)
+	route := expiryForm.Var("route", "")
+	at := expiryForm.Var("at", "")
+
+	canExpire := models.CanManageSchedules(user)
+
+	expiryForm.OnSubmit(func() {
+
+		runAt, err := parseScheduleTime(at.Get())
+
+		if err != nil {
+			error.Set(err.Error())
+			return
+		}
+
+		schedule, err := site.ScheduleRouteExpiry(db, route.Get(), runAt, user)
+
+		if err != nil {
+			error.Set(Fmt("cannot schedule route expiry: %v", err))
+			return
+		}
+
+		if err := Audit(c, audit.ScheduleCreate, schedule.ExtID.Hex(), nil, map[string]any{"site": site.ExtID.Hex(), "action": schedule.Action, "route": schedule.Route, "runAt": schedule.RunAt.String()}); err != nil {
+			error.Set(err.Error())
+			return
+		}
+
+		router.RedirectTo(path)
+	})
+
+	return Div(
+		H2(Fmt("Schedules of %s", site.Name)),
+		If(error.Get() != "", P(error.Get())),
+		Ul(
+			items,
+		),
+		If(
+			canExpire,
+			Div(
+				H3("Expire a route"),
+				expiryForm.Form(
+					Input(Placeholder("route, e.g. /summer-sale"), Value(route)),
+					Input(Placeholder("YYYY-MM-DD HH:MM (UTC)"), Value(at)),
+					Button(
+						Type("submit"),
+						"schedule expiry",
+					),
+				),
+			),
+		),
+		A(Href(router.URL(Fmt("/sites/edit/%s", site.ExtID.Hex()))), "back to editor"),
+	)
+}
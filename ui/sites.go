@@ -1,6 +1,10 @@
 package ui
 
 import (
+	"encoding/hex"
+	"fmt"
+	"github.com/demakes/demake/audit"
+	"github.com/demakes/demake/auth"
 	"github.com/demakes/demake/models"
 	. "github.com/gospel-sh/gospel"
 	"github.com/gospel-sh/gospel/orm"
@@ -11,6 +15,26 @@ func getSites(c Context) ([]*models.Site, error) {
 	return orm.Objects[models.Site](db, map[string]any{})
 }
 
+// loads a site by its hex-encoded external ID
+func useSite(c Context, siteID string) (*models.Site, error) {
+
+	db := func() orm.DB { return UseDB(c) }
+
+	id, err := hex.DecodeString(siteID)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID")
+	}
+
+	site := orm.Init(&models.Site{}, db)
+
+	if err := site.ByExtID(id); err != nil {
+		return nil, fmt.Errorf("cannot find site")
+	}
+
+	return site, nil
+}
+
 func NewSite(c Context) Element {
 
 	db := func() orm.DB { return UseDB(c) }
@@ -79,18 +103,32 @@ func NewSite(c Context) Element {
 			return
 		}
 
-		if err := node.SaveTree(db()); err != nil {
+		if err := models.MakeSQLStore(db).PutTree(node); err != nil {
 			error.Set(Fmt("cannot save tree: %v", err))
 			return
 		}
 
-		newSite.HeadID = &node.ID
-
 		if err := newSite.Save(); err != nil {
 			error.Set("cannot save site")
 			return
 		}
 
+		if _, err := newSite.CommitHead(db, node, UseUser(c), "Initial version"); err != nil {
+			error.Set(Fmt("cannot commit: %v", err))
+			return
+		}
+
+		// changes are made in the draft and published explicitly
+		if _, err := newSite.CreateRef(db, models.DraftRef, models.PublishedRef); err != nil {
+			error.Set(Fmt("cannot create draft: %v", err))
+			return
+		}
+
+		if err := Audit(c, audit.SiteCreate, newSite.ExtID.Hex(), nil, map[string]any{"name": newSite.Name, "hostname": newSite.Hostname}); err != nil {
+			error.Set(err.Error())
+			return
+		}
+
 		UseRouter(c).RedirectTo("/sites")
 	}
 
@@ -110,6 +148,80 @@ func NewSite(c Context) Element {
 
 }
 
+// allows changing the name and hostname of a site
+func SiteSettings(c Context, siteID string) Element {
+
+	router := UseRouter(c)
+
+	site, err := useSite(c, siteID)
+
+	if err != nil {
+		return Div(err.Error())
+	}
+
+	formData := MakeFormData(c, "siteSettings", POST)
+	error := Var[string](c, "")
+	name := formData.Var("name", site.Name)
+	hostname := formData.Var("hostname", site.Hostname)
+
+	formData.OnSubmit(func() {
+
+		if len(name.Get()) == 0 {
+			error.Set("please enter a name")
+			return
+		}
+
+		if len(hostname.Get()) == 0 {
+			error.Set("please enter a hostname")
+			return
+		}
+
+		sites, err := getSites(c)
+
+		if err != nil {
+			error.Set(Fmt("cannot load sites: %v", err))
+			return
+		}
+
+		for _, other := range sites {
+			if other.ID != site.ID && (other.Hostname == hostname.Get() || other.Name == name.Get()) {
+				error.Set("a site with this name or hostname already exists")
+				return
+			}
+		}
+
+		before := map[string]any{"name": site.Name, "hostname": site.Hostname}
+
+		site.Name = name.Get()
+		site.Hostname = hostname.Get()
+
+		if err := site.Save(); err != nil {
+			error.Set(Fmt("cannot save site: %v", err))
+			return
+		}
+
+		if err := Audit(c, audit.SiteUpdate, site.ExtID.Hex(), before, map[string]any{"name": site.Name, "hostname": site.Hostname}); err != nil {
+			error.Set(err.Error())
+			return
+		}
+
+		router.RedirectTo("/sites")
+	})
+
+	return Div(
+		H2(Fmt("Settings of %s", site.Name)),
+		formData.Form(
+			If(error.Get() != "", error.Get()),
+			Input(Placeholder("name"), Value(name)),
+			Input(Placeholder("hostname"), Value(hostname)),
+			Button(
+				Type("submit"),
+				"save",
+			),
+		),
+	)
+}
+
 func SiteList(c Context) Element {
 
 	sites, err := getSites(c)
@@ -120,12 +232,43 @@ func SiteList(c Context) Element {
 
 	siteItems := make([]Element, len(sites))
 
+	db := func() orm.DB { return UseDB(c) }
+
 	for i, site := range sites {
+
+		domain := ""
+
+		// we only load the metadata, not the entire site graph
+		if meta, err := site.LoadMeta(db); err == nil {
+			domain = meta.Domain
+		}
+
 		siteItems[i] = Li(
 			A(
 				Href(UseRouter(c).URL(Fmt("/sites/edit/%s", site.ExtID.Hex()))),
 				site.Name,
 			),
+			If(domain != "", F(" (", domain, ")")),
+			" // ",
+			A(
+				Href(UseRouter(c).URL(Fmt("/sites/history/%s", site.ExtID.Hex()))),
+				"history",
+			),
+			" // ",
+			A(
+				Href(UseRouter(c).URL(Fmt("/sites/experiments/%s", site.ExtID.Hex()))),
+				"experiments",
+			),
+			" // ",
+			A(
+				Href(UseRouter(c).URL(Fmt("/sites/schedules/%s", site.ExtID.Hex()))),
+				"schedules",
+			),
+			" // ",
+			A(
+				Href(UseRouter(c).URL(Fmt("/sites/settings/%s", site.ExtID.Hex()))),
+				"settings",
+			),
 			" // ",
 			site.CreatedAt.String(),
 			" // ",
@@ -133,11 +276,28 @@ func SiteList(c Context) Element {
 		)
 	}
 
+	siteStats := models.SiteCache.Stats()
+	graphStats := models.SiteGraphCache.Stats()
+
 	return Div(
 		Ul(
 			siteItems,
 		),
 		A(Href(UseRouter(c).URL("/sites/new")), "new site"),
+		If(
+			auth.HasRole(UseUser(c), auth.AdminRole),
+			F(
+				" // ", A(Href(UseRouter(c).URL("/audit")), "audit log"),
+				" // ", A(Href(UseRouter(c).URL("/usage")), "node usage"),
+			),
+		),
+		P(
+			Fmt(
+				"Cache: %d sites (%d hits, %d misses), %d graphs (%d hits, %d misses)",
+				siteStats.Entries, siteStats.Hits, siteStats.Misses,
+				graphStats.Entries, graphStats.Hits, graphStats.Misses,
+			),
+		),
 	)
 }
 
@@ -149,7 +309,16 @@ func Sites(c Context) Element {
 		UseRouter(c).Match(
 			c,
 			Route("/new$", NewSite),
+			Route(`/edit/([a-f0-9\-]+)/ref/([a-z0-9\-_]+)$`, EditSiteRef),
 			Route(`/edit/([a-f0-9\-]+)`, EditSite),
+			Route(`/history/([a-f0-9\-]+)/ref/([a-z0-9\-_]+)$`, SiteRefHistory),
+			Route(`/history/([a-f0-9\-]+)/([a-f0-9\-]+)$`, SiteCommit),
+			Route(`/history/([a-f0-9\-]+)$`, SiteHistory),
+			Route(`/experiments/([a-f0-9\-]+)$`, SiteExperiments),
+			Route(`/settings/([a-f0-9\-]+)$`, SiteSettings),
+			Route(`/changes/([a-f0-9\-]+)/([a-f0-9\-]+)$`, SiteChangeRequest),
+			Route(`/changes/([a-f0-9\-]+)$`, SiteChangeRequests),
+			Route(`/schedules/([a-f0-9\-]+)$`, SiteSchedules),
 			Route("$", SiteList),
 		),
 	)
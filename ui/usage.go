@@ -0,0 +1,107 @@
+package ui
+
+import (
+	"github.com/demakes/demake/auth"
+	"github.com/demakes/demake/models"
+	. "github.com/gospel-sh/gospel"
+	"github.com/gospel-sh/gospel/orm"
+	"strings"
+)
+
+// shows where a node (e.g. a shared component) is used, so admins can see
+// which sites are affected before changing it
+func NodeUsage(c Context) Element {
+
+	db := func() orm.DB { return UseDB(c) }
+	router := UseRouter(c)
+
+	if !auth.HasRole(UseUser(c), auth.AdminRole) {
+		return Div("Only admins can look up where nodes are used.")
+	}
+
+	form := MakeFormData(c, "usage", POST)
+	hashValue := form.Var("hash", "")
+
+	form.OnSubmit(func() {})
+
+	lookupForm := form.Form(
+		Input(Placeholder("hash of the node (hex or base32)"), Value(hashValue)),
+		Button(
+			Type("submit"),
+			"look up",
+		),
+	)
+
+	if strings.TrimSpace(hashValue.Get()) == "" {
+		return Div(
+			H2("Used in"),
+			lookupForm,
+		)
+	}
+
+	result := func(content ...any) Element {
+		return Div(
+			H2("Used in"),
+			lookupForm,
+			Div(content...),
+		)
+	}
+
+	hash, err := models.ParseHash(strings.TrimSpace(hashValue.Get()))
+
+	if err != nil {
+		return result(P(err.Error()))
+	}
+
+	node := &models.Node{Hash: hash}
+	usage, err := models.FindUsage(db, node)
+
+	if err == models.ErrNodeNotFound {
+		return result(P("There is no node with this hash."))
+	} else if err != nil {
+		return result(P(Fmt("cannot look up usage: %v", err)))
+	}
+
+	refs := make([]Element, len(usage.Refs))
+
+	for i, refUsage := range usage.Refs {
+
+		paths := make([]Element, len(refUsage.Paths))
+
+		for j, path := range refUsage.Paths {
+			paths[j] = Li(IfElse(path == "", "head", path))
+		}
+
+		refs[i] = Li(
+			A(
+				Href(router.URL(Fmt("/sites/edit/%s/ref/%s", refUsage.Site.ExtID.Hex(), refUsage.Ref.Name))),
+				refUsage.Site.Name,
+			),
+			" // ",
+			refUsage.Site.Hostname,
+			" // ",
+			Strong(refUsage.Ref.Name),
+			Ul(paths),
+		)
+	}
+
+	parents := make([]Element, len(usage.Parents))
+
+	for i, edge := range usage.Parents {
+		parents[i] = Li(
+			edge.From.Type,
+			" ",
+			models.Base32Hash(edge.From.Hash),
+			" // ",
+			edge.Name,
+		)
+	}
+
+	return result(
+		H3(Fmt("Sites (%d)", len(usage.Sites()))),
+		If(len(refs) == 0, P("The node isn't used by any site.")),
+		Ul(refs),
+		H3(Fmt("Parent nodes (%d)", len(parents))),
+		Ul(parents),
+	)
+}